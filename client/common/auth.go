@@ -0,0 +1,97 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// LoadSecret Reads the secret of the agency. Whitespace around it, such
+// as the newline editors add, is not part of the secret, as the server
+// trims the secrets of the agencies too
+func LoadSecret(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the secret file")
+	}
+	secret := bytes.TrimSpace(content)
+	if len(secret) == 0 {
+		return nil, errors.Errorf("secret file %s is empty", path)
+	}
+	return secret, nil
+}
+
+// connectAgency Opens a connection for the binary protocol and, when a
+// secret file is configured, authenticates the agency on it. The
+// connection is closed if the authentication fails
+func (c *Client) connectAgency(ctx context.Context) error {
+	if err := c.Connect(ctx); err != nil {
+		return err
+	}
+	return c.authenticateAgency(ctx)
+}
+
+// reconnectAgency Like connectAgency, but the server is dialed only once,
+// for the callers that retry on their own
+func (c *Client) reconnectAgency(ctx context.Context) error {
+	if err := c.reconnect(ctx); err != nil {
+		return err
+	}
+	return c.authenticateAgency(ctx)
+}
+
+// authenticateAgency Authenticates the agency on the current connection
+// when a secret file is configured. The connection is closed if the
+// authentication fails
+func (c *Client) authenticateAgency(ctx context.Context) error {
+	if c.config.SecretFile == "" {
+		return nil
+	}
+
+	start := time.Now()
+	err := c.authenticate(ctx)
+	c.observe("authenticate", start, err)
+	if err != nil {
+		c.Close()
+		log.Error(NewEvent("authenticate", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	log.Debug(NewEvent("authenticate", "success", "client_id", c.config.ID))
+	return nil
+}
+
+// authenticate Sends a HELLO and answers the CHALLENGE of the server with
+// the HMAC of its nonce, keyed with the secret of the agency
+func (c *Client) authenticate(ctx context.Context) error {
+	secret, err := LoadSecret(c.config.SecretFile)
+	if err != nil {
+		return err
+	}
+	agencyID, err := c.agencyID()
+	if err != nil {
+		return err
+	}
+
+	if err := c.Send(ctx, &protocol.Hello{}); err != nil {
+		return err
+	}
+	res, err := c.Receive(ctx)
+	if err != nil {
+		return err
+	}
+	challenge, ok := res.(*protocol.Challenge)
+	if !ok {
+		return errors.Wrapf(protocol.ErrUnexpectedMessage, "expected %v, got %v", protocol.KindChallenge, res.Kind())
+	}
+
+	mac := protocol.SignChallenge(secret, agencyID, challenge.Nonce)
+	return c.exchange(ctx, &protocol.Authenticate{MAC: mac})
+}
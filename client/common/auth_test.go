@@ -0,0 +1,25 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadSecretTrimsWhitespaceAroundTheSecret(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(" \tsecret 1 \r\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secret, err := LoadSecret(path)
+	if err != nil || string(secret) != "secret 1" {
+		t.Fatalf("expected %q, got %q and %v", "secret 1", secret, err)
+	}
+
+	if err := os.WriteFile(path, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadSecret(path); err == nil {
+		t.Fatal("expected a blank secret to be rejected")
+	}
+}
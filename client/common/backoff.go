@@ -0,0 +1,75 @@
+package common
+
+import (
+	"math/rand"
+	"time"
+)
+
+// BackoffConfig Configuration of an exponential backoff with jitter
+type BackoffConfig struct {
+	// Initial Delay before the first retry
+	Initial time.Duration
+	// Max Upper bound for a single delay
+	Max time.Duration
+	// Multiplier Factor applied to the delay after every retry
+	Multiplier float64
+	// Jitter Fraction of the delay that is randomized, between 0 and 1
+	Jitter float64
+	// MaxWait Upper bound for the sum of all the delays. Zero means no bound
+	MaxWait time.Duration
+}
+
+// backoff Computes the delays between consecutive retries
+type backoff struct {
+	config  BackoffConfig
+	next    time.Duration
+	elapsed time.Duration
+	rand    *rand.Rand
+}
+
+func newBackoff(config BackoffConfig) *backoff {
+	if config.Multiplier < 1 {
+		config.Multiplier = 1
+	}
+	if config.Jitter < 0 {
+		config.Jitter = 0
+	}
+	if config.Jitter > 1 {
+		config.Jitter = 1
+	}
+	return &backoff{
+		config: config,
+		next:   config.Initial,
+		rand:   rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Next Returns the delay to wait before the next retry. The second value
+// is false once the max wait time was exhausted and no retry should be made
+func (b *backoff) Next() (time.Duration, bool) {
+	delay := b.next
+	if b.config.Max > 0 && delay > b.config.Max {
+		delay = b.config.Max
+	}
+	b.next = time.Duration(float64(b.next) * b.config.Multiplier)
+	if b.config.Max > 0 && b.next > b.config.Max {
+		b.next = b.config.Max
+	}
+
+	// Randomize the delay in [delay * (1 - jitter), delay * (1 + jitter)]
+	if b.config.Jitter > 0 {
+		spread := float64(delay) * b.config.Jitter
+		delay = time.Duration(float64(delay) - spread + 2*spread*b.rand.Float64())
+	}
+
+	if b.config.MaxWait > 0 {
+		if b.elapsed >= b.config.MaxWait {
+			return 0, false
+		}
+		if b.elapsed+delay > b.config.MaxWait {
+			delay = b.config.MaxWait - b.elapsed
+		}
+	}
+	b.elapsed += delay
+	return delay, true
+}
@@ -0,0 +1,60 @@
+package common
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffGrowsUntilMax(t *testing.T) {
+	retries := newBackoff(BackoffConfig{
+		Initial:    100 * time.Millisecond,
+		Max:        400 * time.Millisecond,
+		Multiplier: 2,
+	})
+
+	expected := []time.Duration{100, 200, 400, 400}
+	for i, want := range expected {
+		delay, ok := retries.Next()
+		if !ok {
+			t.Fatalf("retry %d: unexpected end of retries", i)
+		}
+		if delay != want*time.Millisecond {
+			t.Fatalf("retry %d: expected %v, got %v", i, want*time.Millisecond, delay)
+		}
+	}
+}
+
+func TestBackoffJitterStaysInRange(t *testing.T) {
+	retries := newBackoff(BackoffConfig{
+		Initial:    time.Second,
+		Multiplier: 1,
+		Jitter:     0.5,
+	})
+
+	for i := 0; i < 100; i++ {
+		delay, _ := retries.Next()
+		if delay < 500*time.Millisecond || delay > 1500*time.Millisecond {
+			t.Fatalf("delay %v out of range", delay)
+		}
+	}
+}
+
+func TestBackoffStopsAfterMaxWait(t *testing.T) {
+	retries := newBackoff(BackoffConfig{
+		Initial:    time.Second,
+		Multiplier: 1,
+		MaxWait:    2500 * time.Millisecond,
+	})
+
+	var total time.Duration
+	for {
+		delay, ok := retries.Next()
+		if !ok {
+			break
+		}
+		total += delay
+	}
+	if total != 2500*time.Millisecond {
+		t.Fatalf("expected to wait 2.5s, waited %v", total)
+	}
+}
@@ -0,0 +1,486 @@
+package common
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+const betCSVFields = 5
+
+// agencyFileName Name of the file that holds the bets of an agency
+func agencyFileName(agencyID string) string {
+	return fmt.Sprintf("agency-%s.csv", agencyID)
+}
+
+// zipEntry Keeps the zip archive open for as long as the entry is read
+type zipEntry struct {
+	io.ReadCloser
+	archive *zip.ReadCloser
+}
+
+func (e *zipEntry) Close() error {
+	err := e.ReadCloser.Close()
+	if archiveErr := e.archive.Close(); err == nil {
+		err = archiveErr
+	}
+	return err
+}
+
+// openAgencyBets Opens the CSV file with the bets of the agency. The
+// dataset path can be a zip file holding agency-N.csv files, a directory
+// holding the extracted files, or the CSV file itself
+func openAgencyBets(dataset string, agencyID string) (io.ReadCloser, error) {
+	name := agencyFileName(agencyID)
+	if strings.HasSuffix(strings.ToLower(dataset), ".zip") {
+		archive, err := zip.OpenReader(dataset)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range archive.File {
+			if filepath.Base(file.Name) != name {
+				continue
+			}
+			entry, err := file.Open()
+			if err != nil {
+				archive.Close()
+				return nil, err
+			}
+			return &zipEntry{ReadCloser: entry, archive: archive}, nil
+		}
+		archive.Close()
+		return nil, errors.Errorf("%s not found in %s", name, dataset)
+	}
+
+	info, err := os.Stat(dataset)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		dataset = filepath.Join(dataset, name)
+	}
+	return os.Open(dataset)
+}
+
+// betReader Reads the bets of an agency from its CSV file, one row at a
+// time. Rows are read line by line so the offset of every bet in the file
+// is known, which means fields can not hold line breaks
+type betReader struct {
+	lines *bufio.Reader
+	// offset Position in the file right after the last bet read
+	offset int64
+	line   int
+	// row Last row read, without its line break
+	row string
+}
+
+func newBetReader(r io.Reader) *betReader {
+	return &betReader{lines: bufio.NewReader(r)}
+}
+
+// Skip Discards the given amount of bytes, e.g. to resume from the offset
+// of a checkpoint. Lines keep being numbered from the start of the file
+func (r *betReader) Skip(offset int64) error {
+	lines := &lineCounter{}
+	skipped, err := io.CopyN(lines, r.lines, offset)
+	r.offset += skipped
+	r.line += lines.lines
+	if err == io.EOF {
+		return errors.Errorf("offset %d is past the end of the file, at %d", offset, r.offset)
+	}
+	return err
+}
+
+// lineCounter Writer that counts the line breaks written to it
+type lineCounter struct {
+	lines int
+}
+
+func (c *lineCounter) Write(b []byte) (int, error) {
+	c.lines += bytes.Count(b, []byte{'\n'})
+	return len(b), nil
+}
+
+// Next Returns the next bet in the file, or io.EOF once all the bets
+// were read
+func (r *betReader) Next() (protocol.Bet, error) {
+	for {
+		line, err := r.lines.ReadBytes('\n')
+		if len(line) == 0 {
+			return protocol.Bet{}, err
+		}
+		if err != nil && err != io.EOF {
+			return protocol.Bet{}, err
+		}
+		r.offset += int64(len(line))
+		r.line++
+
+		line = bytes.TrimRight(line, "\r\n")
+		if len(line) == 0 {
+			continue
+		}
+		r.row = string(line)
+		reader := csv.NewReader(bytes.NewReader(line))
+		reader.FieldsPerRecord = betCSVFields
+		record, err := reader.Read()
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			parseErr.StartLine, parseErr.Line = r.line, r.line
+		}
+		if err != nil {
+			return protocol.Bet{}, err
+		}
+		return protocol.Bet{
+			FirstName: record[0],
+			LastName:  record[1],
+			Document:  record[2],
+			Birthdate: record[3],
+			Number:    record[4],
+		}, nil
+	}
+}
+
+// batcher Groups the bets read from a betReader in batches that have at
+// most maxAmount bets and fit in a single protocol message. Rows found
+// invalid by the validator are left out of the batches
+type batcher struct {
+	bets      *betReader
+	validator *betValidator
+	maxAmount int
+	pending   *protocol.Bet
+	// pendingOffset, offset Position in the file right after the pending
+	// bet, and right after the last bet returned
+	pendingOffset int64
+	offset        int64
+}
+
+func newBatcher(bets *betReader, validator *betValidator, maxAmount int) *batcher {
+	if maxAmount < 1 {
+		maxAmount = 1
+	}
+	return &batcher{bets: bets, validator: validator, maxAmount: maxAmount, offset: bets.offset}
+}
+
+// Offset Returns the position in the file right after the last bet of
+// the last batch returned by Next
+func (b *batcher) Offset() int64 {
+	return b.offset
+}
+
+// Next Returns the next batch of bets, or io.EOF once all the bets were
+// returned
+func (b *batcher) Next() ([]protocol.Bet, error) {
+	var batch []protocol.Bet
+	size := protocol.RequestHeaderSize + protocol.BetBatchHeaderSize
+	for len(batch) < b.maxAmount {
+		var bet protocol.Bet
+		var offset int64
+		if b.pending != nil {
+			bet, offset = *b.pending, b.pendingOffset
+			b.pending = nil
+		} else {
+			next, err := b.bets.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil && !isRowError(err) {
+				return nil, err
+			}
+			if err == nil {
+				err = b.validator.check(next)
+			}
+			if err != nil {
+				if err := b.validator.reject(b.bets.line, b.bets.row, err); err != nil {
+					return nil, err
+				}
+				// The rejected row counts as handled, so a resumed upload
+				// does not read it again
+				b.offset = b.bets.offset
+				continue
+			}
+			bet, offset = next, b.bets.offset
+		}
+
+		entrySize, err := protocol.BetBatchEntrySize(bet)
+		if err != nil {
+			return nil, err
+		}
+		if size+entrySize > protocol.MaxMessageSize {
+			if len(batch) == 0 {
+				return nil, errors.Wrapf(protocol.ErrPayloadTooLarge, "bet of document %s does not fit in a message", bet.Document)
+			}
+			b.pending, b.pendingOffset = &bet, offset
+			break
+		}
+		batch = append(batch, bet)
+		size += entrySize
+		b.offset = offset
+	}
+
+	if len(batch) == 0 {
+		return nil, io.EOF
+	}
+	return batch, nil
+}
+
+// SendBets Reads the bets of the agency from the dataset and sends them
+// to the server in BET_BATCH messages, waiting for the ACKNOWLEDGE of
+// each one. Once all the bets were sent a BET_BATCH_END is sent. Batches
+// whose ACKNOWLEDGE is lost are sent again with the same sequence number,
+// which the server stores only once. When checkpoints are enabled an
+// upload that did not finish resumes after the last batch acknowledged
+// by a previous run.
+// When the spool is enabled and the server can not be reached, the
+// remaining batches are queued on disk and sent in order by a background
+// drainer once it is back. Rows that are not valid bets are handled as
+// the validation policy says, and a summary of them is logged at the end.
+// If some step fails the error is logged and returned
+func (c *Client) SendBets(ctx context.Context) (err error) {
+	if _, err := c.agencyID(); err != nil {
+		log.Error(NewEvent("apuesta_enviada", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+
+	config := c.reloadable()
+	checkpoint, err := c.resumeCheckpoint(config.BatchDataset)
+	if err != nil {
+		log.Error(NewEvent("resume_checkpoint", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	file, err := openAgencyBets(config.BatchDataset, c.config.ID)
+	if err != nil {
+		log.Error(NewEvent("open_dataset", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	defer file.Close()
+	reader := newBetReader(file)
+	if err := reader.Skip(checkpoint.Offset); err != nil {
+		log.Error(NewEvent("resume_checkpoint", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	validator := newBetValidator(c.config.ID, c.config.Validation)
+	defer func() { validator.close(err) }()
+	if err := validator.resume(checkpoint.Rejects); err != nil {
+		log.Error(NewEvent("resume_checkpoint", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+
+	spool, err := c.openSpool()
+	if err != nil {
+		log.Error(NewEvent("open_spool", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	if spool != nil {
+		defer spool.Close()
+	}
+	defer c.Close()
+
+	// Once a batch is spooled the following ones are spooled too, so the
+	// drainer sends them in order
+	var drainer *spoolDrainer
+	var spooled int
+	if spool != nil {
+		spooled, _ = spool.Stats()
+	}
+	if spooled > 0 {
+		drainer = c.startDrainer(ctx, spool)
+	} else if err := c.connectAgency(ctx); err != nil {
+		if spool == nil || !retryable(err) {
+			return err
+		}
+		drainer = c.startDrainer(ctx, spool)
+	}
+	defer func() { drainer.abort() }()
+
+	// Batches are numbered from the last one acknowledged of the upload,
+	// so a batch sent again after a restart keeps its number
+	sequence := checkpoint.Sequence
+	batches := newBatcher(reader, validator, config.BatchMaxAmount)
+	for {
+		if c.stopping() {
+			return ErrShutdown
+		}
+		if err := drainer.failed(); err != nil {
+			return err
+		}
+
+		bets, err := batches.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Error(NewEvent("apuesta_enviada", "fail",
+				"client_id", c.config.ID,
+				"error", err,
+			))
+			return err
+		}
+
+		sequence++
+		batch := &protocol.BetBatch{Upload: checkpoint.Upload, Sequence: sequence, Bets: bets}
+		if drainer == nil {
+			start := time.Now()
+			err = c.exchangeRetrying(ctx, batch)
+			c.observe("bet_batch", start, err)
+			if err != nil && (spool == nil || !retryable(err) || ctx.Err() != nil || c.stopping()) {
+				log.Error(NewEvent("apuesta_enviada", "fail",
+					"client_id", c.config.ID,
+					"cantidad", len(bets),
+					"error", err,
+				))
+				return err
+			}
+			if err != nil {
+				log.Warning(NewEvent("apuesta_enviada", "fail",
+					"client_id", c.config.ID,
+					"cantidad", len(bets),
+					"error", err,
+				))
+				c.Close()
+				drainer = c.startDrainer(ctx, spool)
+			}
+		}
+		if drainer != nil {
+			if err := c.spoolBatch(spool, batch); err != nil {
+				return err
+			}
+		} else {
+			c.metrics.batchSent(c.config.ID, len(bets))
+			log.Info(NewEvent("apuesta_enviada", "success",
+				"client_id", c.config.ID,
+				"cantidad", len(bets),
+			))
+		}
+
+		checkpoint.Offset, checkpoint.Sequence = batches.Offset(), sequence
+		checkpoint.Rejects = validator.rejectsOffset(checkpoint.Rejects)
+		if err := c.saveCheckpoint(checkpoint); err != nil {
+			return err
+		}
+	}
+
+	if drainer != nil {
+		if err := drainer.wait(); err != nil {
+			return err
+		}
+		if err := c.connectAgency(ctx); err != nil {
+			return err
+		}
+	}
+
+	start := time.Now()
+	err = c.exchangeRetrying(ctx, &protocol.BetBatchEnd{})
+	c.observe("batch_end", start, err)
+	if err != nil {
+		log.Error(NewEvent("batch_end", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	log.Info(NewEvent("batch_end", "success", "client_id", c.config.ID))
+	return c.finishCheckpoint()
+}
+
+// exchange Sends a request to the server through the current connection
+// and waits for its ACKNOWLEDGE
+func (c *Client) exchange(ctx context.Context, req protocol.Request) error {
+	if err := c.Send(ctx, req); err != nil {
+		return err
+	}
+	res, err := c.Receive(ctx)
+	if err != nil {
+		return err
+	}
+	if _, ok := res.(*protocol.Acknowledge); !ok {
+		return errors.Wrapf(protocol.ErrUnexpectedMessage, "expected %v, got %v", protocol.KindAcknowledge, res.Kind())
+	}
+	c.metrics.messageAcknowledged(c.config.ID)
+	return nil
+}
+
+// exchangeRetrying Exchanges a request the server processes only once,
+// reconnecting and sending it again when the connection fails before the
+// ACKNOWLEDGE arrives. The reconnect attempts are shared by the dials and
+// the sends: each retry dials the server once, waiting the backoff before
+// all but the first one. Refusals of the server, cancellations and
+// shutdowns are not retried
+func (c *Client) exchangeRetrying(ctx context.Context, req protocol.Request) error {
+	attempts := c.config.Reconnect.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	retries := newBackoff(c.config.Reconnect.Backoff)
+
+	err := c.exchange(ctx, req)
+	for attempt := 1; err != nil; attempt++ {
+		if attempt >= attempts || !retryable(err) || ctx.Err() != nil || c.stopping() {
+			return err
+		}
+
+		var delay time.Duration
+		if attempt > 1 {
+			delay, _ = retries.Next()
+		}
+		log.Warning(NewEvent("retry_request", "in_progress",
+			"client_id", c.config.ID,
+			"kind", req.Kind(),
+			"attempt", attempt,
+			"retry_in", delay,
+			"error", err,
+		))
+		if err := c.sleep(ctx, delay); err != nil {
+			return err
+		}
+		if err = c.reconnectAgency(ctx); err == nil {
+			err = c.exchange(ctx, req)
+		}
+	}
+	return nil
+}
+
+// retryable Returns true if the error comes from the connection, so the
+// request may not have reached the server or its answer may have been
+// lost. An ERROR of the server is never retryable, since the request
+// would be refused again
+func retryable(err error) bool {
+	var refused *protocol.Error
+	if errors.As(err, &refused) {
+		return false
+	}
+	var netErr net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, ErrNotConnected) ||
+		errors.As(err, &netErr)
+}
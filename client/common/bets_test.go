@@ -0,0 +1,150 @@
+package common
+
+import (
+	"archive/zip"
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+const testAgencyCSV = `Santiago Lionel,Lorca,30904465,1999-03-17,2201
+Agustin Emanuel,Zambrano,21689196,2000-05-10,9325
+Tiago Nicolás,Rivera,34407251,2001-08-29,1033
+`
+
+func TestBatcherRespectsMaxAmount(t *testing.T) {
+	batches := newBatcher(newBetReader(strings.NewReader(testAgencyCSV)), nil, 2)
+
+	var sizes []int
+	for {
+		batch, err := batches.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		sizes = append(sizes, len(batch))
+	}
+	if len(sizes) != 2 || sizes[0] != 2 || sizes[1] != 1 {
+		t.Fatalf("expected batches of [2 1], got %v", sizes)
+	}
+}
+
+func TestBatcherRespectsMessageSize(t *testing.T) {
+	row := strings.Repeat("x", 1000) + ",Lorca,30904465,1999-03-17,2201\n"
+	batches := newBatcher(newBetReader(strings.NewReader(strings.Repeat(row, 20))), nil, 100)
+
+	total := 0
+	for {
+		batch, err := batches.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if len(batch) > 8 {
+			t.Fatalf("batch of %d bets does not fit in a message", len(batch))
+		}
+		total += len(batch)
+	}
+	if total != 20 {
+		t.Fatalf("expected 20 bets, got %d", total)
+	}
+}
+
+func TestBatcherSendsFieldsWithCommasAndAccents(t *testing.T) {
+	row := `Ángel,"Álvarez, de la Peña",30904465,1999-03-17,2201` + "\n"
+	batch, err := newBatcher(newBetReader(strings.NewReader(row)), nil, 10).Next()
+	if err != nil || len(batch) != 1 {
+		t.Fatalf("expected a single bet, got %+v and %v", batch, err)
+	}
+	encoded, err := (&protocol.BetBatch{Sequence: 1, Bets: batch}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("could not encode the bet: %v", err)
+	}
+	var decoded protocol.BetBatch
+	if err := decoded.UnmarshalBinary(encoded); err != nil || decoded.Bets[0].LastName != "Álvarez, de la Peña" {
+		t.Fatalf("expected the last name to survive the encoding, got %+v and %v", decoded.Bets, err)
+	}
+}
+
+func TestOpenAgencyBetsFromZip(t *testing.T) {
+	dataset := filepath.Join(t.TempDir(), "dataset.zip")
+	file, err := os.Create(dataset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := zip.NewWriter(file)
+	entry, err := archive.Create("agency-3.csv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry.Write([]byte(testAgencyCSV))
+	archive.Close()
+	file.Close()
+
+	reader, err := openAgencyBets(dataset, "3")
+	if err != nil {
+		t.Fatalf("could not open agency bets: %v", err)
+	}
+	defer reader.Close()
+	content, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != testAgencyCSV {
+		t.Fatalf("unexpected content %q", content)
+	}
+
+	if _, err := openAgencyBets(dataset, "4"); err == nil {
+		t.Fatal("expected an error for a missing agency")
+	}
+}
+
+func TestRetriesShareTheReconnectAttempts(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	metrics := NewMetrics()
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: listener.Addr().String(),
+		Reconnect: ReconnectConfig{
+			Attempts: 3,
+			Backoff:  BackoffConfig{Initial: time.Millisecond, Multiplier: 1},
+		},
+	})
+	client.SetMetrics(metrics)
+	defer client.Close()
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// The server goes down, dropping the connection
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	listener.Close()
+
+	if err := client.exchangeRetrying(context.Background(), &protocol.BetBatchEnd{}); !retryable(err) {
+		t.Fatalf("expected a connection error, got %v", err)
+	}
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	if line := `client_connections_attempted_total{agency="1"} 3`; !strings.Contains(out.String(), line+"\n") {
+		t.Errorf("expected the server to be dialed once per attempt, %q not in\n%s", line, out.String())
+	}
+}
@@ -0,0 +1,216 @@
+package common
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Checkpoint Progress of the upload of the bets of an agency, saved after
+// every acknowledged batch so a restarted client resumes where it was
+type Checkpoint struct {
+	Agency  string `json:"agency"`
+	Dataset string `json:"dataset"`
+	// Upload Random ID of the upload, so the server tells its batches
+	// apart from those of a previous upload of the agency
+	Upload uint64 `json:"upload"`
+	// Offset Position in the CSV file right after the last bet acknowledged
+	Offset int64 `json:"offset"`
+	// Sequence Sequence number of the last batch acknowledged
+	Sequence uint64 `json:"sequence"`
+	// Rejects Size of the rejects file once the invalid rows before Offset
+	// were quarantined
+	Rejects int64 `json:"rejects"`
+}
+
+// checkpointFileName Name of the file that holds the checkpoint of an agency
+func checkpointFileName(agencyID string) string {
+	return fmt.Sprintf("agency-%s.checkpoint.json", agencyID)
+}
+
+// LoadCheckpoint Reads a checkpoint saved by SaveCheckpoint. The second
+// value is false if there is no checkpoint at the path
+func LoadCheckpoint(path string) (Checkpoint, bool, error) {
+	var checkpoint Checkpoint
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return checkpoint, false, nil
+	}
+	if err != nil {
+		return checkpoint, false, errors.Wrap(err, "could not read the checkpoint")
+	}
+	if err := json.Unmarshal(content, &checkpoint); err != nil {
+		return checkpoint, false, errors.Wrapf(err, "could not decode the checkpoint %s", path)
+	}
+	return checkpoint, true, nil
+}
+
+// SaveCheckpoint Writes the checkpoint so a crash never leaves a partial
+// checkpoint behind
+func SaveCheckpoint(path string, checkpoint Checkpoint) error {
+	content, err := json.Marshal(checkpoint)
+	if err != nil {
+		return err
+	}
+	return errors.Wrap(writeFileAtomic(path, content), "could not save the checkpoint")
+}
+
+// writeFileAtomic Writes the content to a temporary file that replaces
+// the one at path once it is synced. The directory is created if needed
+func writeFileAtomic(path string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+// checkpointPath Returns the path of the checkpoint of the client, or an
+// empty string if checkpoints are disabled
+func (c *Client) checkpointPath() string {
+	if c.config.CheckpointDir == "" {
+		return ""
+	}
+	return filepath.Join(c.config.CheckpointDir, checkpointFileName(c.config.ID))
+}
+
+// ResetCheckpoint Discards the checkpoint and the spool of the agency,
+// so the next upload starts from the first bet with a new upload ID
+func (c *Client) ResetCheckpoint() error {
+	if path := c.spoolPath(); path != "" {
+		if err := RemoveSpool(path); err != nil {
+			return err
+		}
+	}
+	path := c.checkpointPath()
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not remove the checkpoint")
+	}
+	log.Info(NewEvent("reset_checkpoint", "success",
+		"client_id", c.config.ID,
+		"path", path,
+	))
+	return nil
+}
+
+// finishCheckpoint Removes the checkpoint once the server acknowledged
+// the end of the upload, so the next upload starts from the first bet
+// with a new upload ID instead of resuming at the end of the dataset
+func (c *Client) finishCheckpoint() error {
+	path := c.checkpointPath()
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		log.Error(NewEvent("finish_checkpoint", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return errors.Wrap(err, "could not remove the checkpoint")
+	}
+	log.Debug(NewEvent("finish_checkpoint", "success",
+		"client_id", c.config.ID,
+		"path", path,
+	))
+	return nil
+}
+
+// newUploadID Returns a random non zero upload ID
+func newUploadID() (uint64, error) {
+	buf := make([]byte, 8)
+	for {
+		if _, err := rand.Read(buf); err != nil {
+			return 0, errors.Wrap(err, "could not generate the upload ID")
+		}
+		if id := binary.LittleEndian.Uint64(buf); id != 0 {
+			return id, nil
+		}
+	}
+}
+
+// resumeCheckpoint Returns the checkpoint the upload of the dataset must
+// resume from. A checkpoint of another agency or dataset is ignored, and
+// the upload starts from scratch with a new upload ID, which is saved
+// before any batch is sent so a restart keeps using it. The rows
+// quarantined by previous uploads are kept
+func (c *Client) resumeCheckpoint(dataset string) (Checkpoint, error) {
+	upload, err := newUploadID()
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	rejects, err := rejectsFileSize(rejectsPath(c.config.Validation, c.config.ID))
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	start := Checkpoint{Agency: c.config.ID, Dataset: dataset, Upload: upload, Rejects: rejects}
+	path := c.checkpointPath()
+	if path == "" {
+		return start, nil
+	}
+	checkpoint, found, err := LoadCheckpoint(path)
+	if err != nil {
+		return start, err
+	}
+	if !found {
+		return start, c.saveCheckpoint(start)
+	}
+	if checkpoint.Agency != start.Agency || checkpoint.Dataset != start.Dataset {
+		log.Warning(NewEvent("resume_checkpoint", "fail",
+			"client_id", c.config.ID,
+			"path", path,
+			"error", fmt.Sprintf("checkpoint of agency %s and dataset %s", checkpoint.Agency, checkpoint.Dataset),
+		))
+		return start, c.saveCheckpoint(start)
+	}
+	log.Info(NewEvent("resume_checkpoint", "success",
+		"client_id", c.config.ID,
+		"upload", checkpoint.Upload,
+		"offset", checkpoint.Offset,
+		"sequence", checkpoint.Sequence,
+	))
+	return checkpoint, nil
+}
+
+// saveCheckpoint Saves the progress of the upload if checkpoints are enabled
+func (c *Client) saveCheckpoint(checkpoint Checkpoint) error {
+	path := c.checkpointPath()
+	if path == "" {
+		return nil
+	}
+	if err := SaveCheckpoint(path, checkpoint); err != nil {
+		log.Error(NewEvent("save_checkpoint", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	log.Debug(NewEvent("save_checkpoint", "success",
+		"client_id", c.config.ID,
+		"offset", checkpoint.Offset,
+		"sequence", checkpoint.Sequence,
+	))
+	return nil
+}
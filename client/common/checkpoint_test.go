@@ -0,0 +1,109 @@
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCheckpointsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoints", checkpointFileName("1"))
+	if _, found, err := LoadCheckpoint(path); err != nil || found {
+		t.Fatalf("expected no checkpoint, got %v and %v", found, err)
+	}
+
+	checkpoint := Checkpoint{Agency: "1", Dataset: "dataset.zip", Upload: 42, Offset: 150, Sequence: 3}
+	if err := SaveCheckpoint(path, checkpoint); err != nil {
+		t.Fatal(err)
+	}
+	loaded, found, err := LoadCheckpoint(path)
+	if err != nil || !found || loaded != checkpoint {
+		t.Fatalf("expected %+v, got %+v, %v and %v", checkpoint, loaded, found, err)
+	}
+}
+
+func TestResettingTheCheckpointStartsANewUpload(t *testing.T) {
+	client := NewClient(ClientConfig{ID: "1", CheckpointDir: t.TempDir(), SpoolDir: t.TempDir()})
+
+	first, err := client.resumeCheckpoint("dataset.zip")
+	if err != nil || first.Upload == 0 || first.Sequence != 0 {
+		t.Fatalf("expected a new upload, got %+v and %v", first, err)
+	}
+	first.Offset, first.Sequence = 150, 3
+	if err := client.saveCheckpoint(first); err != nil {
+		t.Fatal(err)
+	}
+	if resumed, err := client.resumeCheckpoint("dataset.zip"); err != nil || resumed != first {
+		t.Fatalf("expected to resume %+v, got %+v and %v", first, resumed, err)
+	}
+
+	// A batch of the previous upload left in the spool
+	spool, err := client.openSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(testSpoolBatch(4)); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+
+	if err := client.ResetCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(client.spoolPath()); !os.IsNotExist(err) {
+		t.Fatalf("expected the spool to be removed, got %v", err)
+	}
+	second, err := client.resumeCheckpoint("dataset.zip")
+	if err != nil || second.Upload == 0 || second.Upload == first.Upload || second.Offset != 0 || second.Sequence != 0 {
+		t.Fatalf("expected a new upload from the first bet, got %+v and %v", second, err)
+	}
+
+	// Changing the dataset starts a new upload too
+	third, err := client.resumeCheckpoint("other.zip")
+	if err != nil || third.Upload == second.Upload || third.Sequence != 0 {
+		t.Fatalf("expected a new upload of the other dataset, got %+v and %v", third, err)
+	}
+}
+
+func TestBatcherOffsetsPointAfterTheLastBetReturned(t *testing.T) {
+	rows := strings.SplitAfter(testAgencyCSV, "\n")
+	batches := newBatcher(newBetReader(strings.NewReader(testAgencyCSV)), nil, 2)
+
+	if _, err := batches.Next(); err != nil {
+		t.Fatal(err)
+	}
+	if expected := int64(len(rows[0]) + len(rows[1])); batches.Offset() != expected {
+		t.Fatalf("expected offset %d, got %d", expected, batches.Offset())
+	}
+
+	// Resuming from the offset returns the bets that were left
+	reader := newBetReader(strings.NewReader(testAgencyCSV))
+	if err := reader.Skip(batches.Offset()); err != nil {
+		t.Fatal(err)
+	}
+	resumed := newBatcher(reader, nil, 2)
+	batch, err := resumed.Next()
+	if err != nil || len(batch) != 1 || batch[0].Document != "34407251" {
+		t.Fatalf("expected the last bet, got %+v and %v", batch, err)
+	}
+	if _, err := resumed.Next(); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+	if resumed.Offset() != int64(len(testAgencyCSV)) {
+		t.Fatalf("expected offset %d, got %d", len(testAgencyCSV), resumed.Offset())
+	}
+}
+
+func TestBetReaderReportsTheLineOfMalformedRows(t *testing.T) {
+	reader := newBetReader(strings.NewReader(testAgencyCSV + "only,three,fields\n"))
+	for i := 0; i < 3; i++ {
+		if _, err := reader.Next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := reader.Next(); err == nil || !strings.Contains(err.Error(), "line 4") {
+		t.Fatalf("expected an error on line 4, got %v", err)
+	}
+}
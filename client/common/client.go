@@ -2,27 +2,126 @@ package common
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 	"time"
 
 	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
 )
 
 var log = logging.MustGetLogger("log")
 
+var (
+	// ErrShutdown The client stopped because Shutdown was called
+	ErrShutdown = errors.New("client shut down")
+	// ErrNotConnected The operation requires a connection to the server
+	ErrNotConnected = errors.New("client not connected")
+)
+
+const (
+	// ConnectionPerMessage A new connection is created for every message of the loop
+	ConnectionPerMessage = "per-message"
+	// ConnectionPersistent A single connection is kept for the whole loop
+	ConnectionPersistent = "persistent"
+)
+
 // ClientConfig Configuration used by the client
 type ClientConfig struct {
 	ID            string
 	ServerAddress string
 	LoopAmount    int
 	LoopPeriod    time.Duration
+	SocketTimeout time.Duration
+	// LoopConnection Either ConnectionPersistent or ConnectionPerMessage
+	LoopConnection string
+
+	BatchMaxAmount int
+	BatchDataset   string
+	// CheckpointDir Directory where the progress of the bets upload is
+	// saved to resume it after a restart, disabled if empty
+	CheckpointDir string
+	// SpoolDir Directory where the batches are queued while the server is
+	// unreachable, to be sent once it is back. Disabled if empty
+	SpoolDir string
+	// SpoolRetry Time waited before connecting again to drain the spool
+	SpoolRetry time.Duration
+	// Validation Checks applied to the bets before they are sent
+	Validation ValidationConfig
+
+	WinnersBackoff BackoffConfig
+
+	ConnectTimeout time.Duration
+	Reconnect      ReconnectConfig
+
+	// TLS Secures the connections to the server, plain TCP is used if nil
+	TLS *tls.Config
+	// SecretFile File with the secret shared by the agency and the server.
+	// When set, every connection of the binary protocol is authenticated
+	// before sending requests
+	SecretFile string
+}
+
+// ReconnectConfig Policy followed when the server cannot be reached
+type ReconnectConfig struct {
+	// Attempts Amount of dials made before giving up, the first one included
+	Attempts int
+	// Backoff Delays between consecutive dials
+	Backoff BackoffConfig
+}
+
+// ReloadableConfig Part of the configuration that can be changed while
+// the client is running
+type ReloadableConfig struct {
+	LoopAmount     int
+	LoopPeriod     time.Duration
+	BatchMaxAmount int
+	BatchDataset   string
+}
+
+// Validate Returns an error if some of the values is not valid
+func (r ReloadableConfig) Validate() error {
+	if r.LoopAmount < 0 {
+		return errors.Errorf("invalid loop amount %d", r.LoopAmount)
+	}
+	if r.LoopPeriod < 0 {
+		return errors.Errorf("invalid loop period %v", r.LoopPeriod)
+	}
+	if r.BatchMaxAmount < 0 {
+		return errors.Errorf("invalid batch max amount %d", r.BatchMaxAmount)
+	}
+	return nil
+}
+
+// Observer Receives the outcome of every request made by the client.
+// It must be safe for concurrent use if it is shared between clients
+type Observer interface {
+	// RequestDone Called once a request finished, successfully or not
+	RequestDone(action string, latency time.Duration, err error)
 }
 
 // Client Entity that encapsulates how
 type Client struct {
-	config ClientConfig
+	// configMu guards the reloadable part of config
+	configMu sync.RWMutex
+	config   ClientConfig
+	observer Observer
+	metrics  *Metrics
+
+	// connMu guards conn and reader, since the connection can be closed
+	// from another goroutine
+	connMu sync.Mutex
 	conn   net.Conn
+	reader *bufio.Reader
+
+	quit     chan struct{}
+	quitOnce sync.Once
 }
 
 // NewClient Initializes a new client receiving the configuration
@@ -30,60 +129,399 @@ type Client struct {
 func NewClient(config ClientConfig) *Client {
 	client := &Client{
 		config: config,
+		quit:   make(chan struct{}),
 	}
 	return client
 }
 
-// CreateClientSocket Initializes client socket. In case of
-// failure, error is printed in stdout/stderr and exit 1
-// is returned
-func (c *Client) createClientSocket() error {
-	conn, err := net.Dial("tcp", c.config.ServerAddress)
+// SetObserver Registers the observer notified after every request. Must
+// be called before the client starts sending requests
+func (c *Client) SetObserver(observer Observer) {
+	c.observer = observer
+}
+
+// Reload Replaces the reloadable part of the configuration as a whole.
+// A running loop picks up the changes from its next message, while bets
+// use them from the next call to SendBets. An invalid configuration is
+// rejected and the current one is kept
+func (c *Client) Reload(reloaded ReloadableConfig) error {
+	if err := reloaded.Validate(); err != nil {
+		return err
+	}
+	c.configMu.Lock()
+	defer c.configMu.Unlock()
+	c.config.LoopAmount = reloaded.LoopAmount
+	c.config.LoopPeriod = reloaded.LoopPeriod
+	c.config.BatchMaxAmount = reloaded.BatchMaxAmount
+	c.config.BatchDataset = reloaded.BatchDataset
+	return nil
+}
+
+// reloadable Returns the current value of the reloadable configuration
+func (c *Client) reloadable() ReloadableConfig {
+	c.configMu.RLock()
+	defer c.configMu.RUnlock()
+	return ReloadableConfig{
+		LoopAmount:     c.config.LoopAmount,
+		LoopPeriod:     c.config.LoopPeriod,
+		BatchMaxAmount: c.config.BatchMaxAmount,
+		BatchDataset:   c.config.BatchDataset,
+	}
+}
+
+// SetMetrics Registers the collector of the metrics of the client. Must
+// be called before the client starts sending requests
+func (c *Client) SetMetrics(metrics *Metrics) {
+	c.metrics = metrics
+}
+
+// observe Notifies the observer, if any, that a request started at
+// start finished with the given error, and records its latency
+func (c *Client) observe(action string, start time.Time, err error) {
+	latency := time.Since(start)
+	c.metrics.requestDone(c.config.ID, action, latency)
+	if c.observer != nil {
+		c.observer.RequestDone(action, latency, err)
+	}
+}
+
+// Shutdown Asks the client to stop. The request in progress is allowed
+// to finish, but no new request is started and waits are interrupted.
+// Cancelling the context given to the client aborts the request instead
+func (c *Client) Shutdown() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+// Close Closes the current connection, aborting the request in progress
+func (c *Client) Close() error {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.reader = nil
+	return err
+}
+
+// stopping Returns true once Shutdown was called
+func (c *Client) stopping() bool {
+	select {
+	case <-c.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// sleep Waits for the given duration. Returns ErrShutdown if the wait was
+// interrupted by Shutdown, or the context error if it was cancelled
+func (c *Client) sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-c.quit:
+		return ErrShutdown
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// agencyID Returns the ID of the client as sent in the protocol messages
+func (c *Client) agencyID() (uint32, error) {
+	id, err := strconv.ParseUint(c.config.ID, 10, 32)
 	if err != nil {
-		log.Criticalf(
-			"action: connect | result: fail | client_id: %v | error: %v",
-			c.config.ID,
-			err,
-		)
+		return 0, errors.Wrapf(err, "invalid agency id %q", c.config.ID)
 	}
-	c.conn = conn
+	return uint32(id), nil
+}
+
+// Connect Opens a new connection to the server, closing the previous one
+// if there was any. The dial is aborted if the context is cancelled
+func (c *Client) Connect(ctx context.Context) error {
+	c.Close()
+	return c.createClientSocket(ctx)
+}
+
+// reconnect Opens a new connection to the server with a single dial,
+// closing the previous one if there was any. The reconnect policy is not
+// applied, so callers that retry on their own do not multiply the dials
+func (c *Client) reconnect(ctx context.Context) error {
+	c.Close()
+	conn, err := c.dial(ctx)
+	c.metrics.connectionAttempted(c.config.ID, err)
+	if err != nil {
+		log.Warning(NewEvent("connect", "fail",
+			"client_id", c.config.ID,
+			"error", err,
+		))
+		return err
+	}
+	c.setConn(conn)
 	return nil
 }
 
-// StartClientLoop Send messages to the client until some time threshold is met
-func (c *Client) StartClientLoop() {
+// dial Opens a single connection to the server. Over TLS the handshake
+// is completed before returning, within the connect timeout
+func (c *Client) dial(ctx context.Context) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: c.config.ConnectTimeout}
+	if c.config.TLS == nil {
+		return dialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+	}
+	tlsDialer := &tls.Dialer{NetDialer: dialer, Config: c.config.TLS}
+	return tlsDialer.DialContext(ctx, "tcp", c.config.ServerAddress)
+}
+
+// CreateClientSocket Initializes client socket. If the server cannot be
+// reached the dial is retried following the reconnect policy. Once the
+// attempts are exhausted the failure is logged and the last error returned
+func (c *Client) createClientSocket(ctx context.Context) error {
+	attempts := c.config.Reconnect.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	retries := newBackoff(c.config.Reconnect.Backoff)
+
+	for attempt := 1; ; attempt++ {
+		conn, err := c.dial(ctx)
+		c.metrics.connectionAttempted(c.config.ID, err)
+		if err == nil {
+			c.setConn(conn)
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if attempt >= attempts {
+			log.Critical(NewEvent("connect", "fail",
+				"client_id", c.config.ID,
+				"attempts", attempt,
+				"error", err,
+			))
+			return err
+		}
+
+		delay, _ := retries.Next()
+		log.Warning(NewEvent("connect", "retry",
+			"client_id", c.config.ID,
+			"attempt", attempt,
+			"retry_in", delay,
+			"error", err,
+		))
+		if err := c.sleep(ctx, delay); err != nil {
+			return err
+		}
+	}
+}
+
+// setConn Makes conn the current connection of the client
+func (c *Client) setConn(conn net.Conn) {
+	if c.metrics != nil {
+		conn = &countingConn{Conn: conn, agency: c.config.ID, metrics: c.metrics}
+	}
+	c.connMu.Lock()
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	c.connMu.Unlock()
+}
+
+// withConn Runs an operation over the current connection. The operation
+// is bounded by the socket timeout and aborted if the context is cancelled
+func (c *Client) withConn(ctx context.Context, operation func(net.Conn, *bufio.Reader) error) error {
+	c.connMu.Lock()
+	conn, reader := c.conn, c.reader
+	c.connMu.Unlock()
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	var deadline time.Time
+	if c.config.SocketTimeout > 0 {
+		deadline = time.Now().Add(c.config.SocketTimeout)
+	}
+	if ctxDeadline, ok := ctx.Deadline(); ok && (deadline.IsZero() || ctxDeadline.Before(deadline)) {
+		deadline = ctxDeadline
+	}
+	if err := conn.SetDeadline(deadline); err != nil {
+		return err
+	}
+
+	// Unblock the operation in progress once the context is cancelled by
+	// moving the deadline to the past
+	stop := make(chan struct{})
+	watcherDone := make(chan struct{})
+	go func() {
+		defer close(watcherDone)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Unix(1, 0))
+		case <-stop:
+		}
+	}()
+
+	err := operation(conn, reader)
+	close(stop)
+	<-watcherDone
+
+	if err != nil && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Send Sends a request to the server through the current connection
+func (c *Client) Send(ctx context.Context, req protocol.Request) error {
+	agencyID, err := c.agencyID()
+	if err != nil {
+		return err
+	}
+	err = c.withConn(ctx, func(conn net.Conn, _ *bufio.Reader) error {
+		return protocol.WriteRequest(conn, agencyID, req)
+	})
+	if err == nil {
+		c.metrics.messageSent(c.config.ID)
+	}
+	return err
+}
+
+// Receive Waits for the next response of the server on the current
+// connection. An ERROR of the server is returned as a *protocol.Error
+func (c *Client) Receive(ctx context.Context) (protocol.Response, error) {
+	var res protocol.Response
+	err := c.withConn(ctx, func(_ net.Conn, reader *bufio.Reader) error {
+		var err error
+		res, err = protocol.ReadResponse(reader)
+		return err
+	})
+	if refused, ok := res.(*protocol.Error); ok && err == nil {
+		return nil, refused
+	}
+	return res, err
+}
+
+// SendMessage Sends a newline terminated message to the echo server
+// through the current connection
+func (c *Client) SendMessage(ctx context.Context, msg string) error {
+	err := c.withConn(ctx, func(conn net.Conn, _ *bufio.Reader) error {
+		// Fprintf keeps writing until the whole message is sent or an error occurs
+		_, err := fmt.Fprintf(conn, "%s\n", msg)
+		return err
+	})
+	if err == nil {
+		c.metrics.messageSent(c.config.ID)
+	}
+	return err
+}
+
+// ReceiveMessage Waits for the next newline terminated message of the
+// echo server on the current connection
+func (c *Client) ReceiveMessage(ctx context.Context) (string, error) {
+	var msg string
+	err := c.withConn(ctx, func(_ net.Conn, reader *bufio.Reader) error {
+		var err error
+		msg, err = reader.ReadString('\n')
+		return err
+	})
+	return msg, err
+}
+
+// StartClientLoop Send messages to the client until some time threshold is met.
+// The loop stops early if the context is cancelled or Shutdown is called
+func (c *Client) StartClientLoop(ctx context.Context) error {
+	defer c.Close()
+
 	// There is an autoincremental msgID to identify every message sent
 	// Messages if the message amount threshold has not been surpassed
-	for msgID := 1; msgID <= c.config.LoopAmount; msgID++ {
-		// Create the connection the server in every loop iteration. Send an
-		c.createClientSocket()
-
-		// TODO: Modify the send to avoid short-write
-		fmt.Fprintf(
-			c.conn,
-			"[CLIENT %v] Message N°%v\n",
-			c.config.ID,
-			msgID,
-		)
-		msg, err := bufio.NewReader(c.conn).ReadString('\n')
-		c.conn.Close()
+	// The configuration is read on every message, since it may be reloaded
+	for msgID := 1; msgID <= c.reloadable().LoopAmount; msgID++ {
+		if c.stopping() {
+			return ErrShutdown
+		}
 
+		c.metrics.loopIteration(c.config.ID, msgID)
+		start := time.Now()
+		msg, err := c.echo(ctx, fmt.Sprintf("[CLIENT %v] Message N°%v", c.config.ID, msgID))
+		c.observe("echo", start, err)
 		if err != nil {
-			log.Errorf("action: receive_message | result: fail | client_id: %v | error: %v",
-				c.config.ID,
-				err,
-			)
-			return
+			log.Error(NewEvent("receive_message", "fail",
+				"client_id", c.config.ID,
+				"error", err,
+			))
+			return err
 		}
 
-		log.Infof("action: receive_message | result: success | client_id: %v | msg: %v",
-			c.config.ID,
-			msg,
-		)
+		log.Info(NewEvent("receive_message", "success",
+			"client_id", c.config.ID,
+			"msg", msg,
+		))
 
 		// Wait a time between sending one message and the next one
-		time.Sleep(c.config.LoopPeriod)
+		if err := c.sleep(ctx, c.reloadable().LoopPeriod); err != nil {
+			return err
+		}
+	}
+	log.Info(NewEvent("loop_finished", "success", "client_id", c.config.ID))
+	return nil
+}
 
+// echo Sends a message to the echo server and waits for the answer. In
+// per-message mode a new connection is created for the message. In
+// persistent mode the current connection is reused, and if it fails the
+// client reconnects and sends the message once more
+func (c *Client) echo(ctx context.Context, msg string) (string, error) {
+	if c.config.LoopConnection != ConnectionPersistent {
+		defer c.Close()
+		if err := c.Connect(ctx); err != nil {
+			return "", err
+		}
+		return c.exchangeMessage(ctx, msg)
+	}
+
+	reused := c.connected()
+	if !reused {
+		if err := c.Connect(ctx); err != nil {
+			return "", err
+		}
+	}
+	answer, err := c.exchangeMessage(ctx, msg)
+	if err == nil || !reused || ctx.Err() != nil {
+		return answer, err
+	}
+
+	// The server may have closed the connection while the client was idle
+	log.Warning(NewEvent("reconnect", "in_progress",
+		"client_id", c.config.ID,
+		"error", err,
+	))
+	if err := c.Connect(ctx); err != nil {
+		return "", err
 	}
-	log.Infof("action: loop_finished | result: success | client_id: %v", c.config.ID)
+	return c.exchangeMessage(ctx, msg)
+}
+
+// exchangeMessage Sends a message through the current connection and
+// waits for the answer. The connection is closed if something fails
+func (c *Client) exchangeMessage(ctx context.Context, msg string) (string, error) {
+	err := c.SendMessage(ctx, msg)
+	var answer string
+	if err == nil {
+		answer, err = c.ReceiveMessage(ctx)
+	}
+	if err != nil {
+		c.Close()
+		return answer, err
+	}
+	c.metrics.messageAcknowledged(c.config.ID)
+	return answer, nil
+}
+
+// connected Returns true if the client has an open connection
+func (c *Client) connected() bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+	return c.conn != nil
 }
@@ -0,0 +1,310 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// startSilentServer Accepts connections and reads from them without ever
+// answering, so the client blocks waiting for a response
+func startSilentServer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				bufio.NewReader(conn).ReadString(0)
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func TestStartClientLoopHonorsCancellationDuringReads(t *testing.T) {
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: startSilentServer(t),
+		LoopAmount:    1,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	err := client.StartClientLoop(ctx)
+	if err != context.DeadlineExceeded {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("loop took %v to notice the cancellation", elapsed)
+	}
+}
+
+func TestSleepHonorsCancellationAndShutdown(t *testing.T) {
+	client := NewClient(ClientConfig{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := client.sleep(ctx, time.Hour); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	client.Shutdown()
+	if err := client.sleep(context.Background(), time.Hour); err != ErrShutdown {
+		t.Fatalf("expected ErrShutdown, got %v", err)
+	}
+}
+
+func TestSendWithoutConnectionFails(t *testing.T) {
+	client := NewClient(ClientConfig{ID: "1"})
+	if err := client.SendMessage(context.Background(), "hello"); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+func TestConnectRetriesUntilTheServerIsUp(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: address,
+		Reconnect: ReconnectConfig{
+			Attempts: 20,
+			Backoff:  BackoffConfig{Initial: 20 * time.Millisecond, Multiplier: 1},
+		},
+	})
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { listener.Close() })
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Close()
+		}
+	}()
+
+	if err := client.Connect(context.Background()); err != nil {
+		t.Fatalf("expected to connect after retrying, got %v", err)
+	}
+	client.Close()
+}
+
+func TestConnectFailsOnceTheAttemptsAreExhausted(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := NewClient(ClientConfig{
+		ID:            "1",
+		ServerAddress: address,
+		Reconnect: ReconnectConfig{
+			Attempts: 3,
+			Backoff:  BackoffConfig{Initial: time.Millisecond, Multiplier: 1},
+		},
+	})
+	if err := client.Connect(context.Background()); err == nil {
+		t.Fatal("expected the connection to fail")
+	}
+	if err := client.SendMessage(context.Background(), "hello"); err != ErrNotConnected {
+		t.Fatalf("expected ErrNotConnected, got %v", err)
+	}
+}
+
+// startEchoServer Echoes newline terminated messages, closing each
+// connection after messagesPerConn messages. Returns the address of the
+// server and a channel that receives one value per accepted connection
+func startEchoServer(t *testing.T, messagesPerConn int) (string, <-chan struct{}) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	accepted := make(chan struct{}, 100)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- struct{}{}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for i := 0; i < messagesPerConn; i++ {
+					msg, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(msg))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), accepted
+}
+
+func TestPersistentLoopReusesTheConnection(t *testing.T) {
+	address, accepted := startEchoServer(t, 100)
+	client := NewClient(ClientConfig{
+		ID:             "1",
+		ServerAddress:  address,
+		LoopAmount:     5,
+		LoopConnection: ConnectionPersistent,
+	})
+	if err := client.StartClientLoop(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(accepted) != 1 {
+		t.Fatalf("expected a single connection, got %d", len(accepted))
+	}
+}
+
+func TestPersistentLoopReconnectsWhenTheServerClosesTheConnection(t *testing.T) {
+	address, accepted := startEchoServer(t, 2)
+	client := NewClient(ClientConfig{
+		ID:             "1",
+		ServerAddress:  address,
+		LoopAmount:     5,
+		LoopPeriod:     10 * time.Millisecond,
+		LoopConnection: ConnectionPersistent,
+	})
+	if err := client.StartClientLoop(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(accepted) != 3 {
+		t.Fatalf("expected 3 connections, got %d", len(accepted))
+	}
+}
+
+func TestValidateEchoServerChecksEveryMessage(t *testing.T) {
+	address, _ := startEchoServer(t, 100)
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: address})
+	if err := client.ValidateEchoServer(context.Background(), DefaultEchoMessages); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateEchoServerDetectsMismatches(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	// Strips the trailing whitespace of every line, like the python server
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					msg, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(strings.TrimRight(msg, " \n") + "\n"))
+				}
+			}()
+		}
+	}()
+
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: listener.Addr().String()})
+	err = client.ValidateEchoServer(context.Background(), []string{"ok", "trailing space "})
+	if !errors.Is(err, ErrEchoMismatch) {
+		t.Fatalf("expected ErrEchoMismatch, got %v", err)
+	}
+}
+
+func TestReloadAppliesToTheRunningLoop(t *testing.T) {
+	address, _ := startEchoServer(t, 100)
+	client := NewClient(ClientConfig{
+		ID:             "1",
+		ServerAddress:  address,
+		LoopAmount:     2,
+		LoopPeriod:     100 * time.Millisecond,
+		LoopConnection: ConnectionPersistent,
+	})
+	observer := &countingObserver{}
+	client.SetObserver(observer)
+
+	done := make(chan error, 1)
+	go func() { done <- client.StartClientLoop(context.Background()) }()
+
+	time.Sleep(50 * time.Millisecond)
+	if err := client.Reload(ReloadableConfig{LoopAmount: 4, LoopPeriod: time.Millisecond}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := observer.count(); got != 4 {
+		t.Fatalf("expected 4 messages, got %d", got)
+	}
+}
+
+func TestReloadRejectsInvalidConfigs(t *testing.T) {
+	client := NewClient(ClientConfig{ID: "1", LoopAmount: 3, LoopPeriod: time.Second, BatchMaxAmount: 5})
+	for _, config := range []ReloadableConfig{
+		{LoopAmount: -1},
+		{LoopPeriod: -time.Second},
+		{BatchMaxAmount: -2},
+	} {
+		if err := client.Reload(config); err == nil {
+			t.Errorf("expected %+v to be rejected", config)
+		}
+	}
+	if got := client.reloadable(); got != (ReloadableConfig{LoopAmount: 3, LoopPeriod: time.Second, BatchMaxAmount: 5}) {
+		t.Fatalf("expected the configuration to be kept, got %+v", got)
+	}
+}
+
+type countingObserver struct {
+	mu       sync.Mutex
+	requests int
+}
+
+func (o *countingObserver) RequestDone(string, time.Duration, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.requests++
+}
+
+func (o *countingObserver) count() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.requests
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"context"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrEchoMismatch The echo server answered something different from
+// what was sent
+var ErrEchoMismatch = errors.New("echo server answer does not match")
+
+// DefaultEchoMessages Messages sent to validate the echo server when none
+// are configured. They cover the edge cases of the newline framing
+var DefaultEchoMessages = []string{
+	"[CLIENT] validation message",
+	"",
+	strings.Repeat("0123456789", 1000),
+	"¡Hola, ñandú! 日本語 🚀 Álvarez",
+	"first line\nsecond line\nthird line",
+}
+
+// ValidateEchoServer Sends every message to the echo server and checks
+// that the answer is exactly what was sent, byte for byte. Messages with
+// embedded newlines are answered line by line, so one line is read back
+// per line sent. Returns ErrEchoMismatch if some answer differs
+func (c *Client) ValidateEchoServer(ctx context.Context, messages []string) error {
+	defer c.Close()
+
+	failed := 0
+	for i, msg := range messages {
+		answer, err := c.echoLines(ctx, msg)
+		if err != nil {
+			log.Error(NewEvent("test_echo_server", "fail",
+				"client_id", c.config.ID,
+				"message", i,
+				"error", err,
+			))
+			return err
+		}
+		if answer != msg+"\n" {
+			failed++
+			log.Error(NewEvent("test_echo_server", "fail",
+				"client_id", c.config.ID,
+				"message", i,
+				"sent", strconv.Quote(msg+"\n"),
+				"received", strconv.Quote(answer),
+			))
+			continue
+		}
+		log.Debug(NewEvent("test_echo_server", "success",
+			"client_id", c.config.ID,
+			"message", i,
+		))
+	}
+
+	if failed > 0 {
+		log.Info(NewEvent("test_echo_server", "fail",
+			"client_id", c.config.ID,
+			"failed", failed,
+			"total", len(messages),
+		))
+		return errors.Wrapf(ErrEchoMismatch, "%d of %d messages", failed, len(messages))
+	}
+	log.Info(NewEvent("test_echo_server", "success",
+		"client_id", c.config.ID,
+		"total", len(messages),
+	))
+	return nil
+}
+
+// echoLines Sends the message following the loop connection mode and
+// reads back one line per line sent
+func (c *Client) echoLines(ctx context.Context, msg string) (string, error) {
+	if c.config.LoopConnection != ConnectionPersistent || !c.connected() {
+		if err := c.Connect(ctx); err != nil {
+			return "", err
+		}
+	}
+	if c.config.LoopConnection != ConnectionPersistent {
+		defer c.Close()
+	}
+
+	if err := c.SendMessage(ctx, msg); err != nil {
+		return "", err
+	}
+	var answer strings.Builder
+	for lines := strings.Count(msg, "\n") + 1; lines > 0; lines-- {
+		line, err := c.ReceiveMessage(ctx)
+		if err != nil {
+			return answer.String(), err
+		}
+		answer.WriteString(line)
+	}
+	return answer.String(), nil
+}
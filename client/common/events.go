@@ -0,0 +1,45 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Event Log line describing the outcome of an action. Its text form is
+// the "action: X | result: Y | key: value" line parsed by the grading
+// scripts, while the structured log formats emit each field on its own
+type Event struct {
+	Action string
+	Result string
+	Fields []Field
+}
+
+// Field Extra key/value pair of an event, such as client_id or error
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// NewEvent Creates the event of an action. keyvals are alternating keys
+// and values of the extra fields, kept in the order given
+func NewEvent(action string, result string, keyvals ...interface{}) Event {
+	event := Event{Action: action, Result: result}
+	for i := 0; i < len(keyvals); i += 2 {
+		field := Field{Key: fmt.Sprint(keyvals[i])}
+		if i+1 < len(keyvals) {
+			field.Value = keyvals[i+1]
+		}
+		event.Fields = append(event.Fields, field)
+	}
+	return event
+}
+
+// String Returns the text form of the event
+func (e Event) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "action: %v | result: %v", e.Action, e.Result)
+	for _, field := range e.Fields {
+		fmt.Fprintf(&b, " | %s: %v", field.Key, field.Value)
+	}
+	return b.String()
+}
@@ -0,0 +1,189 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+const (
+	// LogFormatText Human readable lines, the format parsed by the grading scripts
+	LogFormatText = "text"
+	// LogFormatJSON One JSON object per line
+	LogFormatJSON = "json"
+	// LogFormatLogfmt One line of key=value pairs per record
+	LogFormatLogfmt = "logfmt"
+)
+
+// textLogFormat Layout of the lines written in the text format
+const textLogFormat = `%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`
+
+// NewLogBackend Returns a go-logging backend that writes the records to
+// w in the given format. In the structured formats the fields of an
+// Event are emitted as separate keys, while any other message is kept
+// whole under the msg key
+func NewLogBackend(w io.Writer, format string) (logging.Backend, error) {
+	switch format {
+	case LogFormatText:
+		return logging.NewBackendFormatter(
+			logging.NewLogBackend(w, "", 0),
+			logging.MustStringFormatter(textLogFormat),
+		), nil
+	case LogFormatJSON:
+		return &structuredBackend{w: w, encode: encodeJSON}, nil
+	case LogFormatLogfmt:
+		return &structuredBackend{w: w, encode: encodeLogfmt}, nil
+	default:
+		return nil, errors.Errorf("unknown log format %q", format)
+	}
+}
+
+// LevelBackend Discards the records below its level, which can be changed
+// while the backend is in use
+type LevelBackend struct {
+	backend logging.Backend
+	level   int32
+}
+
+// NewLevelBackend Wraps the backend so only records of the given level
+// or more severe ones reach it
+func NewLevelBackend(backend logging.Backend, level logging.Level) *LevelBackend {
+	return &LevelBackend{backend: backend, level: int32(level)}
+}
+
+// GetLevel Implements logging.Leveled. The level is shared by every module
+func (b *LevelBackend) GetLevel(string) logging.Level {
+	return logging.Level(atomic.LoadInt32(&b.level))
+}
+
+// SetLevel Implements logging.Leveled. The level is shared by every module
+func (b *LevelBackend) SetLevel(level logging.Level, _ string) {
+	atomic.StoreInt32(&b.level, int32(level))
+}
+
+// IsEnabledFor Implements logging.Leveled
+func (b *LevelBackend) IsEnabledFor(level logging.Level, module string) bool {
+	return level <= b.GetLevel(module)
+}
+
+// Log Implements logging.Backend
+func (b *LevelBackend) Log(level logging.Level, calldepth int, record *logging.Record) error {
+	if !b.IsEnabledFor(level, record.Module) {
+		return nil
+	}
+	return b.backend.Log(level, calldepth+1, record)
+}
+
+// structuredBackend Writes every record as a single line made of its
+// fields, encoded by encode
+type structuredBackend struct {
+	mu     sync.Mutex
+	w      io.Writer
+	encode func(*bytes.Buffer, []Field)
+}
+
+func (b *structuredBackend) Log(level logging.Level, _ int, record *logging.Record) error {
+	fields := []Field{
+		{Key: "time", Value: record.Time.Format(time.RFC3339Nano)},
+		{Key: "level", Value: level.String()},
+	}
+	if event, ok := recordEvent(record); ok {
+		fields = append(fields, Field{Key: "action", Value: event.Action}, Field{Key: "result", Value: event.Result})
+		for _, field := range event.Fields {
+			fields = append(fields, Field{Key: field.Key, Value: fieldValue(field.Value)})
+		}
+	} else {
+		fields = append(fields, Field{Key: "msg", Value: record.Message()})
+	}
+
+	var line bytes.Buffer
+	b.encode(&line, fields)
+	line.WriteByte('\n')
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	_, err := b.w.Write(line.Bytes())
+	return err
+}
+
+// recordEvent Returns the event logged by the record, if it only holds one
+func recordEvent(record *logging.Record) (Event, bool) {
+	if len(record.Args) != 1 {
+		return Event{}, false
+	}
+	event, ok := record.Args[0].(Event)
+	return event, ok
+}
+
+// fieldValue Converts a value to the form it is encoded with. Numbers
+// and booleans are kept as is, everything else becomes text
+func fieldValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case nil, bool, string,
+		int, int8, int16, int32, int64,
+		uint, uint8, uint16, uint32, uint64,
+		float32, float64:
+		return value
+	case error:
+		return value.Error()
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, fields []Field) {
+	buf.WriteByte('{')
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(field.Key)
+		value, err := json.Marshal(field.Value)
+		if err != nil {
+			value, _ = json.Marshal(fmt.Sprint(field.Value))
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+}
+
+func encodeLogfmt(buf *bytes.Buffer, fields []Field) {
+	for i, field := range fields {
+		if i > 0 {
+			buf.WriteByte(' ')
+		}
+		buf.WriteString(field.Key)
+		buf.WriteByte('=')
+		value := ""
+		if field.Value != nil {
+			value = fmt.Sprint(field.Value)
+		}
+		if needsQuoting(value) {
+			value = strconv.Quote(value)
+		}
+		buf.WriteString(value)
+	}
+}
+
+// needsQuoting Returns true if a logfmt value must be quoted to be
+// parsed back as a single value
+func needsQuoting(value string) bool {
+	if value == "" {
+		return true
+	}
+	return strings.IndexFunc(value, func(r rune) bool {
+		return r == '=' || r == '"' || unicode.IsSpace(r) || !unicode.IsPrint(r)
+	}) >= 0
+}
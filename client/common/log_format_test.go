@@ -0,0 +1,130 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+)
+
+func TestEventTextMatchesTheLegacyLines(t *testing.T) {
+	err := errors.New("connection refused")
+	for _, tc := range []struct {
+		event Event
+		line  string
+	}{
+		{
+			NewEvent("loop_finished", "success", "client_id", "1"),
+			fmt.Sprintf("action: loop_finished | result: success | client_id: %v", "1"),
+		},
+		{
+			NewEvent("connect", "retry", "client_id", "2", "attempt", 3, "retry_in", 200*time.Millisecond, "error", err),
+			fmt.Sprintf("action: connect | result: retry | client_id: %v | attempt: %v | retry_in: %v | error: %v", "2", 3, 200*time.Millisecond, err),
+		},
+		{
+			NewEvent("shutdown", "success"),
+			"action: shutdown | result: success",
+		},
+	} {
+		if got := tc.event.String(); got != tc.line {
+			t.Errorf("expected %q, got %q", tc.line, got)
+		}
+	}
+}
+
+// logLine Writes a single record with the backend of the given format
+func logLine(t *testing.T, format string, level logging.Level, args ...interface{}) string {
+	t.Helper()
+	var buf bytes.Buffer
+	backend, err := NewLogBackend(&buf, format)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := &logging.Record{
+		Time:  time.Date(2024, 3, 17, 10, 20, 30, 0, time.UTC),
+		Level: level,
+		Args:  args,
+	}
+	if err := backend.Log(level, 0, record); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func TestTextLogFormat(t *testing.T) {
+	line := logLine(t, LogFormatText, logging.INFO, NewEvent("batch_end", "success", "client_id", "3"))
+	if want := "2024-03-17 10:20:30 INFO     action: batch_end | result: success | client_id: 3\n"; line != want {
+		t.Errorf("expected %q, got %q", want, line)
+	}
+}
+
+func TestJSONLogFormat(t *testing.T) {
+	line := logLine(t, LogFormatJSON, logging.ERROR, NewEvent("apuesta_enviada", "fail",
+		"client_id", "3",
+		"cantidad", 10,
+		"error", errors.New("broken pipe"),
+	))
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		t.Fatalf("invalid JSON %q: %v", line, err)
+	}
+	want := map[string]interface{}{
+		"time":      "2024-03-17T10:20:30Z",
+		"level":     "ERROR",
+		"action":    "apuesta_enviada",
+		"result":    "fail",
+		"client_id": "3",
+		"cantidad":  float64(10),
+		"error":     "broken pipe",
+	}
+	if fmt.Sprint(record) != fmt.Sprint(want) {
+		t.Errorf("expected %v, got %v", want, record)
+	}
+
+	plain := logLine(t, LogFormatJSON, logging.CRITICAL, "not an event")
+	if want := `{"time":"2024-03-17T10:20:30Z","level":"CRITICAL","msg":"not an event"}` + "\n"; plain != want {
+		t.Errorf("expected %q, got %q", want, plain)
+	}
+}
+
+func TestLogfmtLogFormat(t *testing.T) {
+	line := logLine(t, LogFormatLogfmt, logging.INFO, NewEvent("receive_message", "success",
+		"client_id", "1",
+		"msg", "[CLIENT 1] Message N°1\n",
+		"empty", "",
+	))
+	want := `time=2024-03-17T10:20:30Z level=INFO action=receive_message result=success client_id=1 msg="[CLIENT 1] Message N°1\n" empty=""` + "\n"
+	if line != want {
+		t.Errorf("expected %q, got %q", want, line)
+	}
+}
+
+func TestUnknownLogFormat(t *testing.T) {
+	if _, err := NewLogBackend(&bytes.Buffer{}, "xml"); err == nil {
+		t.Error("expected the format to be rejected")
+	}
+}
+
+func TestLevelBackendCanChangeItsLevel(t *testing.T) {
+	var buf bytes.Buffer
+	text, _ := NewLogBackend(&buf, LogFormatText)
+	backend := NewLevelBackend(text, logging.WARNING)
+	record := func(level logging.Level) *logging.Record {
+		return &logging.Record{Level: level, Args: []interface{}{NewEvent("a", "b")}}
+	}
+
+	backend.Log(logging.INFO, 0, record(logging.INFO))
+	if buf.Len() != 0 {
+		t.Fatalf("expected INFO to be discarded, got %q", buf.String())
+	}
+	backend.SetLevel(logging.DEBUG, "")
+	backend.Log(logging.INFO, 0, record(logging.INFO))
+	if buf.Len() == 0 {
+		t.Fatal("expected INFO to be logged once the level changed")
+	}
+}
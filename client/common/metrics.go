@@ -0,0 +1,263 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// latencyBuckets Upper bounds in seconds of the request latency histograms
+var latencyBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// batchBuckets Upper bounds of the histogram of bets sent per batch
+var batchBuckets = []float64{1, 2, 5, 10, 20, 50, 100, 200, 500}
+
+// histogram Distribution of observed values over fixed buckets
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// agencyMetrics Series of the clients of a single agency
+type agencyMetrics struct {
+	connectionsAttempted uint64
+	connectionsFailed    uint64
+	messagesSent         uint64
+	messagesAcknowledged uint64
+	bytesSent            uint64
+	bytesReceived        uint64
+	loopIteration        int
+	requestLatency       map[string]*histogram
+	batchBets            *histogram
+	spoolDepth           int
+	// spoolOldest Time the oldest batch in the spool was queued
+	spoolOldest time.Time
+}
+
+// Metrics Collects the activity of the clients and exposes it in the
+// Prometheus text format. Every series is labeled with the agency of the
+// client. A single Metrics can be shared by many clients and is safe for
+// concurrent use. The methods of a nil *Metrics do nothing, so clients
+// without metrics need no checks
+type Metrics struct {
+	mu       sync.Mutex
+	agencies map[string]*agencyMetrics
+}
+
+// NewMetrics Creates an empty collector
+func NewMetrics() *Metrics {
+	return &Metrics{agencies: make(map[string]*agencyMetrics)}
+}
+
+// update Runs fn with the series of the agency while holding the lock
+func (m *Metrics) update(agency string, fn func(*agencyMetrics)) {
+	if m == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	metrics, ok := m.agencies[agency]
+	if !ok {
+		metrics = &agencyMetrics{
+			requestLatency: make(map[string]*histogram),
+			batchBets:      newHistogram(batchBuckets),
+		}
+		m.agencies[agency] = metrics
+	}
+	fn(metrics)
+}
+
+func (m *Metrics) connectionAttempted(agency string, err error) {
+	m.update(agency, func(a *agencyMetrics) {
+		a.connectionsAttempted++
+		if err != nil {
+			a.connectionsFailed++
+		}
+	})
+}
+
+func (m *Metrics) messageSent(agency string) {
+	m.update(agency, func(a *agencyMetrics) { a.messagesSent++ })
+}
+
+func (m *Metrics) messageAcknowledged(agency string) {
+	m.update(agency, func(a *agencyMetrics) { a.messagesAcknowledged++ })
+}
+
+func (m *Metrics) bytesSent(agency string, n int) {
+	m.update(agency, func(a *agencyMetrics) { a.bytesSent += uint64(n) })
+}
+
+func (m *Metrics) bytesReceived(agency string, n int) {
+	m.update(agency, func(a *agencyMetrics) { a.bytesReceived += uint64(n) })
+}
+
+func (m *Metrics) loopIteration(agency string, iteration int) {
+	m.update(agency, func(a *agencyMetrics) { a.loopIteration = iteration })
+}
+
+func (m *Metrics) batchSent(agency string, bets int) {
+	m.update(agency, func(a *agencyMetrics) { a.batchBets.observe(float64(bets)) })
+}
+
+func (m *Metrics) spoolChanged(agency string, depth int, age time.Duration) {
+	m.update(agency, func(a *agencyMetrics) {
+		a.spoolDepth = depth
+		a.spoolOldest = time.Time{}
+		if depth > 0 {
+			a.spoolOldest = time.Now().Add(-age)
+		}
+	})
+}
+
+func (m *Metrics) requestDone(agency string, action string, latency time.Duration) {
+	m.update(agency, func(a *agencyMetrics) {
+		h, ok := a.requestLatency[action]
+		if !ok {
+			h = newHistogram(latencyBuckets)
+			a.requestLatency[action] = h
+		}
+		h.observe(latency.Seconds())
+	})
+}
+
+// ServeHTTP Writes the metrics in the Prometheus text format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteTo(w)
+}
+
+// counterSeries Value of a counter or gauge of a single agency
+type counterSeries struct {
+	name  string
+	help  string
+	kind  string
+	value func(*agencyMetrics) float64
+}
+
+var counters = []counterSeries{
+	{"client_connections_attempted_total", "Connections attempted to the server.", "counter", func(a *agencyMetrics) float64 { return float64(a.connectionsAttempted) }},
+	{"client_connections_failed_total", "Connections to the server that could not be established.", "counter", func(a *agencyMetrics) float64 { return float64(a.connectionsFailed) }},
+	{"client_messages_sent_total", "Messages sent to the server.", "counter", func(a *agencyMetrics) float64 { return float64(a.messagesSent) }},
+	{"client_messages_acknowledged_total", "Messages answered by the server.", "counter", func(a *agencyMetrics) float64 { return float64(a.messagesAcknowledged) }},
+	{"client_bytes_sent_total", "Bytes written to the server.", "counter", func(a *agencyMetrics) float64 { return float64(a.bytesSent) }},
+	{"client_bytes_received_total", "Bytes read from the server.", "counter", func(a *agencyMetrics) float64 { return float64(a.bytesReceived) }},
+	{"client_loop_iteration", "Message of the client loop currently being sent.", "gauge", func(a *agencyMetrics) float64 { return float64(a.loopIteration) }},
+	{"client_spool_depth", "Batches queued in the spool while the server is unreachable.", "gauge", func(a *agencyMetrics) float64 { return float64(a.spoolDepth) }},
+	{"client_spool_age_seconds", "Time since the oldest batch in the spool was queued.", "gauge", func(a *agencyMetrics) float64 {
+		if a.spoolOldest.IsZero() {
+			return 0
+		}
+		return time.Since(a.spoolOldest).Seconds()
+	}},
+}
+
+// WriteTo Writes the metrics in the Prometheus text format, with the
+// series sorted by agency
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	agencies := make([]string, 0, len(m.agencies))
+	for agency := range m.agencies {
+		agencies = append(agencies, agency)
+	}
+	sort.Strings(agencies)
+
+	var b strings.Builder
+	for _, counter := range counters {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n", counter.name, counter.help, counter.name, counter.kind)
+		for _, agency := range agencies {
+			fmt.Fprintf(&b, "%s{agency=%s} %s\n", counter.name, labelValue(agency), formatValue(counter.value(m.agencies[agency])))
+		}
+	}
+
+	const latencyName = "client_request_duration_seconds"
+	fmt.Fprintf(&b, "# HELP %s Time taken by the requests to the server.\n# TYPE %s histogram\n", latencyName, latencyName)
+	for _, agency := range agencies {
+		latency := m.agencies[agency].requestLatency
+		actions := make([]string, 0, len(latency))
+		for action := range latency {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+		for _, action := range actions {
+			labels := fmt.Sprintf("agency=%s,action=%s", labelValue(agency), labelValue(action))
+			writeHistogram(&b, latencyName, labels, latency[action])
+		}
+	}
+
+	const batchName = "client_batch_bets"
+	fmt.Fprintf(&b, "# HELP %s Bets sent per batch.\n# TYPE %s histogram\n", batchName, batchName)
+	for _, agency := range agencies {
+		writeHistogram(&b, batchName, "agency="+labelValue(agency), m.agencies[agency].batchBets)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHistogram(b *strings.Builder, name string, labels string, h *histogram) {
+	for i, bound := range h.bounds {
+		fmt.Fprintf(b, "%s_bucket{%s,le=\"%s\"} %d\n", name, labels, formatValue(bound), h.counts[i])
+	}
+	fmt.Fprintf(b, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, labels, h.count)
+	fmt.Fprintf(b, "%s_sum{%s} %s\n", name, labels, formatValue(h.sum))
+	fmt.Fprintf(b, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+func formatValue(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// labelValue Quotes a label value escaping the characters the text
+// format requires
+func labelValue(value string) string {
+	value = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+	return `"` + value + `"`
+}
+
+// countingConn Connection that reports the bytes read and written
+type countingConn struct {
+	net.Conn
+	agency  string
+	metrics *Metrics
+}
+
+func (c *countingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.metrics.bytesReceived(c.agency, n)
+	}
+	return n, err
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.metrics.bytesSent(c.agency, n)
+	}
+	return n, err
+}
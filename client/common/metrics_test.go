@@ -0,0 +1,114 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsOfTheClientLoop(t *testing.T) {
+	address, _ := startEchoServer(t, 100)
+	metrics := NewMetrics()
+	client := NewClient(ClientConfig{
+		ID:             "7",
+		ServerAddress:  address,
+		LoopAmount:     3,
+		LoopConnection: ConnectionPersistent,
+	})
+	client.SetMetrics(metrics)
+	if err := client.StartClientLoop(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	// Every message is echoed with its newline
+	var bytes int
+	for i := 1; i <= 3; i++ {
+		bytes += len(fmt.Sprintf("[CLIENT 7] Message N°%d\n", i))
+	}
+	for _, line := range []string{
+		`client_connections_attempted_total{agency="7"} 1`,
+		`client_connections_failed_total{agency="7"} 0`,
+		`client_messages_sent_total{agency="7"} 3`,
+		`client_messages_acknowledged_total{agency="7"} 3`,
+		fmt.Sprintf(`client_bytes_sent_total{agency="7"} %d`, bytes),
+		fmt.Sprintf(`client_bytes_received_total{agency="7"} %d`, bytes),
+		`client_loop_iteration{agency="7"} 3`,
+		`client_request_duration_seconds_bucket{agency="7",action="echo",le="+Inf"} 3`,
+		`client_request_duration_seconds_count{agency="7",action="echo"} 3`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsCountFailedConnections(t *testing.T) {
+	metrics := NewMetrics()
+	client := NewClient(ClientConfig{
+		ID:            "2",
+		ServerAddress: "127.0.0.1:1",
+		Reconnect: ReconnectConfig{
+			Attempts: 2,
+			Backoff:  BackoffConfig{Initial: time.Millisecond, Multiplier: 1},
+		},
+	})
+	client.SetMetrics(metrics)
+	client.Connect(context.Background())
+
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	for _, line := range []string{
+		`client_connections_attempted_total{agency="2"} 2`,
+		`client_connections_failed_total{agency="2"} 2`,
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, out.String())
+		}
+	}
+}
+
+func TestMetricsHistograms(t *testing.T) {
+	metrics := NewMetrics()
+	metrics.batchSent("1", 3)
+	metrics.batchSent("1", 10)
+	metrics.batchSent("1", 1000)
+
+	server := httptest.NewServer(metrics)
+	defer server.Close()
+	res, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+
+	if !strings.HasPrefix(res.Header.Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("unexpected content type %q", res.Header.Get("Content-Type"))
+	}
+	for _, line := range []string{
+		"# TYPE client_batch_bets histogram",
+		`client_batch_bets_bucket{agency="1",le="2"} 0`,
+		`client_batch_bets_bucket{agency="1",le="5"} 1`,
+		`client_batch_bets_bucket{agency="1",le="10"} 2`,
+		`client_batch_bets_bucket{agency="1",le="500"} 2`,
+		`client_batch_bets_bucket{agency="1",le="+Inf"} 3`,
+		`client_batch_bets_sum{agency="1"} 1013`,
+		`client_batch_bets_count{agency="1"} 3`,
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("expected %q in\n%s", line, body)
+		}
+	}
+}
+
+func TestMetricsEscapeLabels(t *testing.T) {
+	if got := labelValue("a\"b\\c\nd"); got != `"a\"b\\c\nd"` {
+		t.Errorf("unexpected label %s", got)
+	}
+}
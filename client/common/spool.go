@@ -0,0 +1,495 @@
+package common
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+const (
+	// spoolHeaderSize Size of the | LENGTH (4) | CRC32 (4) | header of a record
+	spoolHeaderSize = 4 + 4
+	// spoolTimestampSize Size of the time the batch was queued, in Unix
+	// nanoseconds, that starts the payload of a record
+	spoolTimestampSize = 8
+)
+
+// ErrSpoolCorrupted The spool holds a record that does not match its
+// checksum, or its head does not point to a record
+var ErrSpoolCorrupted = errors.New("spool corrupted")
+
+var spoolByteOrder = binary.LittleEndian
+
+// spoolRecord Position of a pending record in the spool file
+type spoolRecord struct {
+	offset   int64
+	size     int64
+	queuedAt time.Time
+}
+
+// Spool Append-only queue of the bet batches that could not be sent
+// while the server was unreachable. Every record is laid out as
+//
+//	| LENGTH (4) | CRC32 (4) | QUEUED AT (8) | BET_BATCH PAYLOAD (LENGTH - 8) |
+//
+// where the CRC32 covers everything after it. Records are synced to disk
+// before Append returns. The offset of the oldest pending record is kept
+// in a .head file next to the spool, and the spool is truncated once
+// every record was sent. It is safe for concurrent use
+type Spool struct {
+	path string
+
+	mu       sync.Mutex
+	file     *os.File
+	head     int64
+	pending  []spoolRecord
+	appended chan struct{}
+}
+
+// OpenSpool Opens the spool at path, creating it if needed, and indexes
+// the records that are still pending. A record cut short by a crash at
+// the end of the file is discarded, while a record that does not match
+// its checksum is reported as ErrSpoolCorrupted
+func OpenSpool(path string) (*Spool, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the spool")
+	}
+	s := &Spool{path: path, file: file, appended: make(chan struct{}, 1)}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// RemoveSpool Removes the spool at path and its head, discarding the
+// batches that were still pending
+func RemoveSpool(path string) error {
+	for _, name := range []string{path, spoolHeadPath(path)} {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return errors.Wrap(err, "could not remove the spool")
+		}
+	}
+	return nil
+}
+
+// load Reads the head and indexes the records after it
+func (s *Spool) load() error {
+	content, err := os.ReadFile(s.headPath())
+	if err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "could not read the spool head")
+	}
+	if len(content) > 0 {
+		if s.head, err = strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64); err != nil {
+			return errors.Wrap(err, "could not parse the spool head")
+		}
+	}
+
+	info, err := s.file.Stat()
+	if err != nil {
+		return err
+	}
+	size := info.Size()
+	if s.head > size {
+		return errors.Wrapf(ErrSpoolCorrupted, "head %d is past the end of the spool, at %d", s.head, size)
+	}
+
+	offset := s.head
+	for offset < size {
+		record, err := s.readRecordAt(offset, size)
+		if err == io.ErrUnexpectedEOF {
+			log.Warning(NewEvent("open_spool", "in_progress",
+				"path", s.path,
+				"discarded_bytes", size-offset,
+			))
+			if err := s.file.Truncate(offset); err != nil {
+				return errors.Wrap(err, "could not discard the incomplete record")
+			}
+			break
+		}
+		if err != nil {
+			return err
+		}
+		s.pending = append(s.pending, record)
+		offset += record.size
+	}
+	_, err = s.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+// readRecordAt Checks the record at offset. Returns io.ErrUnexpectedEOF
+// if the file ends before the record does
+func (s *Spool) readRecordAt(offset int64, size int64) (spoolRecord, error) {
+	if size-offset < spoolHeaderSize {
+		return spoolRecord{}, io.ErrUnexpectedEOF
+	}
+	var header [spoolHeaderSize]byte
+	if _, err := s.file.ReadAt(header[:], offset); err != nil {
+		return spoolRecord{}, err
+	}
+	length := int64(spoolByteOrder.Uint32(header[0:4]))
+	if length < spoolTimestampSize {
+		return spoolRecord{}, errors.Wrapf(ErrSpoolCorrupted, "record at %d has %d bytes", offset, length)
+	}
+	if size-offset-spoolHeaderSize < length {
+		return spoolRecord{}, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, length)
+	if _, err := s.file.ReadAt(payload, offset+spoolHeaderSize); err != nil {
+		return spoolRecord{}, err
+	}
+	if crc32.ChecksumIEEE(payload) != spoolByteOrder.Uint32(header[4:8]) {
+		return spoolRecord{}, errors.Wrapf(ErrSpoolCorrupted, "checksum mismatch in record at %d", offset)
+	}
+	return spoolRecord{
+		offset:   offset,
+		size:     spoolHeaderSize + length,
+		queuedAt: time.Unix(0, int64(spoolByteOrder.Uint64(payload))),
+	}, nil
+}
+
+// Append Queues the batch and syncs it to disk
+func (s *Spool) Append(batch *protocol.BetBatch) error {
+	encoded, err := batch.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	record := make([]byte, spoolHeaderSize+spoolTimestampSize, spoolHeaderSize+spoolTimestampSize+len(encoded))
+	spoolByteOrder.PutUint64(record[spoolHeaderSize:], uint64(now.UnixNano()))
+	record = append(record, encoded...)
+	payload := record[spoolHeaderSize:]
+	spoolByteOrder.PutUint32(record[0:4], uint32(len(payload)))
+	spoolByteOrder.PutUint32(record[4:8], crc32.ChecksumIEEE(payload))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	offset, err := s.file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if _, err := s.file.Write(record); err != nil {
+		return errors.Wrap(err, "could not append to the spool")
+	}
+	if err := s.file.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync the spool")
+	}
+	s.pending = append(s.pending, spoolRecord{offset: offset, size: int64(len(record)), queuedAt: now})
+
+	select {
+	case s.appended <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Peek Returns the oldest pending batch without removing it. The second
+// value is false if the spool is empty
+func (s *Spool) Peek() (*protocol.BetBatch, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil, false, nil
+	}
+	record := s.pending[0]
+	payload := make([]byte, record.size-spoolHeaderSize-spoolTimestampSize)
+	if _, err := s.file.ReadAt(payload, record.offset+spoolHeaderSize+spoolTimestampSize); err != nil {
+		return nil, false, errors.Wrap(err, "could not read the spool")
+	}
+	batch := &protocol.BetBatch{}
+	if err := batch.UnmarshalBinary(payload); err != nil {
+		return nil, false, errors.Wrapf(err, "record at %d", record.offset)
+	}
+	return batch, true, nil
+}
+
+// Pop Removes the oldest pending batch, once it was acknowledged. The
+// spool is truncated when no batch is left
+func (s *Spool) Pop() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return nil
+	}
+	s.pending = s.pending[1:]
+	if len(s.pending) > 0 {
+		s.head = s.pending[0].offset
+		return s.saveHead()
+	}
+
+	// The head is reset before truncating, so a crash in between makes the
+	// sent records pending again, which the server stores only once thanks
+	// to their sequence numbers, instead of leaving a head past the records
+	// appended later
+	s.head = 0
+	if err := s.saveHead(); err != nil {
+		return err
+	}
+	if err := s.file.Truncate(0); err != nil {
+		return errors.Wrap(err, "could not truncate the spool")
+	}
+	return errors.Wrap(s.file.Sync(), "could not sync the spool")
+}
+
+func (s *Spool) saveHead() error {
+	err := writeFileAtomic(s.headPath(), []byte(strconv.FormatInt(s.head, 10)))
+	return errors.Wrap(err, "could not save the spool head")
+}
+
+func (s *Spool) headPath() string {
+	return spoolHeadPath(s.path)
+}
+
+// spoolHeadPath Returns the path of the head of the spool at path
+func spoolHeadPath(path string) string {
+	return path + ".head"
+}
+
+// Stats Returns the amount of pending batches and how long ago the
+// oldest one was queued, zero if the spool is empty
+func (s *Spool) Stats() (int, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.pending) == 0 {
+		return 0, 0
+	}
+	return len(s.pending), time.Since(s.pending[0].queuedAt)
+}
+
+// Appended Returns a channel that receives a value after a batch is
+// appended, to wait for work while the spool is empty
+func (s *Spool) Appended() <-chan struct{} {
+	return s.appended
+}
+
+// Close Closes the spool file
+func (s *Spool) Close() error {
+	return s.file.Close()
+}
+
+// defaultSpoolRetry Time waited to drain the spool when SpoolRetry is zero
+const defaultSpoolRetry = time.Second
+
+// spoolFileName Name of the file that holds the spool of an agency
+func spoolFileName(agencyID string) string {
+	return fmt.Sprintf("agency-%s.spool", agencyID)
+}
+
+// spoolPath Returns the path of the spool of the client, or an empty
+// string if the spool is disabled
+func (c *Client) spoolPath() string {
+	if c.config.SpoolDir == "" {
+		return ""
+	}
+	return filepath.Join(c.config.SpoolDir, spoolFileName(c.config.ID))
+}
+
+// openSpool Opens the spool of the client, or returns nil if it is
+// disabled
+func (c *Client) openSpool() (*Spool, error) {
+	path := c.spoolPath()
+	if path == "" {
+		return nil, nil
+	}
+	if err := os.MkdirAll(c.config.SpoolDir, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create the spool directory")
+	}
+	spool, err := OpenSpool(path)
+	if err != nil {
+		return nil, err
+	}
+	c.spoolChanged(spool)
+	return spool, nil
+}
+
+// spoolChanged Publishes the depth and age of the spool in the metrics
+func (c *Client) spoolChanged(spool *Spool) (int, time.Duration) {
+	depth, age := spool.Stats()
+	c.metrics.spoolChanged(c.config.ID, depth, age)
+	return depth, age
+}
+
+// spoolBatch Queues a batch that could not be sent
+func (c *Client) spoolBatch(spool *Spool, batch *protocol.BetBatch) error {
+	if err := spool.Append(batch); err != nil {
+		log.Error(NewEvent("spool_bets", "fail",
+			"client_id", c.config.ID,
+			"cantidad", len(batch.Bets),
+			"error", err,
+		))
+		return err
+	}
+	depth, age := c.spoolChanged(spool)
+	log.Info(NewEvent("spool_bets", "success",
+		"client_id", c.config.ID,
+		"cantidad", len(batch.Bets),
+		"depth", depth,
+		"age", age,
+	))
+	return nil
+}
+
+// drainSpool Sends the batches of the spool in order, waiting for the
+// ACKNOWLEDGE of each one before removing it. While the server is
+// unreachable it connects again every SpoolRetry. Returns once producing
+// is closed and the spool is empty. It owns the connection of the client
+// until it returns
+func (c *Client) drainSpool(ctx context.Context, spool *Spool, producing <-chan struct{}) error {
+	defer c.Close()
+	retry := c.config.SpoolRetry
+	if retry <= 0 {
+		retry = defaultSpoolRetry
+	}
+
+	for {
+		if c.stopping() {
+			return ErrShutdown
+		}
+		batch, ok, err := spool.Peek()
+		if err != nil {
+			log.Error(NewEvent("spool_drain", "fail",
+				"client_id", c.config.ID,
+				"error", err,
+			))
+			return err
+		}
+		if !ok {
+			select {
+			case <-spool.Appended():
+				continue
+			case <-producing:
+				// A batch may have been appended right before producing closed
+				if depth, _ := spool.Stats(); depth == 0 {
+					return nil
+				}
+				continue
+			case <-c.quit:
+				return ErrShutdown
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		if !c.connected() {
+			err = c.reconnectAgency(ctx)
+		}
+		if err == nil {
+			start := time.Now()
+			err = c.exchange(ctx, batch)
+			c.observe("bet_batch", start, err)
+		}
+		if err != nil {
+			c.Close()
+			if !retryable(err) || ctx.Err() != nil || c.stopping() {
+				log.Error(NewEvent("spool_drain", "fail",
+					"client_id", c.config.ID,
+					"error", err,
+				))
+				return err
+			}
+			depth, age := spool.Stats()
+			log.Warning(NewEvent("spool_drain", "in_progress",
+				"client_id", c.config.ID,
+				"depth", depth,
+				"age", age,
+				"retry_in", retry,
+				"error", err,
+			))
+			if err := c.sleep(ctx, retry); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := spool.Pop(); err != nil {
+			log.Error(NewEvent("spool_drain", "fail",
+				"client_id", c.config.ID,
+				"error", err,
+			))
+			return err
+		}
+		c.metrics.batchSent(c.config.ID, len(batch.Bets))
+		depth, age := c.spoolChanged(spool)
+		log.Info(NewEvent("spool_drain", "success",
+			"client_id", c.config.ID,
+			"cantidad", len(batch.Bets),
+			"depth", depth,
+			"age", age,
+		))
+	}
+}
+
+// spoolDrainer Runs drainSpool in the background while the batches are
+// being spooled. The methods of a nil *spoolDrainer do nothing
+type spoolDrainer struct {
+	producing chan struct{}
+	cancel    context.CancelFunc
+	done      chan struct{}
+	err       error
+}
+
+// startDrainer Starts draining the spool. Until the drainer is waited
+// for, the connection of the client belongs to it
+func (c *Client) startDrainer(ctx context.Context, spool *Spool) *spoolDrainer {
+	depth, age := spool.Stats()
+	log.Warning(NewEvent("spool_bets", "in_progress",
+		"client_id", c.config.ID,
+		"depth", depth,
+		"age", age,
+	))
+	ctx, cancel := context.WithCancel(ctx)
+	d := &spoolDrainer{producing: make(chan struct{}), cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(d.done)
+		d.err = c.drainSpool(ctx, spool, d.producing)
+	}()
+	return d
+}
+
+// failed Returns the error of the drainer if it already stopped
+func (d *spoolDrainer) failed() error {
+	if d == nil {
+		return nil
+	}
+	select {
+	case <-d.done:
+		return d.err
+	default:
+		return nil
+	}
+}
+
+// abort Stops the drainer, leaving the batches it did not send in the
+// spool, and waits until it returns
+func (d *spoolDrainer) abort() {
+	if d == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+}
+
+// wait Tells the drainer no more batches will be spooled and waits until
+// it sends all of them
+func (d *spoolDrainer) wait() error {
+	if d == nil {
+		return nil
+	}
+	close(d.producing)
+	<-d.done
+	return d.err
+}
@@ -0,0 +1,136 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+func testSpoolBatch(sequence uint64) *protocol.BetBatch {
+	return &protocol.BetBatch{Sequence: sequence, Bets: []protocol.Bet{
+		{FirstName: "Santiago Lionel", LastName: "Lorca", Document: "30904465", Birthdate: "1999-03-17", Number: "7574"},
+	}}
+}
+
+func TestSpoolKeepsTheBatchesInOrderAcrossReopens(t *testing.T) {
+	path := filepath.Join(t.TempDir(), spoolFileName("1"))
+	spool, err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for sequence := uint64(1); sequence <= 3; sequence++ {
+		if err := spool.Append(testSpoolBatch(sequence)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := spool.Pop(); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+
+	// The batch removed before closing is not pending anymore
+	spool, err = OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	for _, expected := range []uint64{2, 3} {
+		if depth, age := spool.Stats(); depth != int(4-expected) || age <= 0 {
+			t.Fatalf("expected %d pending batches, got %d aged %v", 4-expected, depth, age)
+		}
+		batch, ok, err := spool.Peek()
+		if err != nil || !ok || batch.Sequence != expected || batch.Bets[0] != testSpoolBatch(0).Bets[0] {
+			t.Fatalf("expected batch %d, got %+v, %v and %v", expected, batch, ok, err)
+		}
+		if err := spool.Pop(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, ok, err := spool.Peek(); ok || err != nil {
+		t.Fatalf("expected an empty spool, got %v and %v", ok, err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != 0 {
+		t.Fatalf("expected the empty spool to be truncated, got %v and %v", info, err)
+	}
+}
+
+func TestSpoolDiscardsATornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), spoolFileName("1"))
+	spool, err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Append(testSpoolBatch(1))
+	spool.Append(testSpoolBatch(2))
+	spool.Close()
+
+	// A crash in the middle of the second append
+	info, _ := os.Stat(path)
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	spool, err = OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if depth, _ := spool.Stats(); depth != 1 {
+		t.Fatalf("expected only the complete batch, got %d", depth)
+	}
+	if err := spool.Append(testSpoolBatch(3)); err != nil {
+		t.Fatal(err)
+	}
+	spool.Pop()
+	if batch, _, err := spool.Peek(); err != nil || batch.Sequence != 3 {
+		t.Fatalf("expected the batch appended after the torn one, got %+v and %v", batch, err)
+	}
+}
+
+func TestSpoolRejectsACorruptedRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), spoolFileName("1"))
+	spool, err := OpenSpool(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spool.Append(testSpoolBatch(1))
+	spool.Close()
+
+	content, _ := os.ReadFile(path)
+	content[len(content)-1] ^= 0xff
+	if err := os.WriteFile(path, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := OpenSpool(path); errors.Cause(err) != ErrSpoolCorrupted {
+		t.Fatalf("expected ErrSpoolCorrupted, got %v", err)
+	}
+}
+
+func TestMetricsOfTheSpool(t *testing.T) {
+	metrics := NewMetrics()
+	client := NewClient(ClientConfig{ID: "4", SpoolDir: t.TempDir()})
+	client.SetMetrics(metrics)
+	spool, err := client.openSpool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer spool.Close()
+	if err := client.spoolBatch(spool, testSpoolBatch(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	var out strings.Builder
+	metrics.WriteTo(&out)
+	if !strings.Contains(out.String(), `client_spool_depth{agency="4"} 1`+"\n") {
+		t.Errorf("expected a spooled batch in\n%s", out.String())
+	}
+	if strings.Contains(out.String(), `client_spool_age_seconds{agency="4"} 0`+"\n") {
+		t.Errorf("expected the age of the spooled batch in\n%s", out.String())
+	}
+}
@@ -0,0 +1,82 @@
+package common
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// TLSVersion12 Minimum TLS version accepted by default
+	TLSVersion12 = "1.2"
+	// TLSVersion13 Only TLS 1.3 is accepted
+	TLSVersion13 = "1.3"
+)
+
+// TLSOptions Files and settings used to secure the connection to the
+// server. Bets carry personal data, so they should not travel in clear
+// text outside a trusted network
+type TLSOptions struct {
+	// CAFile PEM bundle used to verify the server, the system roots are
+	// used if empty
+	CAFile string
+	// CertFile, KeyFile Certificate presented to the server for mutual
+	// TLS. Both or none must be given
+	CertFile string
+	KeyFile  string
+	// ServerName Name checked against the server certificate, the host
+	// of the server address if empty
+	ServerName string
+	// MinVersion Either TLSVersion12 or TLSVersion13, TLSVersion12 if empty
+	MinVersion string
+}
+
+// NewTLSConfig Loads the files of the options into a TLS configuration
+// for the client. Returns an error if some file cannot be loaded
+func NewTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: options.ServerName}
+
+	switch options.MinVersion {
+	case "", TLSVersion12:
+		config.MinVersion = tls.VersionTLS12
+	case TLSVersion13:
+		config.MinVersion = tls.VersionTLS13
+	default:
+		return nil, errors.Errorf("invalid TLS version %q, expected %s or %s", options.MinVersion, TLSVersion12, TLSVersion13)
+	}
+
+	if options.CAFile != "" {
+		pool, err := LoadCertPool(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	if (options.CertFile == "") != (options.KeyFile == "") {
+		return nil, errors.New("a TLS certificate and its key must be given together")
+	}
+	if options.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load the TLS certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// LoadCertPool Reads a PEM bundle with one or more certificates
+func LoadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read the CA bundle")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in %s", path)
+	}
+	return pool, nil
+}
@@ -0,0 +1,154 @@
+package common
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testcerts"
+)
+
+// startTLSEchoServer Echoes newline terminated messages over TLS. The
+// common name of every client certificate received is sent to the
+// returned channel, empty if the client presented none
+func startTLSEchoServer(t *testing.T, config *tls.Config) (string, <-chan string) {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	peers := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if err := tlsConn.Handshake(); err != nil {
+					return
+				}
+				peer := ""
+				if certificates := tlsConn.ConnectionState().PeerCertificates; len(certificates) > 0 {
+					peer = certificates[0].Subject.CommonName
+				}
+				peers <- peer
+
+				reader := bufio.NewReader(conn)
+				for {
+					msg, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					conn.Write([]byte(msg))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), peers
+}
+
+func serverTLSConfig(t *testing.T, authority *testcerts.Authority, clientCA string) *tls.Config {
+	t.Helper()
+	pair := authority.Issue(t, "server", "127.0.0.1")
+	cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if clientCA != "" {
+		pem, err := os.ReadFile(clientCA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.ClientCAs = x509.NewCertPool()
+		config.ClientCAs.AppendCertsFromPEM(pem)
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config
+}
+
+func echoOnce(t *testing.T, client *Client) {
+	t.Helper()
+	ctx := context.Background()
+	if err := client.Connect(ctx); err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	defer client.Close()
+	if err := client.SendMessage(ctx, "hello"); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	if answer, err := client.ReceiveMessage(ctx); err != nil || answer != "hello\n" {
+		t.Fatalf("expected the message back, got %q and %v", answer, err)
+	}
+}
+
+func TestClientConnectsOverTLS(t *testing.T) {
+	authority := testcerts.NewAuthority(t)
+	address, peers := startTLSEchoServer(t, serverTLSConfig(t, authority, ""))
+
+	config, err := NewTLSConfig(TLSOptions{CAFile: authority.CertFile, MinVersion: TLSVersion13})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, NewClient(ClientConfig{ID: "1", ServerAddress: address, TLS: config}))
+	if peer := <-peers; peer != "" {
+		t.Fatalf("expected no client certificate, got %q", peer)
+	}
+}
+
+func TestClientRejectsAnUntrustedServer(t *testing.T) {
+	address, _ := startTLSEchoServer(t, serverTLSConfig(t, testcerts.NewAuthority(t), ""))
+
+	config, err := NewTLSConfig(TLSOptions{CAFile: testcerts.NewAuthority(t).CertFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := NewClient(ClientConfig{ID: "1", ServerAddress: address, TLS: config})
+	if err := client.Connect(context.Background()); err == nil {
+		client.Close()
+		t.Fatal("expected the server certificate to be rejected")
+	}
+}
+
+func TestClientPresentsItsCertificateForMutualTLS(t *testing.T) {
+	authority := testcerts.NewAuthority(t)
+	address, peers := startTLSEchoServer(t, serverTLSConfig(t, authority, authority.CertFile))
+	pair := authority.Issue(t, "agencia-1")
+
+	config, err := NewTLSConfig(TLSOptions{
+		CAFile:   authority.CertFile,
+		CertFile: pair.CertFile,
+		KeyFile:  pair.KeyFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	echoOnce(t, NewClient(ClientConfig{ID: "1", ServerAddress: address, TLS: config}))
+	if peer := <-peers; peer != "agencia-1" {
+		t.Fatalf("expected the certificate of agencia-1, got %q", peer)
+	}
+}
+
+func TestNewTLSConfigRejectsInvalidOptions(t *testing.T) {
+	authority := testcerts.NewAuthority(t)
+	pair := authority.Issue(t, "agencia-1")
+	for _, options := range []TLSOptions{
+		{CertFile: pair.CertFile},
+		{KeyFile: pair.KeyFile},
+		{MinVersion: "1.0"},
+		{CAFile: pair.KeyFile},
+		{CAFile: "missing.pem"},
+	} {
+		if _, err := NewTLSConfig(options); err == nil {
+			t.Errorf("expected %+v to be rejected", options)
+		}
+	}
+}
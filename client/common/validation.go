@@ -0,0 +1,336 @@
+package common
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+const (
+	// InvalidBetsSkip Invalid rows are logged and left out of the upload
+	InvalidBetsSkip = "skip"
+	// InvalidBetsQuarantine Invalid rows are logged and copied to the
+	// rejects file of the agency, to be fixed and sent later
+	InvalidBetsQuarantine = "quarantine"
+	// InvalidBetsAbort The upload fails on the first invalid row
+	InvalidBetsAbort = "abort"
+)
+
+const (
+	// minDocument, maxDocument Range of the DNIs considered plausible
+	minDocument = 100000
+	maxDocument = 99999999
+
+	birthdateLayout = "2006-01-02"
+)
+
+// ValidationConfig Checks applied to the bets read from the dataset
+// before they are sent
+type ValidationConfig struct {
+	// Policy Either InvalidBetsSkip, InvalidBetsQuarantine or
+	// InvalidBetsAbort. Bets are sent without being checked if empty
+	Policy string
+	// RejectsDir Directory of the rejects file of the agency, used by
+	// InvalidBetsQuarantine
+	RejectsDir string
+	// MinNumber, MaxNumber Range of the numbers a bet may be placed on
+	MinNumber int
+	MaxNumber int
+}
+
+// Bet A bet read from the dataset, with its fields parsed
+type Bet struct {
+	FirstName string
+	LastName  string
+	Document  uint64
+	Birthdate time.Time
+	Number    int
+}
+
+// InvalidBetError A field of a bet that does not hold a valid value
+type InvalidBetError struct {
+	Field  string
+	Value  string
+	Reason string
+}
+
+func (e *InvalidBetError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Field, e.Value, e.Reason)
+}
+
+// ParseBet Parses and checks the fields of a bet. Names can not be empty,
+// the document must be a plausible DNI, the birthdate must have the
+// format YYYY-MM-DD and not be after today, and the number must be in
+// the configured range. The first invalid field is returned as an
+// *InvalidBetError
+func ParseBet(bet protocol.Bet, config ValidationConfig, today time.Time) (Bet, error) {
+	if strings.TrimSpace(bet.FirstName) == "" {
+		return Bet{}, &InvalidBetError{Field: "first_name", Value: bet.FirstName, Reason: "is empty"}
+	}
+	if strings.TrimSpace(bet.LastName) == "" {
+		return Bet{}, &InvalidBetError{Field: "last_name", Value: bet.LastName, Reason: "is empty"}
+	}
+
+	document, err := strconv.ParseUint(bet.Document, 10, 64)
+	if err != nil {
+		return Bet{}, &InvalidBetError{Field: "document", Value: bet.Document, Reason: "is not a number"}
+	}
+	if document < minDocument || document > maxDocument {
+		return Bet{}, &InvalidBetError{Field: "document", Value: bet.Document, Reason: fmt.Sprintf("is not between %d and %d", minDocument, maxDocument)}
+	}
+
+	birthdate, err := time.Parse(birthdateLayout, bet.Birthdate)
+	if err != nil {
+		return Bet{}, &InvalidBetError{Field: "birthdate", Value: bet.Birthdate, Reason: "is not a YYYY-MM-DD date"}
+	}
+	if birthdate.After(today) {
+		return Bet{}, &InvalidBetError{Field: "birthdate", Value: bet.Birthdate, Reason: "is in the future"}
+	}
+
+	number, err := strconv.Atoi(bet.Number)
+	if err != nil {
+		return Bet{}, &InvalidBetError{Field: "number", Value: bet.Number, Reason: "is not a number"}
+	}
+	if number < config.MinNumber || number > config.MaxNumber {
+		return Bet{}, &InvalidBetError{Field: "number", Value: bet.Number, Reason: fmt.Sprintf("is not between %d and %d", config.MinNumber, config.MaxNumber)}
+	}
+
+	return Bet{
+		FirstName: bet.FirstName,
+		LastName:  bet.LastName,
+		Document:  document,
+		Birthdate: birthdate,
+		Number:    number,
+	}, nil
+}
+
+// ValidationSummary Outcome of the validation of the rows read in an upload
+type ValidationSummary struct {
+	Rows        int
+	Valid       int
+	Skipped     int
+	Quarantined int
+	// Reasons Amount of invalid rows by the field found invalid, or "row"
+	// for the rows that could not be parsed
+	Reasons map[string]int
+}
+
+// Invalid Returns the amount of invalid rows
+func (s ValidationSummary) Invalid() int {
+	return s.Rows - s.Valid
+}
+
+// rejectsFileName Name of the file that holds the invalid rows of an agency
+func rejectsFileName(agencyID string) string {
+	return fmt.Sprintf("agency-%s.rejects.csv", agencyID)
+}
+
+// rejectsPath Returns the path of the rejects file of the agency, or an
+// empty string if invalid rows are not quarantined
+func rejectsPath(config ValidationConfig, agencyID string) string {
+	if config.Policy != InvalidBetsQuarantine {
+		return ""
+	}
+	return filepath.Join(config.RejectsDir, rejectsFileName(agencyID))
+}
+
+// rejectsFileSize Returns the size of the rejects file at path, zero if
+// it does not exist or invalid rows are not quarantined
+func rejectsFileSize(path string) (int64, error) {
+	if path == "" {
+		return 0, nil
+	}
+	info, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errors.Wrap(err, "could not inspect the rejects file")
+	}
+	return info.Size(), nil
+}
+
+// betValidator Applies the validation policy to the rows of an upload.
+// The methods of a nil *betValidator accept every row, and stop the
+// upload on the rows that can not be parsed
+type betValidator struct {
+	agency  string
+	config  ValidationConfig
+	today   time.Time
+	rejects *os.File
+	// rejectsSize Size of the rejects file after the last quarantined row
+	rejectsSize int64
+	summary     ValidationSummary
+}
+
+// newBetValidator Returns the validator of the upload of the agency, or
+// nil if bets are not validated
+func newBetValidator(agency string, config ValidationConfig) *betValidator {
+	if config.Policy == "" {
+		return nil
+	}
+	return &betValidator{
+		agency:  agency,
+		config:  config,
+		today:   time.Now(),
+		summary: ValidationSummary{Reasons: make(map[string]int)},
+	}
+}
+
+// resume Truncates the rejects file to the size saved in the checkpoint
+// the upload resumes from. The rows quarantined after it are read again,
+// so they would be quarantined twice otherwise
+func (v *betValidator) resume(size int64) error {
+	if v == nil || v.config.Policy != InvalidBetsQuarantine {
+		return nil
+	}
+	path := rejectsPath(v.config, v.agency)
+	current, err := rejectsFileSize(path)
+	if err != nil {
+		return err
+	}
+	if current > size {
+		log.Warning(NewEvent("resume_rejects", "in_progress",
+			"client_id", v.agency,
+			"discarded_bytes", current-size,
+		))
+		if err := os.Truncate(path, size); err != nil {
+			return errors.Wrap(err, "could not discard the rows quarantined after the checkpoint")
+		}
+		current = size
+	}
+	v.rejectsSize = current
+	return nil
+}
+
+// rejectsOffset Returns the size of the rejects file to be saved in the
+// checkpoint, given the one saved before. The size is only tracked while
+// invalid rows are quarantined
+func (v *betValidator) rejectsOffset(size int64) int64 {
+	if v == nil || v.config.Policy != InvalidBetsQuarantine {
+		return size
+	}
+	return v.rejectsSize
+}
+
+// check Returns an *InvalidBetError if the bet is not valid
+func (v *betValidator) check(bet protocol.Bet) error {
+	if v == nil {
+		return nil
+	}
+	_, err := ParseBet(bet, v.config, v.today)
+	if err == nil {
+		v.summary.Rows++
+		v.summary.Valid++
+	}
+	return err
+}
+
+// reject Applies the policy to an invalid row, given the error found in
+// it. Returns the error if the upload must stop
+func (v *betValidator) reject(line int, row string, err error) error {
+	if v == nil {
+		return err
+	}
+	v.count(err)
+	if v.config.Policy == InvalidBetsAbort {
+		return errors.Wrapf(err, "line %d", line)
+	}
+
+	if v.config.Policy == InvalidBetsQuarantine {
+		if err := v.quarantine(row); err != nil {
+			return err
+		}
+		v.summary.Quarantined++
+	} else {
+		v.summary.Skipped++
+	}
+	log.Warning(NewEvent("validate_bet", "fail",
+		"client_id", v.agency,
+		"line", line,
+		"policy", v.config.Policy,
+		"error", err,
+	))
+	return nil
+}
+
+// count Adds an invalid row to the summary
+func (v *betValidator) count(err error) {
+	reason := "row"
+	if invalid, ok := err.(*InvalidBetError); ok {
+		reason = invalid.Field
+	}
+	v.summary.Rows++
+	v.summary.Reasons[reason]++
+}
+
+// quarantine Appends the row as it was read to the rejects file, synced
+// so it is not lost if the client crashes
+func (v *betValidator) quarantine(row string) error {
+	if v.rejects == nil {
+		if err := os.MkdirAll(v.config.RejectsDir, 0755); err != nil {
+			return errors.Wrap(err, "could not create the rejects directory")
+		}
+		path := rejectsPath(v.config, v.agency)
+		file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return errors.Wrap(err, "could not open the rejects file")
+		}
+		v.rejects = file
+	}
+	n, err := v.rejects.WriteString(row + "\n")
+	v.rejectsSize += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "could not quarantine the row")
+	}
+	return errors.Wrap(v.rejects.Sync(), "could not quarantine the row")
+}
+
+// close Logs the summary of the validation and closes the rejects file
+func (v *betValidator) close(err error) {
+	if v == nil {
+		return
+	}
+	if v.rejects != nil {
+		v.rejects.Close()
+	}
+
+	result := "success"
+	if err != nil {
+		result = "fail"
+	}
+	fields := []interface{}{
+		"client_id", v.agency,
+		"policy", v.config.Policy,
+		"rows", v.summary.Rows,
+		"valid", v.summary.Valid,
+		"invalid", v.summary.Invalid(),
+		"skipped", v.summary.Skipped,
+		"quarantined", v.summary.Quarantined,
+	}
+	reasons := make([]string, 0, len(v.summary.Reasons))
+	for reason := range v.summary.Reasons {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		fields = append(fields, "invalid_"+reason, v.summary.Reasons[reason])
+	}
+	log.Info(NewEvent("validate_bets", result, fields...))
+}
+
+// isRowError Returns true if the error comes from a row of the CSV file
+// that could not be parsed, rather than from reading the file
+func isRowError(err error) bool {
+	_, ok := err.(*csv.ParseError)
+	return ok
+}
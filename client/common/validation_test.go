@@ -0,0 +1,172 @@
+package common
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+var testValidation = ValidationConfig{MinNumber: 0, MaxNumber: 9999}
+
+func TestParseBet(t *testing.T) {
+	today := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	valid := protocol.Bet{FirstName: "Tiago Nicolás", LastName: "Rivera", Document: "34407251", Birthdate: "2001-08-29", Number: "1033"}
+	bet, err := ParseBet(valid, testValidation, today)
+	if err != nil || bet.Document != 34407251 || bet.Number != 1033 || bet.Birthdate.Year() != 2001 {
+		t.Fatalf("expected the bet to be valid, got %+v and %v", bet, err)
+	}
+
+	for field, invalid := range map[string]func(*protocol.Bet){
+		"first_name": func(b *protocol.Bet) { b.FirstName = " " },
+		"last_name":  func(b *protocol.Bet) { b.LastName = "" },
+		"document":   func(b *protocol.Bet) { b.Document = "3440725l" },
+		"birthdate":  func(b *protocol.Bet) { b.Birthdate = "2024-05-02" },
+		"number":     func(b *protocol.Bet) { b.Number = "10000" },
+	} {
+		bet := valid
+		invalid(&bet)
+		_, err := ParseBet(bet, testValidation, today)
+		if invalidErr, ok := err.(*InvalidBetError); !ok || invalidErr.Field != field {
+			t.Errorf("expected the %s to be invalid, got %v", field, err)
+		}
+	}
+	for _, document := range []string{"99999", "100000000"} {
+		bet := valid
+		bet.Document = document
+		if _, err := ParseBet(bet, testValidation, today); err == nil {
+			t.Errorf("expected document %s to be out of range", document)
+		}
+	}
+}
+
+// testInvalidCSV Holds a valid row, a row with a negative number, a row
+// with missing fields and another valid row
+const testInvalidCSV = `Santiago Lionel,Lorca,30904465,1999-03-17,2201
+Agustin Emanuel,Zambrano,21689196,2000-05-10,-1
+only,three,fields
+Tiago Nicolás,Rivera,34407251,2001-08-29,1033
+`
+
+// readAllBets Returns every bet the batcher accepts
+func readAllBets(batches *batcher) ([]protocol.Bet, error) {
+	var bets []protocol.Bet
+	for {
+		batch, err := batches.Next()
+		if err == io.EOF {
+			return bets, nil
+		}
+		if err != nil {
+			return bets, err
+		}
+		bets = append(bets, batch...)
+	}
+}
+
+func TestInvalidBetsAreSkipped(t *testing.T) {
+	config := testValidation
+	config.Policy = InvalidBetsSkip
+	validator := newBetValidator("1", config)
+	batches := newBatcher(newBetReader(strings.NewReader(testInvalidCSV)), validator, 10)
+
+	bets, err := readAllBets(batches)
+	if err != nil || len(bets) != 2 || bets[1].Document != "34407251" {
+		t.Fatalf("expected the two valid bets, got %+v and %v", bets, err)
+	}
+	summary := validator.summary
+	if summary.Rows != 4 || summary.Valid != 2 || summary.Skipped != 2 || summary.Reasons["number"] != 1 || summary.Reasons["row"] != 1 {
+		t.Errorf("unexpected summary %+v", summary)
+	}
+	if batches.Offset() != int64(len(testInvalidCSV)) {
+		t.Errorf("expected offset %d, got %d", len(testInvalidCSV), batches.Offset())
+	}
+}
+
+func TestInvalidBetsAreQuarantined(t *testing.T) {
+	config := testValidation
+	config.Policy = InvalidBetsQuarantine
+	config.RejectsDir = filepath.Join(t.TempDir(), "rejects")
+	validator := newBetValidator("1", config)
+	batches := newBatcher(newBetReader(strings.NewReader(testInvalidCSV)), validator, 10)
+
+	if bets, err := readAllBets(batches); err != nil || len(bets) != 2 {
+		t.Fatalf("expected the two valid bets, got %+v and %v", bets, err)
+	}
+	validator.close(nil)
+
+	rejects, err := os.ReadFile(filepath.Join(config.RejectsDir, rejectsFileName("1")))
+	rows := strings.SplitAfter(testInvalidCSV, "\n")
+	if err != nil || string(rejects) != rows[1]+rows[2] {
+		t.Fatalf("expected the invalid rows to be quarantined, got %q and %v", rejects, err)
+	}
+	if validator.summary.Quarantined != 2 {
+		t.Errorf("unexpected summary %+v", validator.summary)
+	}
+}
+
+func TestResumingDiscardsTheRowsQuarantinedAfterTheCheckpoint(t *testing.T) {
+	config := testValidation
+	config.Policy = InvalidBetsQuarantine
+	config.RejectsDir = t.TempDir()
+	path := rejectsPath(config, "1")
+	previous := "quarantined,by,a,previous,upload\n"
+	if err := os.WriteFile(path, []byte(previous), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first run saves a checkpoint after the first bet, and crashes
+	// after quarantining the following rows
+	validator := newBetValidator("1", config)
+	if err := validator.resume(int64(len(previous))); err != nil {
+		t.Fatal(err)
+	}
+	batches := newBatcher(newBetReader(strings.NewReader(testInvalidCSV)), validator, 1)
+	if _, err := batches.Next(); err != nil {
+		t.Fatal(err)
+	}
+	checkpoint := Checkpoint{Offset: batches.Offset(), Rejects: validator.rejectsOffset(0)}
+	if _, err := readAllBets(batches); err != nil {
+		t.Fatal(err)
+	}
+	validator.close(nil)
+
+	validator = newBetValidator("1", config)
+	if err := validator.resume(checkpoint.Rejects); err != nil {
+		t.Fatal(err)
+	}
+	reader := newBetReader(strings.NewReader(testInvalidCSV))
+	if err := reader.Skip(checkpoint.Offset); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readAllBets(newBatcher(reader, validator, 1)); err != nil {
+		t.Fatal(err)
+	}
+	validator.close(nil)
+
+	rejects, err := os.ReadFile(path)
+	rows := strings.SplitAfter(testInvalidCSV, "\n")
+	if err != nil || string(rejects) != previous+rows[1]+rows[2] {
+		t.Fatalf("expected the invalid rows to be quarantined once, got %q and %v", rejects, err)
+	}
+	if size := validator.rejectsOffset(0); size != int64(len(rejects)) {
+		t.Errorf("expected the rejects offset to be %d, got %d", len(rejects), size)
+	}
+}
+
+func TestInvalidBetsAbortTheUpload(t *testing.T) {
+	config := testValidation
+	config.Policy = InvalidBetsAbort
+	batches := newBatcher(newBetReader(strings.NewReader(testInvalidCSV)), newBetValidator("1", config), 10)
+
+	_, err := readAllBets(batches)
+	var invalid *InvalidBetError
+	if !errors.As(err, &invalid) || invalid.Field != "number" || !strings.Contains(err.Error(), "line 2") {
+		t.Fatalf("expected the number on line 2 to stop the upload, got %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package common
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// QueryWinners Polls the server with GET_WINNERS until the draw is made,
+// waiting between attempts according to the configured backoff. Once the
+// server answers WINNERS_READY the BETTING_RESULTS of the agency are read
+// and the documents of the winners are returned
+func (c *Client) QueryWinners(ctx context.Context) ([]string, error) {
+	retries := newBackoff(c.config.WinnersBackoff)
+	for {
+		if c.stopping() {
+			return nil, ErrShutdown
+		}
+
+		start := time.Now()
+		documents, ready, err := c.getWinners(ctx)
+		c.observe("get_winners", start, err)
+		if err != nil {
+			log.Error(NewEvent("consulta_ganadores", "fail",
+				"client_id", c.config.ID,
+				"error", err,
+			))
+			return nil, err
+		}
+		if ready {
+			log.Info(NewEvent("consulta_ganadores", "success", "cant_ganadores", len(documents)))
+			return documents, nil
+		}
+
+		delay, ok := retries.Next()
+		if !ok {
+			err := errors.Errorf("winners not ready after %v", c.config.WinnersBackoff.MaxWait)
+			log.Error(NewEvent("consulta_ganadores", "fail",
+				"client_id", c.config.ID,
+				"error", err,
+			))
+			return nil, err
+		}
+		log.Debug(NewEvent("consulta_ganadores", "in_progress",
+			"client_id", c.config.ID,
+			"retry_in", delay,
+		))
+		if err := c.sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// getWinners Sends a GET_WINNERS through a new connection. The server
+// answers ACKNOWLEDGE while the draw is pending, or WINNERS_READY followed
+// by the BETTING_RESULTS of the agency once it was made
+func (c *Client) getWinners(ctx context.Context) ([]string, bool, error) {
+	if err := c.connectAgency(ctx); err != nil {
+		return nil, false, err
+	}
+	defer c.Close()
+
+	if err := c.Send(ctx, &protocol.GetWinners{}); err != nil {
+		return nil, false, err
+	}
+
+	res, err := c.Receive(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	switch res.(type) {
+	case *protocol.Acknowledge:
+		c.metrics.messageAcknowledged(c.config.ID)
+		return nil, false, nil
+	case *protocol.WinnersReady:
+		c.metrics.messageAcknowledged(c.config.ID)
+	default:
+		return nil, false, errors.Wrapf(protocol.ErrUnexpectedMessage, "expected %v, got %v", protocol.KindWinnersReady, res.Kind())
+	}
+
+	res, err = c.Receive(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	results, ok := res.(*protocol.BettingResults)
+	if !ok {
+		return nil, false, errors.Wrapf(protocol.ErrUnexpectedMessage, "expected %v, got %v", protocol.KindBettingResults, res.Kind())
+	}
+	return results.Documents, true, nil
+}
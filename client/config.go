@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// settingType How the value of a setting is parsed
+type settingType int
+
+const (
+	typeString settingType = iota
+	typeInt
+	typeFloat
+	typeDuration
+	typeBool
+	// typeAddress A HOST:PORT address, the host may be empty to listen on
+	// every interface
+	typeAddress
+)
+
+func (t settingType) String() string {
+	switch t {
+	case typeInt:
+		return "int"
+	case typeFloat:
+		return "float"
+	case typeDuration:
+		return "time.Duration"
+	case typeBool:
+		return "bool"
+	case typeAddress:
+		return "HOST:PORT"
+	default:
+		return "string"
+	}
+}
+
+// noLimit Marks a setting without a minimum or maximum
+var noLimit = math.NaN()
+
+// setting Schema of a configuration key of the client
+type setting struct {
+	key   string
+	usage string
+	typ   settingType
+	// required The key must be set by some source, defaults excluded
+	required bool
+	// def Default value, nil if there is none
+	def interface{}
+	// min, max Range of the numbers and durations, in seconds for the
+	// latter, or noLimit
+	min, max float64
+	// oneOf Values accepted, compared without case, or nil for any value.
+	// Read them with getOneOf to get the value as written here
+	oneOf []string
+}
+
+// schema Every configuration key of the client. Each one can be set with
+// a flag named after it, e.g. --batch-max-amount for batch.maxAmount, and
+// with a CLI_ env variable, e.g. CLI_BATCH_MAXAMOUNT
+var schema = []setting{
+	{key: "id", usage: "ID of the agency", typ: typeInt, required: true, min: 0, max: math.MaxUint32},
+	{key: "server.address", usage: "address of the server, as HOST:PORT", typ: typeAddress, required: true, min: noLimit, max: noLimit},
+	{key: "mode", usage: "what to run without a command, echo or bets", typ: typeString, min: noLimit, max: noLimit, oneOf: []string{"echo", "bets"}},
+	{key: "loop.amount", usage: "amount of messages sent by the loop", typ: typeInt, required: true, min: 0, max: noLimit},
+	{key: "loop.period", usage: "time waited between the messages of the loop", typ: typeDuration, required: true, min: 0, max: noLimit},
+	{key: "loop.connection", usage: "per-message or persistent", typ: typeString, def: common.ConnectionPerMessage, min: noLimit, max: noLimit, oneOf: []string{common.ConnectionPerMessage, common.ConnectionPersistent}},
+	{key: "log.level", usage: "log level", typ: typeString, def: "INFO", min: noLimit, max: noLimit, oneOf: []string{"CRITICAL", "ERROR", "WARNING", "NOTICE", "INFO", "DEBUG"}},
+	{key: "log.format", usage: "text, json or logfmt", typ: typeString, def: common.LogFormatText, min: noLimit, max: noLimit, oneOf: []string{common.LogFormatText, common.LogFormatJSON, common.LogFormatLogfmt}},
+	{key: "socket.timeout", usage: "maximum time a read or write may take, 0 for none", typ: typeDuration, min: 0, max: noLimit},
+	{key: "batch.maxAmount", usage: "maximum amount of bets sent per batch", typ: typeInt, min: 0, max: noLimit},
+	{key: "batch.dataset", usage: "zip file, directory or CSV file with the bets", typ: typeString, min: noLimit, max: noLimit},
+	{key: "checkpoint.dir", usage: "directory where the progress of the bets upload is saved, disabled if empty", typ: typeString, def: "./.data/checkpoints", min: noLimit, max: noLimit},
+	{key: "spool.dir", usage: "directory where the batches are queued while the server is unreachable, disabled if empty", typ: typeString, def: "./.data/spool", min: noLimit, max: noLimit},
+	{key: "spool.retryInterval", usage: "time waited before connecting again to send the queued batches", typ: typeDuration, def: "1s", min: 0, max: noLimit},
+
+	// Checks applied to the bets before they are sent, and what is done
+	// with the rows that fail them
+	{key: "validation.policy", usage: "what to do with an invalid bet, skip, quarantine or abort", typ: typeString, def: common.InvalidBetsAbort, min: noLimit, max: noLimit, oneOf: []string{common.InvalidBetsSkip, common.InvalidBetsQuarantine, common.InvalidBetsAbort}},
+	{key: "validation.rejectsDir", usage: "directory of the file where quarantined rows are written", typ: typeString, def: "./.data/rejects", min: noLimit, max: noLimit},
+	{key: "validation.number.min", usage: "lowest number a bet may be placed on", typ: typeInt, def: 0, min: 0, max: noLimit},
+	{key: "validation.number.max", usage: "highest number a bet may be placed on", typ: typeInt, def: 9999, min: 0, max: noLimit},
+
+	// Policy followed while polling the server for the winners
+	{key: "winners.backoff.initial", usage: "first wait between winner queries", typ: typeDuration, def: "100ms", min: 0, max: noLimit},
+	{key: "winners.backoff.max", usage: "longest wait between winner queries", typ: typeDuration, def: "5s", min: 0, max: noLimit},
+	{key: "winners.backoff.multiplier", usage: "growth of the wait between winner queries", typ: typeFloat, def: 2, min: 1, max: noLimit},
+	{key: "winners.backoff.jitter", usage: "random fraction added to the wait between winner queries", typ: typeFloat, def: 0.2, min: 0, max: 1},
+	{key: "winners.backoff.maxWait", usage: "time after which the winners query is given up", typ: typeDuration, def: "2m", min: 0, max: noLimit},
+
+	// Time given to the request in progress to finish once a SIGTERM is received
+	{key: "shutdown.grace", usage: "time given to the request in progress once a signal is received", typ: typeDuration, def: "500ms", min: 0, max: noLimit},
+
+	// Policy followed while the server cannot be reached, e.g. while it is
+	// still starting
+	{key: "connect.timeout", usage: "maximum time a dial may take", typ: typeDuration, def: "5s", min: 0, max: noLimit},
+	{key: "reconnect.attempts", usage: "dials made before giving up", typ: typeInt, def: 5, min: 1, max: noLimit},
+	{key: "reconnect.initialDelay", usage: "first wait between dials", typ: typeDuration, def: "200ms", min: 0, max: noLimit},
+	{key: "reconnect.maxDelay", usage: "longest wait between dials", typ: typeDuration, def: "5s", min: 0, max: noLimit},
+	{key: "reconnect.jitter", usage: "random fraction added to the wait between dials", typ: typeFloat, def: 0.2, min: 0, max: 1},
+
+	// Encryption of the connections to the server. The certificate and key
+	// are only needed when the server requires mutual TLS
+	{key: "tls.enabled", usage: "connect to the server over TLS", typ: typeBool, def: false, min: noLimit, max: noLimit},
+	{key: "tls.caFile", usage: "PEM bundle that verifies the server, the system roots if empty", typ: typeString, min: noLimit, max: noLimit},
+	{key: "tls.certFile", usage: "PEM certificate presented to the server for mutual TLS", typ: typeString, min: noLimit, max: noLimit},
+	{key: "tls.keyFile", usage: "PEM key of the certificate presented to the server", typ: typeString, min: noLimit, max: noLimit},
+	{key: "tls.serverName", usage: "name checked against the server certificate, the host of server.address if empty", typ: typeString, min: noLimit, max: noLimit},
+	{key: "tls.minVersion", usage: "minimum TLS version, 1.2 or 1.3", typ: typeString, def: common.TLSVersion12, min: noLimit, max: noLimit, oneOf: []string{common.TLSVersion12, common.TLSVersion13}},
+
+	// Secret shared with the server, used to authenticate every connection
+	// of the binary protocol
+	{key: "auth.secretFile", usage: "file with the secret shared with the server, no authentication if empty", typ: typeString, min: noLimit, max: noLimit},
+
+	{key: "metrics.address", usage: "address of the metrics HTTP listener, disabled if empty", typ: typeAddress, min: noLimit, max: noLimit},
+}
+
+// lookupSetting Returns the schema of the key
+func lookupSetting(key string) (setting, bool) {
+	for _, s := range schema {
+		if s.key == key {
+			return s, true
+		}
+	}
+	return setting{}, false
+}
+
+// ConfigError Every problem found while validating the configuration
+type ConfigError struct {
+	Problems []string
+}
+
+func (e *ConfigError) Error() string {
+	return fmt.Sprintf("invalid configuration, %d problem(s):\n  - %s", len(e.Problems), strings.Join(e.Problems, "\n  - "))
+}
+
+// validateConfig Checks the given keys, or every key of the schema if
+// none is given, against the schema. All the problems found are
+// reported together in a *ConfigError
+func validateConfig(v *viper.Viper, keys ...string) error {
+	settings := schema
+	if len(keys) > 0 {
+		settings = nil
+		for _, key := range keys {
+			if s, ok := lookupSetting(key); ok {
+				settings = append(settings, s)
+			}
+		}
+	}
+
+	var problems []string
+	valid := make(map[string]bool)
+	for _, s := range settings {
+		if err := s.validate(v); err != nil {
+			problems = append(problems, fmt.Sprintf("%s (CLI_%s): %v", s.key, envName(s.key), err))
+		} else {
+			valid[s.key] = true
+		}
+	}
+	if valid["validation.number.min"] && valid["validation.number.max"] {
+		if min, max := v.GetInt("validation.number.min"), v.GetInt("validation.number.max"); min > max {
+			problems = append(problems, fmt.Sprintf("validation.number.min (CLI_%s): must be at most validation.number.max %d, got %d", envName("validation.number.min"), max, min))
+		}
+	}
+	if len(problems) > 0 {
+		return &ConfigError{Problems: problems}
+	}
+	return nil
+}
+
+// getOneOf Returns the value of a setting with accepted values as it is
+// written in the schema, whatever its case in v, so it can be compared
+// exactly. The value is returned as is if it is not one of them
+func getOneOf(v *viper.Viper, key string) string {
+	raw := strings.TrimSpace(v.GetString(key))
+	if s, ok := lookupSetting(key); ok {
+		for _, accepted := range s.oneOf {
+			if strings.EqualFold(raw, accepted) {
+				return accepted
+			}
+		}
+	}
+	return raw
+}
+
+// validate Checks the value the setting has in v
+func (s setting) validate(v *viper.Viper) error {
+	if !v.IsSet(s.key) {
+		if s.required {
+			return fmt.Errorf("is required")
+		}
+		return nil
+	}
+	raw := strings.TrimSpace(v.GetString(s.key))
+	if raw == "" {
+		if s.required {
+			return fmt.Errorf("can not be empty")
+		}
+		return nil
+	}
+
+	var number float64
+	switch s.typ {
+	case typeInt:
+		value, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return fmt.Errorf("expected an %v, got %q", s.typ, raw)
+		}
+		number = float64(value)
+	case typeFloat:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return fmt.Errorf("expected a %v, got %q", s.typ, raw)
+		}
+		number = value
+	case typeDuration:
+		value, err := time.ParseDuration(raw)
+		if err != nil {
+			return fmt.Errorf("expected a %v such as 5s, got %q", s.typ, raw)
+		}
+		number = value.Seconds()
+	case typeBool:
+		if _, err := strconv.ParseBool(raw); err != nil {
+			return fmt.Errorf("expected a %v, got %q", s.typ, raw)
+		}
+	case typeAddress:
+		host, port, err := net.SplitHostPort(raw)
+		if err != nil {
+			return fmt.Errorf("expected %v, got %q", s.typ, raw)
+		}
+		if s.required && host == "" {
+			return fmt.Errorf("expected a host in %q", raw)
+		}
+		if value, err := strconv.ParseUint(port, 10, 16); err != nil || value == 0 {
+			return fmt.Errorf("invalid port in %q", raw)
+		}
+	}
+
+	if !math.IsNaN(s.min) && number < s.min {
+		return fmt.Errorf("must be at least %v, got %q", s.limit(s.min), raw)
+	}
+	if !math.IsNaN(s.max) && number > s.max {
+		return fmt.Errorf("must be at most %v, got %q", s.limit(s.max), raw)
+	}
+
+	if s.oneOf != nil {
+		for _, accepted := range s.oneOf {
+			if strings.EqualFold(raw, accepted) {
+				return nil
+			}
+		}
+		return fmt.Errorf("expected one of %s, got %q", strings.Join(s.oneOf, ", "), raw)
+	}
+	return nil
+}
+
+// limit Formats a limit of the setting as its values are written
+func (s setting) limit(value float64) interface{} {
+	if s.typ == typeDuration {
+		return time.Duration(value * float64(time.Second))
+	}
+	return value
+}
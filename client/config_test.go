@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// validConfig Returns a viper with every required key set
+func validConfig() *viper.Viper {
+	v := viper.New()
+	for _, setting := range schema {
+		if setting.def != nil {
+			v.SetDefault(setting.key, setting.def)
+		}
+	}
+	v.Set("id", 1)
+	v.Set("server.address", "server:12345")
+	v.Set("loop.amount", 5)
+	v.Set("loop.period", "5s")
+	return v
+}
+
+func TestValidateConfigAcceptsAValidConfig(t *testing.T) {
+	v := validConfig()
+	v.Set("metrics.address", ":9100")
+	v.Set("log.level", "debug")
+	if err := validateConfig(v); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestValidateConfigReportsEveryProblem(t *testing.T) {
+	v := validConfig()
+	v.Set("id", "")
+	v.Set("server.address", "server")
+	v.Set("loop.amount", -1)
+	v.Set("loop.period", "soon")
+	v.Set("loop.connection", "sometimes")
+	v.Set("winners.backoff.jitter", 1.5)
+	v.Set("reconnect.attempts", 0)
+	v.Set("metrics.address", "localhost:99999")
+	v.Set("validation.number.min", 100)
+	v.Set("validation.number.max", 10)
+
+	err := validateConfig(v)
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) {
+		t.Fatalf("expected a *ConfigError, got %v", err)
+	}
+	want := []string{
+		"id (CLI_ID)",
+		"server.address (CLI_SERVER_ADDRESS)",
+		"loop.amount (CLI_LOOP_AMOUNT)",
+		"loop.period (CLI_LOOP_PERIOD)",
+		"loop.connection (CLI_LOOP_CONNECTION)",
+		"winners.backoff.jitter (CLI_WINNERS_BACKOFF_JITTER)",
+		"reconnect.attempts (CLI_RECONNECT_ATTEMPTS)",
+		"metrics.address (CLI_METRICS_ADDRESS)",
+		"validation.number.min (CLI_VALIDATION_NUMBER_MIN)",
+	}
+	if len(configErr.Problems) != len(want) {
+		t.Fatalf("expected %d problems, got %d\n%v", len(want), len(configErr.Problems), err)
+	}
+	for i, prefix := range want {
+		if !strings.HasPrefix(configErr.Problems[i], prefix) {
+			t.Errorf("expected problem %d to be about %s, got %q", i, prefix, configErr.Problems[i])
+		}
+	}
+}
+
+func TestGetOneOfReturnsTheValuesAsTheSchemaWritesThem(t *testing.T) {
+	v := validConfig()
+	v.Set("mode", "BETS")
+	v.Set("loop.connection", "Persistent")
+	v.Set("log.level", "debug")
+	v.Set("log.format", " JSON ")
+	v.Set("validation.policy", "Quarantine")
+	if err := validateConfig(v); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for key, want := range map[string]string{
+		"mode":              "bets",
+		"loop.connection":   common.ConnectionPersistent,
+		"log.level":         "DEBUG",
+		"log.format":        common.LogFormatJSON,
+		"validation.policy": common.InvalidBetsQuarantine,
+	} {
+		if got := getOneOf(v, key); got != want {
+			t.Errorf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+}
+
+func TestValidateConfigRequiresKeys(t *testing.T) {
+	err := validateConfig(viper.New(), "id", "server.address", "socket.timeout")
+	var configErr *ConfigError
+	if !errors.As(err, &configErr) || len(configErr.Problems) != 2 {
+		t.Fatalf("expected id and server.address to be required, got %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+const usage = `Usage: client [command] [flags]
+
+Commands:
+  echo                  send the messages of the loop to the echo server
+  send-bets             send the bets of the agency and finish
+  winners               query the winners of the agency
+  validate-echo-server  check that the echo server answers every message
+  validate-config       check the configuration and exit
+  print-config          print the configuration and where each value came from
+
+Without a command the client runs the configured mode. Flags take
+precedence over the CLI_ env variables, which take precedence over the
+config file.
+
+Flags:
+`
+
+const (
+	commandEcho               = "echo"
+	commandSendBets           = "send-bets"
+	commandWinners            = "winners"
+	commandValidateEchoServer = "validate-echo-server"
+	commandValidateConfig     = "validate-config"
+	commandPrintConfig        = "print-config"
+)
+
+var commands = []string{
+	commandEcho,
+	commandSendBets,
+	commandWinners,
+	commandValidateEchoServer,
+	commandValidateConfig,
+	commandPrintConfig,
+}
+
+// flagName Returns the name of the flag that sets the configuration key
+func flagName(key string) string {
+	var b strings.Builder
+	for _, r := range key {
+		switch {
+		case r == '.':
+			b.WriteByte('-')
+		case unicode.IsUpper(r):
+			b.WriteByte('-')
+			b.WriteRune(unicode.ToLower(r))
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// ParseArgs Splits the command from the flags and parses them. The
+// command is empty if none was given
+func ParseArgs(args []string) (string, *pflag.FlagSet, error) {
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+		if !isCommand(command) {
+			return "", nil, fmt.Errorf("unknown command %q", command)
+		}
+	}
+
+	flags := pflag.NewFlagSet("client", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	flags.String("config", "./config.yaml", "config file")
+	flags.Bool("restart", false, "discard the checkpoint and the spool of the bets upload and start from the first bet")
+	for _, config := range schema {
+		flags.String(flagName(config.key), "", config.usage)
+	}
+	return command, flags, flags.Parse(args)
+}
+
+func isCommand(name string) bool {
+	for _, command := range commands {
+		if command == name {
+			return true
+		}
+	}
+	return false
+}
+
+// bindFlags Makes the flags set on the command line take precedence over
+// every other source of their configuration key
+func bindFlags(v *viper.Viper, flags *pflag.FlagSet) {
+	for _, config := range schema {
+		v.BindPFlag(config.key, flags.Lookup(flagName(config.key)))
+	}
+}
+
+// configSource Returns where the value of the configuration key came
+// from: flag, env, file, default or unset
+func configSource(v *viper.Viper, file *viper.Viper, flags *pflag.FlagSet, key string) string {
+	if flag := flags.Lookup(flagName(key)); flag != nil && flag.Changed {
+		return "flag"
+	}
+	if _, ok := os.LookupEnv("CLI_" + envName(key)); ok {
+		return "env"
+	}
+	if file != nil && file.IsSet(key) {
+		return "file"
+	}
+	if v.IsSet(key) {
+		return "default"
+	}
+	return "unset"
+}
+
+// readConfigFile Reads the config file on its own, to tell which values
+// come from it. Returns nil if it cannot be read
+func readConfigFile(v *viper.Viper) *viper.Viper {
+	file := viper.New()
+	file.SetConfigFile(v.ConfigFileUsed())
+	if err := file.ReadInConfig(); err != nil {
+		return nil
+	}
+	return file
+}
+
+// WriteConfig Writes every configuration key with its value and the
+// source it came from, one per line
+func WriteConfig(w io.Writer, v *viper.Viper, flags *pflag.FlagSet) {
+	file := readConfigFile(v)
+	for _, config := range schema {
+		fmt.Fprintf(w, "%-28s %-30v %s\n", config.key, v.Get(config.key), configSource(v, file, flags, config.key))
+	}
+}
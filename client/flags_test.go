@@ -0,0 +1,79 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFlagName(t *testing.T) {
+	for key, want := range map[string]string{
+		"id":                      "id",
+		"server.address":          "server-address",
+		"batch.maxAmount":         "batch-max-amount",
+		"winners.backoff.maxWait": "winners-backoff-max-wait",
+	} {
+		if got := flagName(key); got != want {
+			t.Errorf("flagName(%q) = %q, expected %q", key, got, want)
+		}
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	command, flags, err := ParseArgs([]string{"send-bets", "--id", "3"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id, _ := flags.GetString("id"); command != commandSendBets || id != "3" {
+		t.Errorf("unexpected command %q and id %q", command, id)
+	}
+
+	if command, _, err := ParseArgs([]string{"--id", "3"}); err != nil || command != "" {
+		t.Errorf("expected no command, got %q and %v", command, err)
+	}
+	if _, _, err := ParseArgs([]string{"dance"}); err == nil {
+		t.Error("expected an unknown command to be rejected")
+	}
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "id: 1\nserver:\n  address: localhost:12345\nloop:\n  amount: 5\n  period: 1s\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CLI_LOOP_PERIOD", "2s")
+	t.Setenv("CLI_ID", "4")
+
+	_, flags, err := ParseArgs([]string{"--config", path, "--id", "9"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := InitConfig(flags)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	file := readConfigFile(v)
+	for key, want := range map[string]struct{ value, source string }{
+		"id":              {"9", "flag"},
+		"loop.period":     {"2s", "env"},
+		"loop.amount":     {"5", "file"},
+		"shutdown.grace":  {"500ms", "default"},
+		"metrics.address": {"", "unset"},
+	} {
+		if got := v.GetString(key); got != want.value {
+			t.Errorf("%s: expected %q, got %q", key, want.value, got)
+		}
+		if got := configSource(v, file, flags, key); got != want.source {
+			t.Errorf("%s: expected source %s, got %s", key, want.source, got)
+		}
+	}
+
+	var out strings.Builder
+	WriteConfig(&out, v, flags)
+	if !strings.Contains(out.String(), "loop.period") || !strings.Contains(out.String(), " env\n") {
+		t.Errorf("unexpected config dump\n%s", out.String())
+	}
+}
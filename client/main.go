@@ -1,13 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/fsnotify/fsnotify"
 	"github.com/op/go-logging"
 	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
 	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
@@ -15,13 +24,18 @@ import (
 
 var log = logging.MustGetLogger("log")
 
+// exitCodeShutdown Exit status used when the client stops because of a
+// SIGTERM or SIGINT, 128 + SIGTERM as the shells report it
+const exitCodeShutdown = 143
+
 // InitConfig Function that uses viper library to parse configuration parameters.
-// Viper is configured to read variables from both environment variables and the
-// config file ./config.yaml. Environment variables takes precedence over parameters
-// defined in the configuration file. If some of the variables cannot be parsed,
-// an error is returned
-func InitConfig() (*viper.Viper, error) {
+// Viper is configured to read variables from the command line flags, environment
+// variables and the config file (./config.yaml unless --config is given), in that
+// order of precedence. If some of the variables do not follow the schema, a
+// *ConfigError listing every problem is returned
+func InitConfig(flags *pflag.FlagSet) (*viper.Viper, error) {
 	v := viper.New()
+	bindFlags(v, flags)
 
 	// Configure viper to read env variables with the CLI_ prefix
 	v.AutomaticEnv()
@@ -31,85 +45,389 @@ func InitConfig() (*viper.Viper, error) {
 	// env variables for the nested configurations
 	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
 
-	// Add env variables supported
-	v.BindEnv("id")
-	v.BindEnv("server", "address")
-	v.BindEnv("loop", "period")
-	v.BindEnv("loop", "amount")
-	v.BindEnv("log", "level")
+	// Add the env variables and defaults of every key of the schema
+	for _, setting := range schema {
+		v.BindEnv(setting.key)
+		if setting.def != nil {
+			v.SetDefault(setting.key, setting.def)
+		}
+	}
 
 	// Try to read configuration from config file. If config file
 	// does not exists then ReadInConfig will fail but configuration
 	// can be loaded from the environment variables so we shouldn't
 	// return an error in that case
-	v.SetConfigFile("./config.yaml")
+	configFile, _ := flags.GetString("config")
+	v.SetConfigFile(configFile)
 	if err := v.ReadInConfig(); err != nil {
 		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
 	}
 
-	// Parse time.Duration variables and return an error if those variables cannot be parsed
-
-	if _, err := time.ParseDuration(v.GetString("loop.period")); err != nil {
-		return nil, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD env var as time.Duration.")
+	// Check every key against the schema so all the problems are reported
+	// at once, before connecting to the server
+	if err := validateConfig(v); err != nil {
+		return nil, err
 	}
 
 	return v, nil
 }
 
-// InitLogger Receives the log level to be set in go-logging as a string. This method
-// parses the string and set the level to the logger. If the level string is not
-// valid an error is returned
-func InitLogger(logLevel string) error {
-	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
-	format := logging.MustStringFormatter(
-		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
-	)
-	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
-
-	backendLeveled := logging.AddModuleLevel(backendFormatter)
+// envName Returns the name of the env variable (without the CLI_ prefix)
+// that overrides the given configuration key
+func envName(key string) string {
+	return strings.ToUpper(strings.ReplaceAll(key, ".", "_"))
+}
+
+// InitTLS Loads the files of the TLS configuration. Returns a nil
+// configuration if TLS is disabled, so plain TCP is used
+func InitTLS(v *viper.Viper) (*tls.Config, error) {
+	if !v.GetBool("tls.enabled") {
+		return nil, nil
+	}
+	config, err := common.NewTLSConfig(common.TLSOptions{
+		CAFile:     v.GetString("tls.caFile"),
+		CertFile:   v.GetString("tls.certFile"),
+		KeyFile:    v.GetString("tls.keyFile"),
+		ServerName: v.GetString("tls.serverName"),
+		MinVersion: getOneOf(v, "tls.minVersion"),
+	})
+	return config, errors.Wrap(err, "Could not load the TLS configuration.")
+}
+
+// InitLogger Receives the log level and format to be set in go-logging as strings.
+// This method parses the level and set it to the logger. The text format keeps the
+// lines parsed by the grading scripts, while json and logfmt emit every event as a
+// structured record. If the level or the format are not valid an error is returned
+// The returned backend allows changing the level later
+func InitLogger(logLevel string, logFormat string) (*common.LevelBackend, error) {
+	baseBackend, err := common.NewLogBackend(os.Stdout, logFormat)
+	if err != nil {
+		return nil, err
+	}
+
 	logLevelCode, err := logging.LogLevel(logLevel)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	backendLeveled.SetLevel(logLevelCode, "")
+	backendLeveled := common.NewLevelBackend(baseBackend, logLevelCode)
 
 	// Set the backends to be used.
 	logging.SetBackend(backendLeveled)
-	return nil
+	return backendLeveled, nil
+}
+
+// WatchConfig Reloads the reloadable part of the configuration every time
+// the config file changes. The new values are validated as a whole and are
+// only applied if all of them are valid, otherwise the current ones are
+// kept. Env variables still take precedence over the file
+func WatchConfig(v *viper.Viper, client *common.Client, logger *common.LevelBackend) {
+	v.OnConfigChange(func(e fsnotify.Event) {
+		reloaded, level, err := reloadableConfig(v)
+		if err != nil {
+			log.Error(common.NewEvent("config_reload", "fail",
+				"client_id", v.GetString("id"),
+				"file", e.Name,
+				"error", err,
+			))
+			return
+		}
+
+		client.Reload(reloaded)
+		logger.SetLevel(level, "")
+		log.Info(common.NewEvent("config_reload", "success",
+			"client_id", v.GetString("id"),
+			"loop_amount", reloaded.LoopAmount,
+			"loop_period", reloaded.LoopPeriod,
+			"log_level", level,
+			"batch_max_amount", reloaded.BatchMaxAmount,
+			"batch_dataset", reloaded.BatchDataset,
+		))
+	})
+	v.WatchConfig()
+}
+
+// reloadableConfig Parses and validates the configuration that can be
+// reloaded. Unlike the viper getters, values that cannot be parsed are
+// reported instead of being replaced by zero
+func reloadableConfig(v *viper.Viper) (common.ReloadableConfig, logging.Level, error) {
+	var config common.ReloadableConfig
+	err := validateConfig(v, "loop.amount", "loop.period", "batch.maxAmount", "batch.dataset", "log.level")
+	if err != nil {
+		return config, 0, err
+	}
+	if config.LoopAmount, err = strconv.Atoi(v.GetString("loop.amount")); err != nil {
+		return config, 0, errors.Wrapf(err, "Could not parse CLI_LOOP_AMOUNT as int.")
+	}
+	if config.LoopPeriod, err = time.ParseDuration(v.GetString("loop.period")); err != nil {
+		return config, 0, errors.Wrapf(err, "Could not parse CLI_LOOP_PERIOD as time.Duration.")
+	}
+	if v.IsSet("batch.maxAmount") {
+		if config.BatchMaxAmount, err = strconv.Atoi(v.GetString("batch.maxAmount")); err != nil {
+			return config, 0, errors.Wrapf(err, "Could not parse CLI_BATCH_MAXAMOUNT as int.")
+		}
+	}
+	config.BatchDataset = v.GetString("batch.dataset")
+
+	level, err := logging.LogLevel(getOneOf(v, "log.level"))
+	if err != nil {
+		return config, 0, errors.Wrapf(err, "Could not parse CLI_LOG_LEVEL.")
+	}
+	return config, level, config.Validate()
 }
 
 // PrintConfig Print all the configuration parameters of the program.
-// For debugging purposes only
-func PrintConfig(v *viper.Viper) {
-	log.Infof("action: config | result: success | client_id: %s | server_address: %s | loop_amount: %v | loop_period: %v | log_level: %s",
-		v.GetString("id"),
-		v.GetString("server.address"),
-		v.GetInt("loop.amount"),
-		v.GetDuration("loop.period"),
-		v.GetString("log.level"),
-	)
+// For debugging purposes only. At DEBUG level every key is also logged
+// along with the source its value came from
+func PrintConfig(v *viper.Viper, flags *pflag.FlagSet) {
+	log.Info(common.NewEvent("config", "success",
+		"client_id", v.GetString("id"),
+		"server_address", v.GetString("server.address"),
+		"loop_amount", v.GetInt("loop.amount"),
+		"loop_period", v.GetDuration("loop.period"),
+		"loop_connection", getOneOf(v, "loop.connection"),
+		"log_level", getOneOf(v, "log.level"),
+		"mode", getOneOf(v, "mode"),
+		"batch_max_amount", v.GetInt("batch.maxAmount"),
+		"batch_dataset", v.GetString("batch.dataset"),
+	))
+
+	file := readConfigFile(v)
+	for _, config := range schema {
+		log.Debug(common.NewEvent("config_value", "success",
+			"key", config.key,
+			"value", v.Get(config.key),
+			"source", configSource(v, file, flags, config.key),
+		))
+	}
 }
 
 func main() {
-	v, err := InitConfig()
+	command, flags, err := ParseArgs(os.Args[1:])
+	if err == pflag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		os.Exit(1)
+	}
+
+	v, err := InitConfig(flags)
 	if err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+	tlsConfig, err := InitTLS(v)
+	if err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+	if path := v.GetString("auth.secretFile"); path != "" {
+		if _, err := common.LoadSecret(path); err != nil {
+			log.Criticalf("%s", err)
+			os.Exit(1)
+		}
+	}
+
+	switch command {
+	case commandValidateConfig:
+		fmt.Printf("action: validate_config | result: success | file: %s\n", v.ConfigFileUsed())
+		return
+	case commandPrintConfig:
+		WriteConfig(os.Stdout, v, flags)
+		return
 	}
 
-	if err := InitLogger(v.GetString("log.level")); err != nil {
+	logger, err := InitLogger(getOneOf(v, "log.level"), getOneOf(v, "log.format"))
+	if err != nil {
 		log.Criticalf("%s", err)
+		os.Exit(1)
 	}
 
 	// Print program config with debugging purposes
-	PrintConfig(v)
+	PrintConfig(v, flags)
 
 	clientConfig := common.ClientConfig{
 		ServerAddress: v.GetString("server.address"),
 		ID:            v.GetString("id"),
 		LoopAmount:    v.GetInt("loop.amount"),
 		LoopPeriod:    v.GetDuration("loop.period"),
+		SocketTimeout: v.GetDuration("socket.timeout"),
+
+		LoopConnection: getOneOf(v, "loop.connection"),
+
+		BatchMaxAmount: v.GetInt("batch.maxAmount"),
+		BatchDataset:   v.GetString("batch.dataset"),
+		CheckpointDir:  v.GetString("checkpoint.dir"),
+		SpoolDir:       v.GetString("spool.dir"),
+		SpoolRetry:     v.GetDuration("spool.retryInterval"),
+		Validation: common.ValidationConfig{
+			Policy:     getOneOf(v, "validation.policy"),
+			RejectsDir: v.GetString("validation.rejectsDir"),
+			MinNumber:  v.GetInt("validation.number.min"),
+			MaxNumber:  v.GetInt("validation.number.max"),
+		},
+
+		WinnersBackoff: common.BackoffConfig{
+			Initial:    v.GetDuration("winners.backoff.initial"),
+			Max:        v.GetDuration("winners.backoff.max"),
+			Multiplier: v.GetFloat64("winners.backoff.multiplier"),
+			Jitter:     v.GetFloat64("winners.backoff.jitter"),
+			MaxWait:    v.GetDuration("winners.backoff.maxWait"),
+		},
+
+		ConnectTimeout: v.GetDuration("connect.timeout"),
+		Reconnect: common.ReconnectConfig{
+			Attempts: v.GetInt("reconnect.attempts"),
+			Backoff: common.BackoffConfig{
+				Initial:    v.GetDuration("reconnect.initialDelay"),
+				Max:        v.GetDuration("reconnect.maxDelay"),
+				Multiplier: 2,
+				Jitter:     v.GetFloat64("reconnect.jitter"),
+			},
+		},
+
+		TLS:        tlsConfig,
+		SecretFile: v.GetString("auth.secretFile"),
 	}
 
 	client := common.NewClient(clientConfig)
-	client.StartClientLoop()
+
+	if restart, _ := flags.GetBool("restart"); restart {
+		if err := client.ResetCheckpoint(); err != nil {
+			log.Criticalf("%s", err)
+			os.Exit(1)
+		}
+	}
+
+	// Metrics are only collected when there is somewhere to expose them
+	if address := v.GetString("metrics.address"); address != "" {
+		metrics := common.NewMetrics()
+		client.SetMetrics(metrics)
+		server, err := serveMetrics(address, metrics)
+		if err != nil {
+			log.Critical(common.NewEvent("metrics_server", "fail",
+				"client_id", clientConfig.ID,
+				"address", address,
+				"error", err,
+			))
+			os.Exit(1)
+		}
+		defer server.Close()
+		log.Info(common.NewEvent("metrics_server", "success",
+			"client_id", clientConfig.ID,
+			"address", address,
+		))
+	}
+
+	// The validate-echo-server command checks the echo server and exits
+	// with a status that tells whether the validation succeeded
+	if command == commandValidateEchoServer {
+		messages := common.DefaultEchoMessages
+		if v.IsSet("echo.messages") {
+			messages = v.GetStringSlice("echo.messages")
+		}
+		if err := client.ValidateEchoServer(context.Background(), messages); err != nil {
+			os.Exit(1)
+		}
+		return
+	}
+
+	// Values read before watching the config file, since viper must not be
+	// read while the watcher reloads it
+	if command == "" {
+		command = commandForMode(getOneOf(v, "mode"))
+	}
+	grace := v.GetDuration("shutdown.grace")
+	if _, err := os.Stat(v.ConfigFileUsed()); err == nil {
+		WatchConfig(v, client, logger)
+	}
+
+	// The context is cancelled to abort the request in progress once the
+	// shutdown grace period expires
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx, client, command)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			os.Exit(1)
+		}
+	case sig := <-signals:
+		shutdown(client, cancel, done, sig, grace)
+		os.Exit(exitCodeShutdown)
+	}
+}
+
+// serveMetrics Starts an HTTP server that exposes the metrics in the
+// Prometheus text format under /metrics
+func serveMetrics(address string, metrics *common.Metrics) (*http.Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics)
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	return server, nil
+}
+
+// commandBets Runs send-bets followed by winners, what the bets mode does
+const commandBets = "bets"
+
+// commandForMode Returns what to run when no command was given
+func commandForMode(mode string) string {
+	if mode == "bets" {
+		return commandBets
+	}
+	return commandEcho
+}
+
+// run Executes the command until it finishes or the context is cancelled
+func run(ctx context.Context, client *common.Client, command string) error {
+	switch command {
+	case commandBets:
+		if err := client.SendBets(ctx); err != nil {
+			return err
+		}
+		_, err := client.QueryWinners(ctx)
+		return err
+	case commandSendBets:
+		return client.SendBets(ctx)
+	case commandWinners:
+		_, err := client.QueryWinners(ctx)
+		return err
+	default:
+		return client.StartClientLoop(ctx)
+	}
+}
+
+// shutdown Stops the client after a signal was received. The request in
+// progress is given the grace period to finish, after which the context
+// is cancelled to abort it
+func shutdown(client *common.Client, cancel context.CancelFunc, done <-chan error, sig os.Signal, grace time.Duration) {
+	log.Info(common.NewEvent("shutdown", "in_progress", "signal", sig))
+	client.Shutdown()
+
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		log.Warning(common.NewEvent("shutdown", "in_progress",
+			"error", fmt.Sprintf("request still in progress after %v, aborting", grace),
+		))
+		cancel()
+		<-done
+	}
+	client.Close()
+	log.Info(common.NewEvent("shutdown", "success"))
 }
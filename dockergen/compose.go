@@ -0,0 +1,175 @@
+package main
+
+import (
+	"io"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/pkg/errors"
+)
+
+// EnvVar Environment variable of a service
+type EnvVar struct {
+	Key   string
+	Value string
+}
+
+// ComposeConfig Everything needed to render the docker compose file
+type ComposeConfig struct {
+	Name     string
+	Network  string
+	Subnet   string
+	LogLevel string
+
+	ServerImage      string
+	ServerEntrypoint string
+	ServerVolumes    []string
+
+	Clients          int
+	ClientImage      string
+	ClientEntrypoint string
+	ClientVolumes    []string
+	// ClientEnv Variables shared by every client
+	ClientEnv []EnvVar
+	// ClientOverrides Variables of a single client, by client number
+	ClientOverrides map[int][]EnvVar
+}
+
+// service Rendered data of a single service
+type service struct {
+	Name       string
+	Image      string
+	Entrypoint string
+	Env        []EnvVar
+	Volumes    []string
+	DependsOn  []string
+}
+
+var composeTemplate = template.Must(template.New("compose").Funcs(template.FuncMap{
+	"scalar": yamlScalar,
+}).Parse(`name: {{.Name}}
+services:
+{{- range $i, $s := .Services}}
+{{- if $i}}
+{{end}}
+  {{$s.Name}}:
+    container_name: {{$s.Name}}
+    image: {{$s.Image}}
+    entrypoint: {{$s.Entrypoint}}
+    environment:
+{{- range $s.Env}}
+      - {{scalar (printf "%s=%s" .Key .Value)}}
+{{- end}}
+    networks:
+      - {{$.Network}}
+{{- if $s.DependsOn}}
+    depends_on:
+{{- range $s.DependsOn}}
+      - {{.}}
+{{- end}}
+{{- end}}
+{{- if $s.Volumes}}
+    volumes:
+{{- range $s.Volumes}}
+      - {{scalar .}}
+{{- end}}
+{{- end}}
+{{- end}}
+
+networks:
+  {{.Network}}:
+    ipam:
+      driver: default
+      config:
+        - subnet: {{.Subnet}}
+`))
+
+// yamlScalar Quotes the value if YAML would not read it back as the same
+// plain string
+func yamlScalar(value string) string {
+	if value == "" ||
+		strings.Contains(value, ": ") ||
+		strings.Contains(value, " #") ||
+		strings.HasSuffix(value, ":") ||
+		strings.TrimSpace(value) != value ||
+		strings.ContainsAny(value[:1], "!&*-?{}[],#|>@`'\"%") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// setEnv Sets the variable keeping the position of the key if it was
+// already present, so the output does not depend on the override order
+func setEnv(env []EnvVar, variable EnvVar) []EnvVar {
+	for i := range env {
+		if env[i].Key == variable.Key {
+			env[i].Value = variable.Value
+			return env
+		}
+	}
+	return append(env, variable)
+}
+
+// clientEnv Returns the variables of the client with the given number
+func (c ComposeConfig) clientEnv(number int) []EnvVar {
+	env := []EnvVar{
+		{Key: "CLI_ID", Value: strconv.Itoa(number)},
+		{Key: "CLI_LOG_LEVEL", Value: c.LogLevel},
+	}
+	for _, variable := range c.ClientEnv {
+		env = setEnv(env, variable)
+	}
+	for _, variable := range c.ClientOverrides[number] {
+		env = setEnv(env, variable)
+	}
+	return env
+}
+
+// Render Writes the docker compose file with a server and the configured
+// amount of clients. The output only depends on the config
+func Render(w io.Writer, c ComposeConfig) error {
+	if c.Clients < 0 {
+		return errors.Errorf("invalid amount of clients %d", c.Clients)
+	}
+	for number := range c.ClientOverrides {
+		if number < 1 || number > c.Clients {
+			return errors.Errorf("override for client %d, but there are %d clients", number, c.Clients)
+		}
+	}
+
+	services := []service{{
+		Name:       "server",
+		Image:      c.ServerImage,
+		Entrypoint: c.ServerEntrypoint,
+		Env: []EnvVar{
+			{Key: "PYTHONUNBUFFERED", Value: "1"},
+			{Key: "LOGGING_LEVEL", Value: c.LogLevel},
+		},
+		Volumes: c.ServerVolumes,
+	}}
+	for number := 1; number <= c.Clients; number++ {
+		services = append(services, service{
+			Name:       "client" + strconv.Itoa(number),
+			Image:      c.ClientImage,
+			Entrypoint: c.ClientEntrypoint,
+			Env:        c.clientEnv(number),
+			Volumes:    c.ClientVolumes,
+			DependsOn:  []string{"server"},
+		})
+	}
+
+	return composeTemplate.Execute(w, struct {
+		ComposeConfig
+		Services []service
+	}{c, services})
+}
+
+// ParseEnvVar Parses a KEY=VALUE variable
+func ParseEnvVar(raw string) (EnvVar, error) {
+	parts := strings.SplitN(raw, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return EnvVar{}, errors.Errorf("invalid variable %q, expected KEY=VALUE", raw)
+	}
+	return EnvVar{Key: parts[0], Value: parts[1]}, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+// checkGolden Compares the rendered compose file with the golden file,
+// rewriting it instead when the tests run with -update
+func checkGolden(t *testing.T, name string, args []string) {
+	t.Helper()
+	config, _, err := parseArgs(args)
+	if err != nil {
+		t.Fatalf("could not parse %v: %v", args, err)
+	}
+	var rendered bytes.Buffer
+	if err := Render(&rendered, config); err != nil {
+		t.Fatalf("could not render: %v", err)
+	}
+
+	golden := filepath.Join("testdata", name+".golden")
+	if *update {
+		if err := os.WriteFile(golden, rendered.Bytes(), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(expected, rendered.Bytes()) {
+		t.Fatalf("%s does not match, got:\n%s", golden, rendered.String())
+	}
+}
+
+func TestRenderDefault(t *testing.T) {
+	checkGolden(t, "default", []string{"-", "1"})
+}
+
+func TestRenderWithOverrides(t *testing.T) {
+	checkGolden(t, "overrides", []string{
+		"--server-image", "server:v2",
+		"--subnet", "172.25.126.0/24",
+		"--server-volume", "./server/config.ini:/config.ini",
+		"--client-volume", "./client/config.yaml:/config.yaml",
+		"--client-volume", "./.data:/.data",
+		"--env", "CLI_SOCKET_TIMEOUT=15s",
+		"--client-env", "2:CLI_BETTOR_NOMBRE=Juan Carlos",
+		"--client-env", "2:CLI_BETTOR_APELLIDO=Pérez: hijo",
+		"--client-env", "3:CLI_SOCKET_TIMEOUT=30s",
+		"--client-env", "1:CLI_ID=10",
+		"-", "3",
+	})
+}
+
+func TestRenderedDefaultMatchesTheDevComposeFile(t *testing.T) {
+	config, _, err := parseArgs([]string{"-", "1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rendered bytes.Buffer
+	if err := Render(&rendered, config); err != nil {
+		t.Fatal(err)
+	}
+	expected, err := os.ReadFile(filepath.Join("..", "docker-compose-dev.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bytes.TrimSpace(expected), bytes.TrimSpace(rendered.Bytes())) {
+		t.Fatalf("rendered compose file differs from docker-compose-dev.yaml:\n%s", rendered.String())
+	}
+}
+
+func TestRenderRejectsOverridesOfMissingClients(t *testing.T) {
+	config, _, err := parseArgs([]string{"--client-env", "4:CLI_ID=4", "-", "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Render(&bytes.Buffer{}, config); err == nil {
+		t.Fatal("expected an error for an override of client 4")
+	}
+}
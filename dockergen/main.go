@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/spf13/pflag"
+)
+
+const usage = `Usage: dockergen [flags] <output-file> <clients>
+
+Generates a docker compose file with a server and the given amount of
+clients. Use - as output file to write to stdout.
+
+Flags:
+`
+
+// parseClientEnv Parses a N:KEY=VALUE override of the variable of client N
+func parseClientEnv(raw string) (int, EnvVar, error) {
+	parts := strings.SplitN(raw, ":", 2)
+	if len(parts) != 2 {
+		return 0, EnvVar{}, errors.Errorf("invalid override %q, expected N:KEY=VALUE", raw)
+	}
+	number, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, EnvVar{}, errors.Wrapf(err, "invalid client number in %q", raw)
+	}
+	variable, err := ParseEnvVar(parts[1])
+	return number, variable, err
+}
+
+// parseArgs Builds the compose config and the output path from the
+// command line arguments
+func parseArgs(args []string) (ComposeConfig, string, error) {
+	flags := pflag.NewFlagSet("dockergen", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+
+	config := ComposeConfig{ClientOverrides: make(map[int][]EnvVar)}
+	flags.StringVar(&config.Name, "name", "tp0", "name of the compose project")
+	flags.StringVar(&config.Network, "network", "testing_net", "name of the network shared by the services")
+	flags.StringVar(&config.Subnet, "subnet", "172.25.125.0/24", "subnet of the network")
+	flags.StringVar(&config.LogLevel, "log-level", "DEBUG", "log level of every service")
+	flags.StringVar(&config.ServerImage, "server-image", "server:latest", "image of the server")
+	flags.StringVar(&config.ServerEntrypoint, "server-entrypoint", "python3 /main.py", "entrypoint of the server")
+	flags.StringArrayVar(&config.ServerVolumes, "server-volume", nil, "volume mounted in the server, as SRC:DST (repeatable)")
+	flags.StringVar(&config.ClientImage, "client-image", "client:latest", "image of the clients")
+	flags.StringVar(&config.ClientEntrypoint, "client-entrypoint", "/client", "entrypoint of the clients")
+	flags.StringArrayVar(&config.ClientVolumes, "client-volume", nil, "volume mounted in every client, as SRC:DST (repeatable)")
+	env := flags.StringArray("env", nil, "variable of every client, as KEY=VALUE (repeatable)")
+	clientEnv := flags.StringArray("client-env", nil, "variable of a single client, as N:KEY=VALUE, e.g. 2:CLI_BETTOR_NOMBRE=Juan (repeatable)")
+
+	if err := flags.Parse(args); err != nil {
+		return config, "", err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return config, "", errors.New("expected an output file and an amount of clients")
+	}
+
+	clients, err := strconv.Atoi(flags.Arg(1))
+	if err != nil || clients < 0 {
+		return config, "", errors.Errorf("invalid amount of clients %q", flags.Arg(1))
+	}
+	config.Clients = clients
+
+	for _, raw := range *env {
+		variable, err := ParseEnvVar(raw)
+		if err != nil {
+			return config, "", err
+		}
+		config.ClientEnv = append(config.ClientEnv, variable)
+	}
+	for _, raw := range *clientEnv {
+		number, variable, err := parseClientEnv(raw)
+		if err != nil {
+			return config, "", err
+		}
+		config.ClientOverrides[number] = append(config.ClientOverrides[number], variable)
+	}
+	return config, flags.Arg(0), nil
+}
+
+func main() {
+	config, output, err := parseArgs(os.Args[1:])
+	if err == pflag.ErrHelp {
+		return
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "action: generate_compose | result: fail | error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var rendered bytes.Buffer
+	if err := Render(&rendered, config); err != nil {
+		fmt.Fprintf(os.Stderr, "action: generate_compose | result: fail | error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if output == "-" {
+		os.Stdout.Write(rendered.Bytes())
+		return
+	}
+	if err := os.WriteFile(output, rendered.Bytes(), 0644); err != nil {
+		fmt.Fprintf(os.Stderr, "action: generate_compose | result: fail | error: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Fprintf(os.Stderr, "action: generate_compose | result: success | file: %s | clients: %d\n", output, config.Clients)
+}
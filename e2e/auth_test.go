@@ -0,0 +1,110 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/harness"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testcerts"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/lottery"
+)
+
+// writeSecret Writes the secret of an agency as the client expects it
+func writeSecret(t *testing.T, secret string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte(secret+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestAgenciesOverMutualTLSWithAuthentication(t *testing.T) {
+	const agencies = 2
+	authority := testcerts.NewAuthority(t)
+	serverPair := authority.Issue(t, "server", "127.0.0.1")
+	tlsConfig, err := lottery.NewTLSConfig(serverPair.CertFile, serverPair.KeyFile, authority.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataset := make(map[int][]protocol.Bet)
+	secrets := make(map[int][]byte)
+	certificateAgencies := make(map[string]int)
+	for agency := 1; agency <= agencies; agency++ {
+		for i := 0; i < 5; i++ {
+			dataset[agency] = append(dataset[agency], testBet(agency*1000+i, 7574))
+		}
+		secrets[agency] = []byte(fmt.Sprintf("secret-%d", agency))
+		certificateAgencies[fmt.Sprintf("agencia-%d", agency)] = agency
+	}
+	datasetDir := harness.WriteDataset(t, dataset)
+	server := harness.StartConfiguredLotteryServer(t, lottery.ServerConfig{
+		Agencies:            agencies,
+		TLS:                 tlsConfig,
+		CertificateAgencies: certificateAgencies,
+		Secrets:             secrets,
+	})
+
+	var clients []*common.Client
+	for id := 1; id <= agencies; id++ {
+		pair := authority.Issue(t, fmt.Sprintf("agencia-%d", id))
+		clientTLS, err := common.NewTLSConfig(common.TLSOptions{
+			CAFile:   authority.CertFile,
+			CertFile: pair.CertFile,
+			KeyFile:  pair.KeyFile,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := harness.ClientConfig(id, server.Address())
+		config.BatchDataset = datasetDir
+		config.TLS = clientTLS
+		config.SecretFile = writeSecret(t, string(secrets[id]))
+		clients = append(clients, common.NewClient(config))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	harness.RequireNoErrors(t, harness.RunClients(ctx, clients, func(ctx context.Context, client *common.Client) error {
+		if err := client.SendBets(ctx); err != nil {
+			return err
+		}
+		_, err := client.QueryWinners(ctx)
+		return err
+	}))
+
+	if stored := len(server.Bets(t)); stored != agencies*5 {
+		t.Fatalf("expected %d bets to be stored, got %d", agencies*5, stored)
+	}
+}
+
+func TestAgencyWithAWrongSecretIsRefused(t *testing.T) {
+	datasetDir := harness.WriteDataset(t, map[int][]protocol.Bet{1: {testBet(1000, 7574)}})
+	server := harness.StartConfiguredLotteryServer(t, lottery.ServerConfig{
+		Agencies: 1,
+		Secrets:  map[int][]byte{1: []byte("secret-1")},
+	})
+
+	config := harness.ClientConfig(1, server.Address())
+	config.BatchDataset = datasetDir
+	config.SecretFile = writeSecret(t, "secret-2")
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	err := common.NewClient(config).SendBets(ctx)
+	var refused *protocol.Error
+	if !errors.As(err, &refused) || refused.Code != protocol.CodeAuthenticationFailed {
+		t.Fatalf("expected the agency to be refused, got %v", err)
+	}
+	if stored := len(server.Bets(t)); stored != 0 {
+		t.Fatalf("expected no bets to be stored, got %d", stored)
+	}
+}
@@ -0,0 +1,172 @@
+package e2e
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/harness"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+const testTimeout = 30 * time.Second
+
+func TestEchoClients(t *testing.T) {
+	logs := harness.RecordLogs(t)
+	server := harness.StartEchoServer(t)
+
+	const clientsAmount = 3
+	var clients []*common.Client
+	for id := 1; id <= clientsAmount; id++ {
+		clients = append(clients, common.NewClient(harness.ClientConfig(id, server.Addr())))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	harness.RequireNoErrors(t, harness.RunClients(ctx, clients, func(ctx context.Context, client *common.Client) error {
+		return client.StartClientLoop(ctx)
+	}))
+
+	loopAmount := harness.ClientConfig(0, "").LoopAmount
+	if got, want := len(server.Messages()), clientsAmount*loopAmount; got != want {
+		t.Errorf("expected the server to receive %d messages, got %d", want, got)
+	}
+	if got, want := server.Connections(), clientsAmount*loopAmount; got != want {
+		t.Errorf("expected a connection per message, got %d connections", got)
+	}
+
+	for id := 1; id <= clientsAmount; id++ {
+		var received []string
+		for _, entry := range logs.Find("receive_message", "success") {
+			if entry.Field("client_id") == strconv.Itoa(id) {
+				received = append(received, entry.Field("msg"))
+			}
+		}
+		if len(received) != loopAmount {
+			t.Fatalf("expected client %d to log %d messages, got %v", id, loopAmount, received)
+		}
+		for i, msg := range received {
+			if want := fmt.Sprintf("[CLIENT %d] Message N°%d", id, i+1); msg != want {
+				t.Errorf("expected client %d to receive %q, got %q", id, want, msg)
+			}
+		}
+	}
+	if got := logs.Count("loop_finished", "success"); got != clientsAmount {
+		t.Errorf("expected %d finished loops, got %d", clientsAmount, got)
+	}
+}
+
+func TestEchoClientsWithPersistentConnections(t *testing.T) {
+	harness.RecordLogs(t)
+	server := harness.StartEchoServer(t)
+
+	const clientsAmount = 2
+	var clients []*common.Client
+	for id := 1; id <= clientsAmount; id++ {
+		config := harness.ClientConfig(id, server.Addr())
+		config.LoopConnection = common.ConnectionPersistent
+		clients = append(clients, common.NewClient(config))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	harness.RequireNoErrors(t, harness.RunClients(ctx, clients, func(ctx context.Context, client *common.Client) error {
+		return client.StartClientLoop(ctx)
+	}))
+
+	if got := server.Connections(); got != clientsAmount {
+		t.Errorf("expected a connection per client, got %d connections", got)
+	}
+}
+
+func testBet(document int, number int) protocol.Bet {
+	return protocol.Bet{
+		FirstName: "Santiago Lionel",
+		LastName:  "Lorca",
+		Document:  strconv.Itoa(document),
+		Birthdate: "1999-03-17",
+		Number:    strconv.Itoa(number),
+	}
+}
+
+func TestLotteryAgencies(t *testing.T) {
+	logs := harness.RecordLogs(t)
+
+	// Every agency has a few bets and the even documents hold the winning number
+	const agencies = 3
+	dataset := make(map[int][]protocol.Bet)
+	expectedWinners := make(map[int][]string)
+	for agency := 1; agency <= agencies; agency++ {
+		for i := 0; i < 25; i++ {
+			document := agency*1000 + i
+			number := i
+			if document%2 == 0 {
+				number = 7574
+				expectedWinners[agency] = append(expectedWinners[agency], strconv.Itoa(document))
+			}
+			dataset[agency] = append(dataset[agency], testBet(document, number))
+		}
+	}
+	datasetDir := harness.WriteDataset(t, dataset)
+	server := harness.StartLotteryServer(t, agencies)
+
+	var clients []*common.Client
+	agencyOf := make(map[*common.Client]int)
+	for id := 1; id <= agencies; id++ {
+		config := harness.ClientConfig(id, server.Address())
+		config.BatchDataset = datasetDir
+		client := common.NewClient(config)
+		clients = append(clients, client)
+		agencyOf[client] = id
+	}
+
+	winners := make([][]string, agencies)
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	harness.RequireNoErrors(t, harness.RunClients(ctx, clients, func(ctx context.Context, client *common.Client) error {
+		if err := client.SendBets(ctx); err != nil {
+			return err
+		}
+		documents, err := client.QueryWinners(ctx)
+		winners[agencyOf[client]-1] = documents
+		return err
+	}))
+
+	stored := make(map[int]int)
+	for _, bet := range server.Bets(t) {
+		stored[bet.Agency]++
+	}
+	for agency := 1; agency <= agencies; agency++ {
+		if stored[agency] != len(dataset[agency]) {
+			t.Errorf("expected %d bets of agency %d to be stored, got %d", len(dataset[agency]), agency, stored[agency])
+		}
+
+		serverWinners := server.Winners(t, agency)
+		clientWinners := winners[agency-1]
+		sort.Strings(serverWinners)
+		sort.Strings(clientWinners)
+		if fmt.Sprint(serverWinners) != fmt.Sprint(expectedWinners[agency]) {
+			t.Errorf("expected the server to draw %v for agency %d, got %v", expectedWinners[agency], agency, serverWinners)
+		}
+		if fmt.Sprint(clientWinners) != fmt.Sprint(expectedWinners[agency]) {
+			t.Errorf("expected agency %d to receive %v, got %v", agency, expectedWinners[agency], clientWinners)
+		}
+	}
+
+	queries := logs.Find("consulta_ganadores", "success")
+	if len(queries) != agencies {
+		t.Fatalf("expected %d successful winner queries, got %d", agencies, len(queries))
+	}
+	for _, entry := range queries {
+		if entry.Field("cant_ganadores") == "" {
+			t.Errorf("expected the amount of winners to be logged, got %q", entry.Message)
+		}
+	}
+	if got := logs.Count("sorteo", "success"); got != 1 {
+		t.Errorf("expected a single draw, got %d", got)
+	}
+}
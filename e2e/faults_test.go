@@ -0,0 +1,322 @@
+package e2e
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/harness"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/proxy/faults"
+)
+
+func TestEchoClientHandlesShortReadsAndWrites(t *testing.T) {
+	logs := harness.RecordLogs(t)
+	server := harness.StartEchoServer(t)
+	proxy := harness.StartFaultProxy(t, server.Addr(), faults.Fault{ChunkSize: 1, Latency: time.Millisecond})
+
+	client := common.NewClient(harness.ClientConfig(1, proxy.Addr().String()))
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := client.StartClientLoop(ctx); err != nil {
+		t.Fatalf("the loop failed: %v", err)
+	}
+
+	loopAmount := harness.ClientConfig(0, "").LoopAmount
+	if got := logs.Count("receive_message", "success"); got != loopAmount {
+		t.Errorf("expected %d messages to be received, got %d", loopAmount, got)
+	}
+}
+
+func TestLotteryAgencyHandlesShortReadsAndWrites(t *testing.T) {
+	harness.RecordLogs(t)
+
+	var bets []protocol.Bet
+	for i := 0; i < 30; i++ {
+		bets = append(bets, testBet(i, 7574))
+	}
+	dataset := harness.WriteDataset(t, map[int][]protocol.Bet{1: bets})
+	server := harness.StartLotteryServer(t, 1)
+	proxy := harness.StartFaultProxy(t, server.Address(), faults.Fault{ChunkSize: 1})
+
+	config := harness.ClientConfig(1, proxy.Addr().String())
+	config.BatchDataset = dataset
+	client := common.NewClient(config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := client.SendBets(ctx); err != nil {
+		t.Fatalf("could not send bets: %v", err)
+	}
+	winners, err := client.QueryWinners(ctx)
+	if err != nil {
+		t.Fatalf("could not query winners: %v", err)
+	}
+	if len(winners) != len(bets) || len(server.Bets(t)) != len(bets) {
+		t.Errorf("expected %d bets and winners, got %d bets and %d winners", len(bets), len(server.Bets(t)), len(winners))
+	}
+}
+
+func TestLotteryAgencyRetriesBatchesWithoutDuplicatingBets(t *testing.T) {
+	logs := harness.RecordLogs(t)
+
+	var bets []protocol.Bet
+	for i := 0; i < 30; i++ {
+		bets = append(bets, testBet(i, 7574))
+	}
+	dataset := harness.WriteDataset(t, map[int][]protocol.Bet{1: bets})
+	server := harness.StartLotteryServer(t, 1)
+	// The first batch is stored but its acknowledge never arrives
+	proxy := harness.StartFaultProxy(t, server.Address(), faults.Fault{
+		Direction:   faults.Downstream,
+		Connections: []int{1},
+		DropAfter:   faults.Bytes(1),
+	})
+
+	config := harness.ClientConfig(1, proxy.Addr().String())
+	config.BatchDataset = dataset
+	config.Reconnect.Attempts = 3
+	client := common.NewClient(config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := client.SendBets(ctx); err != nil {
+		t.Fatalf("could not send bets: %v", err)
+	}
+	if got := logs.Count("retry_request", "in_progress"); got != 1 {
+		t.Errorf("expected a single retry, got %d", got)
+	}
+	if got := logs.Count("apuesta_recibida", "duplicate"); got != 1 {
+		t.Errorf("expected the retried batch to be recognized, got %d duplicates", got)
+	}
+	if got := len(server.Bets(t)); got != len(bets) {
+		t.Errorf("expected %d bets to be stored once, got %d", len(bets), got)
+	}
+}
+
+func TestLotteryAgencyResumesFromItsCheckpoint(t *testing.T) {
+	logs := harness.RecordLogs(t)
+
+	var bets []protocol.Bet
+	for i := 0; i < 30; i++ {
+		bets = append(bets, testBet(i, 7574))
+	}
+	dataset := harness.WriteDataset(t, map[int][]protocol.Bet{1: bets})
+	server := harness.StartLotteryServer(t, 1)
+	// Only the acknowledge of the first batch arrives, so the first run
+	// fails right after storing the second one
+	proxy := harness.StartFaultProxy(t, server.Address(), faults.Fault{
+		Direction:   faults.Downstream,
+		Connections: []int{1},
+		DropAfter:   faults.Bytes(protocol.ResponseHeaderSize + 4),
+	})
+
+	config := harness.ClientConfig(1, proxy.Addr().String())
+	config.BatchDataset = dataset
+	config.CheckpointDir = t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := common.NewClient(config).SendBets(ctx); err == nil {
+		t.Fatal("expected the first run to fail")
+	}
+
+	config.ServerAddress = server.Address()
+	client := common.NewClient(config)
+	if err := client.SendBets(ctx); err != nil {
+		t.Fatalf("could not resume sending bets: %v", err)
+	}
+	resumed := logs.Find("resume_checkpoint", "success")
+	if len(resumed) != 1 || resumed[0].Field("offset") == "0" || resumed[0].Field("sequence") != "1" {
+		t.Errorf("expected to resume after the first batch, got %+v", resumed)
+	}
+	if got := len(server.Bets(t)); got != len(bets) {
+		t.Errorf("expected %d bets to be stored once, got %d", len(bets), got)
+	}
+
+	if err := client.ResetCheckpoint(); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.SendBets(ctx); err != nil {
+		t.Fatalf("could not send the bets again: %v", err)
+	}
+	if got := len(logs.Find("resume_checkpoint", "success")); got != 1 {
+		t.Errorf("expected the reset upload to start over, got %d resumes", got)
+	}
+	// The new upload is not mistaken for retransmissions of the first one
+	if got := len(server.Bets(t)); got != 2*len(bets) {
+		t.Errorf("expected the %d bets to be stored again, got %d bets", len(bets), got)
+	}
+}
+
+func TestLotteryAgencyUploadsEveryBetOnEachSuccessfulRun(t *testing.T) {
+	logs := harness.RecordLogs(t)
+
+	var bets []protocol.Bet
+	for i := 0; i < 30; i++ {
+		bets = append(bets, testBet(i, 7574))
+	}
+	dataset := harness.WriteDataset(t, map[int][]protocol.Bet{1: bets})
+	server := harness.StartLotteryServer(t, 1)
+
+	config := harness.ClientConfig(1, server.Address())
+	config.BatchDataset = dataset
+	config.CheckpointDir = t.TempDir()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	for run := 1; run <= 2; run++ {
+		if err := common.NewClient(config).SendBets(ctx); err != nil {
+			t.Fatalf("run %d: could not send bets: %v", run, err)
+		}
+		if got := len(server.Bets(t)); got != run*len(bets) {
+			t.Fatalf("run %d: expected every bet to be uploaded, got %d bets stored", run, got)
+		}
+	}
+	if got := logs.Count("resume_checkpoint", "success"); got != 0 {
+		t.Errorf("expected the finished upload not to be resumed, got %d resumes", got)
+	}
+}
+
+func TestLotteryAgencySpoolsBatchesWhileTheServerIsUnreachable(t *testing.T) {
+	logs := harness.RecordLogs(t)
+
+	var bets []protocol.Bet
+	for i := 0; i < 30; i++ {
+		bets = append(bets, testBet(i, 7574))
+	}
+	dataset := harness.WriteDataset(t, map[int][]protocol.Bet{1: bets})
+	server := harness.StartLotteryServer(t, 1)
+	// Only the acknowledge of the first batch arrives, and the client gives
+	// up on the connection at once, so the remaining batches are spooled
+	proxy := harness.StartFaultProxy(t, server.Address(), faults.Fault{
+		Direction:   faults.Downstream,
+		Connections: []int{1},
+		DropAfter:   faults.Bytes(protocol.ResponseHeaderSize + 4),
+	})
+
+	config := harness.ClientConfig(1, proxy.Addr().String())
+	config.BatchDataset = dataset
+	config.Reconnect.Attempts = 1
+	config.SpoolDir = t.TempDir()
+	config.SpoolRetry = 10 * time.Millisecond
+	client := common.NewClient(config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := client.SendBets(ctx); err != nil {
+		t.Fatalf("could not send bets: %v", err)
+	}
+	spooled := logs.Count("spool_bets", "success")
+	if spooled == 0 {
+		t.Fatal("expected batches to be spooled")
+	}
+	if got := logs.Count("spool_drain", "success"); got != spooled {
+		t.Errorf("expected the %d spooled batches to be drained, got %d", spooled, got)
+	}
+	if got := len(server.Bets(t)); got != len(bets) {
+		t.Errorf("expected %d bets to be stored once, got %d", len(bets), got)
+	}
+}
+
+func TestLotteryAgencyDoesNotRetryBetsTheServerRefuses(t *testing.T) {
+	logs := harness.RecordLogs(t)
+
+	invalid := testBet(1, 7574)
+	invalid.Number = "seven"
+	dataset := harness.WriteDataset(t, map[int][]protocol.Bet{1: {testBet(0, 7574), invalid}})
+	server := harness.StartLotteryServer(t, 1)
+
+	config := harness.ClientConfig(1, server.Address())
+	config.BatchDataset = dataset
+	config.Reconnect.Attempts = 3
+	config.SpoolDir = t.TempDir()
+	config.SpoolRetry = 10 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	err := common.NewClient(config).SendBets(ctx)
+	var refused *protocol.Error
+	if !errors.As(err, &refused) || refused.Code != protocol.CodeInvalidBet {
+		t.Fatalf("expected the bets to be refused, got %v", err)
+	}
+	if got := logs.Count("retry_request", "in_progress") + logs.Count("spool_bets", "success"); got != 0 {
+		t.Errorf("expected the refused batch not to be sent again, got %d retries", got)
+	}
+
+	// A refused batch left in the spool stops the drainer too
+	spool, err := common.OpenSpool(filepath.Join(config.SpoolDir, "agency-1.spool"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := spool.Append(&protocol.BetBatch{Upload: 1, Sequence: 1, Bets: []protocol.Bet{invalid}}); err != nil {
+		t.Fatal(err)
+	}
+	spool.Close()
+	err = common.NewClient(config).SendBets(ctx)
+	if !errors.As(err, &refused) || refused.Code != protocol.CodeInvalidBet {
+		t.Fatalf("expected the spooled bets to be refused, got %v", err)
+	}
+	if got := logs.Count("spool_drain", "in_progress"); got != 0 {
+		t.Errorf("expected the refused batch not to be drained again, got %d retries", got)
+	}
+	if got := len(server.Bets(t)); got != 0 {
+		t.Errorf("expected no bet to be stored, got %d", got)
+	}
+}
+
+func TestPersistentClientReconnectsAfterDrop(t *testing.T) {
+	logs := harness.RecordLogs(t)
+	server := harness.StartEchoServer(t)
+	// The first connection is dropped after the first answer
+	proxy := harness.StartFaultProxy(t, server.Addr(), faults.Fault{
+		Direction:   faults.Downstream,
+		Connections: []int{1},
+		DropAfter:   faults.Bytes(int64(len("[CLIENT 1] Message N°1\n"))),
+	})
+
+	config := harness.ClientConfig(1, proxy.Addr().String())
+	config.LoopConnection = common.ConnectionPersistent
+	client := common.NewClient(config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := client.StartClientLoop(ctx); err != nil {
+		t.Fatalf("the loop failed: %v", err)
+	}
+	if got := logs.Count("reconnect", "in_progress"); got != 1 {
+		t.Errorf("expected a single reconnection, got %d", got)
+	}
+	if got := server.Connections(); got != 2 {
+		t.Errorf("expected 2 connections, got %d", got)
+	}
+}
+
+func TestClientTimesOutOnStalledConnection(t *testing.T) {
+	logs := harness.RecordLogs(t)
+	server := harness.StartEchoServer(t)
+	proxy := harness.StartFaultProxy(t, server.Addr(), faults.Fault{
+		Direction: faults.Downstream,
+		DropAfter: faults.Bytes(1),
+		DropMode:  faults.DropStall,
+	})
+
+	config := harness.ClientConfig(1, proxy.Addr().String())
+	config.SocketTimeout = 200 * time.Millisecond
+	client := common.NewClient(config)
+
+	ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+	defer cancel()
+	if err := client.StartClientLoop(ctx); err == nil {
+		t.Fatal("expected the loop to fail once the connection stalled")
+	}
+	failures := logs.Find("receive_message", "fail")
+	if len(failures) != 1 || failures[0].Field("client_id") != strconv.Itoa(1) {
+		t.Errorf("expected a single failure of client 1 to be logged, got %v", failures)
+	}
+}
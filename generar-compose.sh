@@ -0,0 +1,21 @@
+#!/bin/bash
+# Generates a docker compose file with a server and N clients.
+# Usage: ./generar-compose.sh <output-file> <clients> [dockergen flags]
+set -e
+
+if [ "$#" -lt 2 ]; then
+    echo "Usage: $0 <output-file> <clients> [dockergen flags]"
+    exit 1
+fi
+
+OUTPUT=$1
+CLIENTS=$2
+shift 2
+
+# Resolve the output path before moving to the repository root
+if [ "$OUTPUT" != "-" ]; then
+    OUTPUT="$(cd "$(dirname "$OUTPUT")" && pwd)/$(basename "$OUTPUT")"
+fi
+
+cd "$(dirname "$0")"
+go run ./dockergen "$@" "$OUTPUT" "$CLIENTS"
@@ -0,0 +1,47 @@
+package harness
+
+import (
+	"encoding/csv"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// WriteDataset Writes the bets of every agency to a temporary directory
+// laid out like the extracted dataset, with one agency-N.csv file per
+// agency. The returned directory can be used as BatchDataset
+func WriteDataset(t testing.TB, agencies map[int][]protocol.Bet) string {
+	t.Helper()
+	dir := t.TempDir()
+	for agency, bets := range agencies {
+		path := filepath.Join(dir, fmt.Sprintf("agency-%d.csv", agency))
+		if err := writeBets(path, bets); err != nil {
+			t.Fatalf("could not write the bets of agency %d: %v", agency, err)
+		}
+	}
+	return dir
+}
+
+func writeBets(path string, bets []protocol.Bet) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	for _, bet := range bets {
+		record := []string{bet.FirstName, bet.LastName, bet.Document, bet.Birthdate, bet.Number}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,70 @@
+// Package harness runs the servers and the clients of the system inside
+// the test process, so the whole flow can be exercised by go test without
+// starting any container.
+//
+// Servers are bound to a random loopback port and stopped when the test
+// finishes. Clients are configured with short periods and timeouts, and
+// the log lines they emit can be recorded to assert on their fields.
+package harness
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// ClientConfig Returns the configuration of a client that talks to the
+// server at address, with periods and timeouts short enough for tests
+func ClientConfig(id int, address string) common.ClientConfig {
+	return common.ClientConfig{
+		ID:             fmt.Sprint(id),
+		ServerAddress:  address,
+		LoopAmount:     3,
+		LoopPeriod:     10 * time.Millisecond,
+		SocketTimeout:  5 * time.Second,
+		LoopConnection: common.ConnectionPerMessage,
+		BatchMaxAmount: 10,
+		WinnersBackoff: common.BackoffConfig{
+			Initial:    10 * time.Millisecond,
+			Max:        100 * time.Millisecond,
+			Multiplier: 2,
+			MaxWait:    10 * time.Second,
+		},
+		ConnectTimeout: time.Second,
+		Reconnect:      common.ReconnectConfig{Attempts: 1},
+	}
+}
+
+// RunClients Runs fn with every client concurrently and waits for all
+// of them to finish. The errors are returned in the order of the clients
+func RunClients(ctx context.Context, clients []*common.Client, fn func(context.Context, *common.Client) error) []error {
+	errs := make([]error, len(clients))
+	var wg sync.WaitGroup
+	for i, client := range clients {
+		wg.Add(1)
+		go func(i int, client *common.Client) {
+			defer wg.Done()
+			errs[i] = fn(ctx, client)
+		}(i, client)
+	}
+	wg.Wait()
+	return errs
+}
+
+// RequireNoErrors Fails the test if any of the errors returned by
+// RunClients is not nil
+func RequireNoErrors(t testing.TB, errs []error) {
+	t.Helper()
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("client %d failed: %v", i+1, err)
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,111 @@
+package harness
+
+import (
+	"fmt"
+	stdlog "log"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/op/go-logging"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+// LogEntry Log line emitted through go-logging. The fields of client
+// events are kept as is, while other lines with the "key: value | key:
+// value" layout used across the repo are split into their fields
+type LogEntry struct {
+	Level   logging.Level
+	Message string
+	Fields  map[string]string
+}
+
+// Field Returns the value of the field, or an empty string if the line
+// does not have it
+func (e LogEntry) Field(key string) string {
+	return e.Fields[key]
+}
+
+// LogRecorder go-logging backend that keeps every log line in memory
+type LogRecorder struct {
+	mu      sync.Mutex
+	entries []LogEntry
+}
+
+// RecordLogs Replaces the go-logging backend with a recorder. The
+// backend is process wide, so tests using it must not run in parallel.
+// Once the test finishes the default stderr backend is restored
+func RecordLogs(t testing.TB) *LogRecorder {
+	recorder := &LogRecorder{}
+	leveled := logging.AddModuleLevel(recorder)
+	leveled.SetLevel(logging.DEBUG, "")
+	logging.SetBackend(leveled)
+	t.Cleanup(func() {
+		logging.SetBackend(logging.NewLogBackend(os.Stderr, "", stdlog.LstdFlags))
+	})
+	return recorder
+}
+
+// Log Implements logging.Backend
+func (r *LogRecorder) Log(level logging.Level, _ int, record *logging.Record) error {
+	message := record.Message()
+	entry := LogEntry{Level: level, Message: message}
+	entry.Fields = parseFields(message)
+	if len(record.Args) == 1 {
+		if event, ok := record.Args[0].(common.Event); ok {
+			entry.Fields = eventFields(event)
+		}
+	}
+	r.mu.Lock()
+	r.entries = append(r.entries, entry)
+	r.mu.Unlock()
+	return nil
+}
+
+// Entries Returns all the lines recorded so far
+func (r *LogRecorder) Entries() []LogEntry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]LogEntry(nil), r.entries...)
+}
+
+// Find Returns the lines with the given action and result
+func (r *LogRecorder) Find(action string, result string) []LogEntry {
+	var found []LogEntry
+	for _, entry := range r.Entries() {
+		if entry.Field("action") == action && entry.Field("result") == result {
+			found = append(found, entry)
+		}
+	}
+	return found
+}
+
+// Count Returns the amount of lines with the given action and result
+func (r *LogRecorder) Count(action string, result string) int {
+	return len(r.Find(action, result))
+}
+
+// eventFields Returns the fields of the event, formatted as in its text form
+func eventFields(event common.Event) map[string]string {
+	fields := map[string]string{"action": event.Action, "result": event.Result}
+	for _, field := range event.Fields {
+		fields[field.Key] = strings.TrimSpace(fmt.Sprint(field.Value))
+	}
+	return fields
+}
+
+// parseFields Splits a "key: value | key: value" line into its fields.
+// Parts that do not follow the layout are ignored
+func parseFields(message string) map[string]string {
+	fields := make(map[string]string)
+	for _, part := range strings.Split(message, " | ") {
+		keyValue := strings.SplitN(part, ": ", 2)
+		if len(keyValue) != 2 {
+			continue
+		}
+		fields[strings.TrimSpace(keyValue[0])] = strings.TrimSpace(keyValue[1])
+	}
+	return fields
+}
@@ -0,0 +1,208 @@
+package harness
+
+import (
+	"bufio"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/proxy/faults"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/lottery"
+)
+
+// loopback Address the servers of the harness are bound to
+const loopback = "127.0.0.1"
+
+// EchoServer Answers every newline terminated message with the message
+// itself, like the python server does, and records what it received
+type EchoServer struct {
+	listener net.Listener
+
+	mu          sync.Mutex
+	messages    []string
+	connections int
+	conns       map[net.Conn]struct{}
+	handlers    sync.WaitGroup
+}
+
+// StartEchoServer Starts an echo server on a loopback port. It is closed
+// once the test finishes
+func StartEchoServer(t testing.TB) *EchoServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", net.JoinHostPort(loopback, "0"))
+	if err != nil {
+		t.Fatalf("could not start echo server: %v", err)
+	}
+	s := &EchoServer{listener: listener, conns: make(map[net.Conn]struct{})}
+	go s.run()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Addr Returns the address clients must connect to
+func (s *EchoServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Messages Returns the messages received so far, without the newline
+func (s *EchoServer) Messages() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.messages...)
+}
+
+// Connections Returns the amount of connections accepted so far
+func (s *EchoServer) Connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connections
+}
+
+// Close Stops accepting connections, closes the ones in progress and
+// waits for their handlers to finish
+func (s *EchoServer) Close() {
+	s.listener.Close()
+	s.mu.Lock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.handlers.Wait()
+}
+
+func (s *EchoServer) run() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.connections++
+		s.conns[conn] = struct{}{}
+		s.handlers.Add(1)
+		s.mu.Unlock()
+		go s.handle(conn)
+	}
+}
+
+func (s *EchoServer) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.handlers.Done()
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		msg, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.messages = append(s.messages, msg[:len(msg)-1])
+		s.mu.Unlock()
+		if _, err := conn.Write([]byte(msg)); err != nil {
+			return
+		}
+	}
+}
+
+// LotteryServer Lottery server storing its bets in a temporary file
+type LotteryServer struct {
+	*lottery.Server
+	StoragePath string
+
+	done chan error
+}
+
+// StartLotteryServer Starts a lottery server on a loopback port that
+// makes the draw once the given amount of agencies finished. It is shut
+// down once the test finishes
+func StartLotteryServer(t testing.TB, agencies int) *LotteryServer {
+	t.Helper()
+	return StartConfiguredLotteryServer(t, lottery.ServerConfig{Agencies: agencies})
+}
+
+// StartConfiguredLotteryServer Starts a lottery server with the given
+// configuration, e.g. to require TLS or authentication. The address,
+// backlog and storage are overridden as in StartLotteryServer
+func StartConfiguredLotteryServer(t testing.TB, config lottery.ServerConfig) *LotteryServer {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	config.Host = loopback
+	config.ListenBacklog = config.Agencies
+	config.StoragePath = path
+	server, err := lottery.NewServer(config)
+	if err != nil {
+		t.Fatalf("could not start lottery server: %v", err)
+	}
+
+	s := &LotteryServer{Server: server, StoragePath: path, done: make(chan error, 1)}
+	go func() { s.done <- server.Run() }()
+	t.Cleanup(func() {
+		server.Shutdown()
+		if err := <-s.done; err != nil {
+			t.Errorf("lottery server failed: %v", err)
+		}
+	})
+	return s
+}
+
+// Address Returns the address clients must connect to
+func (s *LotteryServer) Address() string {
+	return s.Addr().String()
+}
+
+// Bets Returns all the bets stored by the server
+func (s *LotteryServer) Bets(t testing.TB) []lottery.Bet {
+	t.Helper()
+	var bets []lottery.Bet
+	if err := lottery.LoadBets(s.StoragePath, func(bet lottery.Bet) {
+		bets = append(bets, bet)
+	}); err != nil {
+		t.Fatalf("could not load stored bets: %v", err)
+	}
+	return bets
+}
+
+// Winners Returns the documents of the winners of the agency. The test
+// fails if the draw was not made yet
+func (s *LotteryServer) Winners(t testing.TB, agency int) []string {
+	t.Helper()
+	documents, drawn, err := s.Storage().Winners(agency)
+	if err != nil {
+		t.Fatalf("could not query winners: %v", err)
+	}
+	if !drawn {
+		t.Fatal("the draw was not made")
+	}
+	return documents
+}
+
+// StartFaultProxy Starts a proxy on a loopback port that forwards the
+// traffic to upstream injecting the given faults. It is shut down once
+// the test finishes
+func StartFaultProxy(t testing.TB, upstream string, injected ...faults.Fault) *faults.Proxy {
+	t.Helper()
+	proxy, err := faults.NewProxy(faults.Plan{
+		Listen:   net.JoinHostPort(loopback, "0"),
+		Upstream: upstream,
+		Faults:   injected,
+	})
+	if err != nil {
+		t.Fatalf("could not start fault proxy: %v", err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- proxy.Run() }()
+	t.Cleanup(func() {
+		proxy.Shutdown()
+		if err := <-done; err != nil {
+			t.Errorf("fault proxy failed: %v", err)
+		}
+	})
+	return proxy
+}
@@ -0,0 +1,127 @@
+// Package testcerts generates the certificates used by the TLS tests. A
+// throwaway certificate authority is created per test and the certificates
+// it issues are written as PEM files to a temporary directory, so they can
+// be loaded the same way the configured ones are.
+package testcerts
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var serial int64
+
+// Authority Self-signed certificate authority that issues the server
+// and agency certificates of a test
+type Authority struct {
+	// CertFile PEM file with the certificate of the authority, used as
+	// CA bundle
+	CertFile string
+
+	dir  string
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// Pair Certificate and key issued by an Authority
+type Pair struct {
+	CertFile string
+	KeyFile  string
+}
+
+// NewAuthority Creates a certificate authority valid for the test
+func NewAuthority(t testing.TB) *Authority {
+	t.Helper()
+	key := newKey(t)
+	template := &x509.Certificate{
+		SerialNumber:          nextSerial(),
+		Subject:               pkix.Name{CommonName: "test authority"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("could not create the authority: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	authority := &Authority{dir: t.TempDir(), cert: cert, key: key}
+	authority.CertFile = authority.write(t, "ca.pem", "CERTIFICATE", der)
+	return authority
+}
+
+// Issue Creates a certificate with the given common name, valid both
+// for servers and clients. Hosts are added as IP or DNS names so the
+// certificate can be served on them
+func (a *Authority) Issue(t testing.TB, commonName string, hosts ...string) Pair {
+	t.Helper()
+	key := newKey(t)
+	template := &x509.Certificate{
+		SerialNumber: nextSerial(),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, a.cert, &key.PublicKey, a.key)
+	if err != nil {
+		t.Fatalf("could not issue %s: %v", commonName, err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := template.SerialNumber.String()
+	return Pair{
+		CertFile: a.write(t, name+".pem", "CERTIFICATE", der),
+		KeyFile:  a.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER),
+	}
+}
+
+func (a *Authority) write(t testing.TB, name string, kind string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(a.dir, name)
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func newKey(t testing.TB) *ecdsa.PrivateKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("could not generate a key: %v", err)
+	}
+	return key
+}
+
+func nextSerial() *big.Int {
+	return big.NewInt(atomic.AddInt64(&serial, 1))
+}
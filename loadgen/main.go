@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+var log = logging.MustGetLogger("log")
+
+// InitConfig Function that uses viper library to parse configuration parameters.
+// Viper is configured to read variables from both environment variables and the
+// config file ./loadgen.yaml. Environment variables takes precedence over parameters
+// defined in the configuration file. If some of the variables cannot be parsed,
+// an error is returned
+func InitConfig() (*viper.Viper, error) {
+	v := viper.New()
+
+	// Configure viper to read env variables with the LOADGEN_ prefix
+	v.AutomaticEnv()
+	v.SetEnvPrefix("loadgen")
+	v.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	v.SetDefault("log.level", "WARNING")
+	v.SetDefault("report.interval", "0s")
+	v.SetDefault("socket.timeout", "15s")
+	v.SetDefault("reconnect.attempts", 5)
+	v.SetDefault("reconnect.initialDelay", "200ms")
+	v.SetDefault("reconnect.maxDelay", "5s")
+
+	v.SetConfigFile("./loadgen.yaml")
+	if err := v.ReadInConfig(); err != nil {
+		return nil, errors.Wrapf(err, "Could not read the load generation config file.")
+	}
+
+	for _, key := range []string{"report.interval", "socket.timeout", "reconnect.initialDelay", "reconnect.maxDelay"} {
+		if _, err := time.ParseDuration(v.GetString(key)); err != nil {
+			return nil, errors.Wrapf(err, "Could not parse %s as time.Duration.", key)
+		}
+	}
+	return v, nil
+}
+
+// LoadConfigFrom Builds the load generation config from viper
+func LoadConfigFrom(v *viper.Viper) (LoadConfig, error) {
+	config := LoadConfig{
+		ServerAddress: v.GetString("server.address"),
+		SocketTimeout: v.GetDuration("socket.timeout"),
+	}
+	config.Reconnect.Attempts = v.GetInt("reconnect.attempts")
+	config.Reconnect.Backoff.Initial = v.GetDuration("reconnect.initialDelay")
+	config.Reconnect.Backoff.Max = v.GetDuration("reconnect.maxDelay")
+	config.Reconnect.Backoff.Multiplier = 2
+	config.Reconnect.Backoff.Jitter = 0.2
+
+	if err := v.UnmarshalKey("groups", &config.Groups); err != nil {
+		return config, errors.Wrapf(err, "Could not parse groups.")
+	}
+	if err := v.UnmarshalKey("rampUp", &config.RampUp); err != nil {
+		return config, errors.Wrapf(err, "Could not parse rampUp.")
+	}
+	for _, group := range config.Groups {
+		if group.Mode != modeEcho && group.Mode != modeBets {
+			return config, errors.Errorf("Group %q has invalid mode %q, expected %s or %s.", group.Name, group.Mode, modeEcho, modeBets)
+		}
+	}
+	return config, nil
+}
+
+// InitLogger Receives the log level to be set in go-logging as a string. This method
+// parses the string and set the level to the logger. If the level string is not
+// valid an error is returned
+func InitLogger(logLevel string) error {
+	baseBackend := logging.NewLogBackend(os.Stderr, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:.5s}     %{message}`,
+	)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backendLeveled.SetLevel(logLevelCode, "")
+
+	// Set the backends to be used.
+	logging.SetBackend(backendLeveled)
+	return nil
+}
+
+func main() {
+	v, err := InitConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if err := InitLogger(v.GetString("log.level")); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	config, err := LoadConfigFrom(v)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		<-signals
+		cancel()
+	}()
+
+	stats := NewStats()
+
+	// Periodic snapshots of the stats, if enabled
+	if interval := v.GetDuration("report.interval"); interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		go func() {
+			for {
+				select {
+				case <-ticker.C:
+					stats.Report(os.Stdout, "snapshot")
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	Run(ctx, config, stats)
+	stats.Report(os.Stdout, "final")
+}
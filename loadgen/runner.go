@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/client/common"
+)
+
+const (
+	modeEcho = "echo"
+	modeBets = "bets"
+)
+
+// GroupConfig Settings shared by a group of virtual clients. The clients
+// of the group get consecutive agency IDs starting at FirstID
+type GroupConfig struct {
+	Name    string
+	Clients int
+	FirstID int `mapstructure:"firstId"`
+	Mode    string
+	Dataset string
+	Batch   struct {
+		MaxAmount int `mapstructure:"maxAmount"`
+	}
+	Loop struct {
+		Amount     int
+		Period     time.Duration
+		Connection string
+	}
+}
+
+// RampStage Starts Clients more virtual clients evenly spaced over the
+// Over duration
+type RampStage struct {
+	Clients int
+	Over    time.Duration
+}
+
+// LoadConfig Configuration of a load generation run
+type LoadConfig struct {
+	ServerAddress string
+	SocketTimeout time.Duration
+	Reconnect     common.ReconnectConfig
+	Groups        []GroupConfig
+	RampUp        []RampStage
+}
+
+// virtualClient A client of the run together with the mode it runs in
+type virtualClient struct {
+	client *common.Client
+	mode   string
+}
+
+// newVirtualClients Creates the clients of every group, in group order
+func newVirtualClients(config LoadConfig, stats *Stats) []virtualClient {
+	var clients []virtualClient
+	for _, group := range config.Groups {
+		for i := 0; i < group.Clients; i++ {
+			client := common.NewClient(common.ClientConfig{
+				ID:             strconv.Itoa(group.FirstID + i),
+				ServerAddress:  config.ServerAddress,
+				LoopAmount:     group.Loop.Amount,
+				LoopPeriod:     group.Loop.Period,
+				LoopConnection: group.Loop.Connection,
+				SocketTimeout:  config.SocketTimeout,
+				BatchMaxAmount: group.Batch.MaxAmount,
+				BatchDataset:   group.Dataset,
+				Reconnect:      config.Reconnect,
+				WinnersBackoff: common.BackoffConfig{
+					Initial:    100 * time.Millisecond,
+					Max:        5 * time.Second,
+					Multiplier: 2,
+					Jitter:     0.2,
+					MaxWait:    2 * time.Minute,
+				},
+			})
+			client.SetObserver(stats)
+			clients = append(clients, virtualClient{client: client, mode: group.Mode})
+		}
+	}
+	return clients
+}
+
+// startDelays Returns the delay since the beginning of the run after
+// which each client must be started. Clients not covered by the ramp up
+// stages start right after the last stage
+func startDelays(clients int, stages []RampStage) []time.Duration {
+	delays := make([]time.Duration, clients)
+	var offset time.Duration
+	next := 0
+	for _, stage := range stages {
+		for i := 0; i < stage.Clients && next < clients; i++ {
+			delays[next] = offset + stage.Over*time.Duration(i)/time.Duration(stage.Clients)
+			next++
+		}
+		offset += stage.Over
+	}
+	for ; next < clients; next++ {
+		delays[next] = offset
+	}
+	return delays
+}
+
+// Run Starts every virtual client following the ramp up schedule and
+// waits for all of them to finish or for the context to be cancelled
+func Run(ctx context.Context, config LoadConfig, stats *Stats) {
+	clients := newVirtualClients(config, stats)
+	delays := startDelays(len(clients), config.RampUp)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i, virtual := range clients {
+		wait := time.Until(start.Add(delays[i]))
+		if wait > 0 {
+			timer := time.NewTimer(wait)
+			select {
+			case <-timer.C:
+			case <-ctx.Done():
+				timer.Stop()
+			}
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		wg.Add(1)
+		stats.ClientStarted()
+		go func(virtual virtualClient) {
+			defer wg.Done()
+			stats.ClientFinished(runClient(ctx, virtual))
+		}(virtual)
+	}
+	wg.Wait()
+}
+
+// runClient Runs a single virtual client in its mode
+func runClient(ctx context.Context, virtual virtualClient) error {
+	switch virtual.mode {
+	case modeBets:
+		if err := virtual.client.SendBets(ctx); err != nil {
+			return err
+		}
+		_, err := virtual.client.QueryWinners(ctx)
+		return err
+	default:
+		return virtual.client.StartClientLoop(ctx)
+	}
+}
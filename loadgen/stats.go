@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// actionStats Outcome of the requests of a single action
+type actionStats struct {
+	requests  int
+	errors    int
+	latencies []time.Duration
+}
+
+// Stats Collects the outcome of the requests made by every virtual
+// client. It implements common.Observer and is safe for concurrent use
+type Stats struct {
+	mu      sync.Mutex
+	start   time.Time
+	actions map[string]*actionStats
+
+	clientsStarted  int
+	clientsFailed   int
+	clientsFinished int
+}
+
+// NewStats Creates an empty collector. Throughput is computed from now
+func NewStats() *Stats {
+	return &Stats{
+		start:   time.Now(),
+		actions: make(map[string]*actionStats),
+	}
+}
+
+// RequestDone Registers the outcome of a request
+func (s *Stats) RequestDone(action string, latency time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats, ok := s.actions[action]
+	if !ok {
+		stats = &actionStats{}
+		s.actions[action] = stats
+	}
+	stats.requests++
+	if err != nil {
+		stats.errors++
+	}
+	stats.latencies = append(stats.latencies, latency)
+}
+
+// ClientStarted Registers that a virtual client started
+func (s *Stats) ClientStarted() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientsStarted++
+}
+
+// ClientFinished Registers that a virtual client finished, with the error
+// that stopped it if any
+func (s *Stats) ClientFinished(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clientsFinished++
+	if err != nil {
+		s.clientsFailed++
+	}
+}
+
+// percentile Returns the latency below which the given fraction of the
+// sorted latencies fall, using the nearest rank method
+func percentile(sorted []time.Duration, fraction float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(fraction*float64(len(sorted))+0.999999999) - 1
+	if rank < 0 {
+		rank = 0
+	}
+	if rank >= len(sorted) {
+		rank = len(sorted) - 1
+	}
+	return sorted[rank]
+}
+
+// Report Writes the aggregate throughput, error rates and latency
+// percentiles of every action, in the order of the action names
+func (s *Stats) Report(w io.Writer, title string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	elapsed := time.Since(s.start)
+	fmt.Fprintf(w, "=== %s | elapsed: %v | clients: %d started, %d finished, %d failed\n",
+		title,
+		elapsed.Round(time.Millisecond),
+		s.clientsStarted,
+		s.clientsFinished,
+		s.clientsFailed,
+	)
+
+	names := make([]string, 0, len(s.actions))
+	for name := range s.actions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintf(w, "%-12s %10s %10s %8s %10s %10s %10s %10s %10s\n",
+		"action", "requests", "req/s", "errors", "p50", "p90", "p95", "p99", "max")
+	for _, name := range names {
+		stats := s.actions[name]
+		sorted := append([]time.Duration(nil), stats.latencies...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+		fmt.Fprintf(w, "%-12s %10d %10.1f %7.2f%% %10v %10v %10v %10v %10v\n",
+			name,
+			stats.requests,
+			float64(stats.requests)/elapsed.Seconds(),
+			100*float64(stats.errors)/float64(stats.requests),
+			percentile(sorted, 0.50).Round(time.Microsecond),
+			percentile(sorted, 0.90).Round(time.Microsecond),
+			percentile(sorted, 0.95).Round(time.Microsecond),
+			percentile(sorted, 0.99).Round(time.Microsecond),
+			percentile(sorted, 1).Round(time.Microsecond),
+		)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPercentileUsesNearestRank(t *testing.T) {
+	var sorted []time.Duration
+	for i := 1; i <= 100; i++ {
+		sorted = append(sorted, time.Duration(i)*time.Millisecond)
+	}
+	cases := map[float64]time.Duration{
+		0.50: 50 * time.Millisecond,
+		0.99: 99 * time.Millisecond,
+		1:    100 * time.Millisecond,
+	}
+	for fraction, expected := range cases {
+		if got := percentile(sorted, fraction); got != expected {
+			t.Errorf("p%v: expected %v, got %v", fraction*100, expected, got)
+		}
+	}
+	if got := percentile(nil, 0.5); got != 0 {
+		t.Errorf("expected 0 for no latencies, got %v", got)
+	}
+}
+
+func TestStartDelaysFollowTheRampUp(t *testing.T) {
+	delays := startDelays(5, []RampStage{
+		{Clients: 2, Over: time.Second},
+		{Clients: 2, Over: 2 * time.Second},
+	})
+	expected := []time.Duration{0, 500 * time.Millisecond, time.Second, 2 * time.Second, 3 * time.Second}
+	for i := range expected {
+		if delays[i] != expected[i] {
+			t.Fatalf("expected delays %v, got %v", expected, delays)
+		}
+	}
+}
+
+func TestReportIncludesErrorRates(t *testing.T) {
+	stats := NewStats()
+	stats.RequestDone("echo", time.Millisecond, nil)
+	stats.RequestDone("echo", time.Millisecond, errors.New("boom"))
+
+	var out bytes.Buffer
+	stats.Report(&out, "final")
+	if !strings.Contains(out.String(), "50.00%") {
+		t.Fatalf("expected a 50%% error rate in\n%s", out.String())
+	}
+}
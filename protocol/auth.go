@@ -0,0 +1,169 @@
+package protocol
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// NonceSize Size in bytes of the nonce sent in a CHALLENGE
+	NonceSize = 32
+	// MACSize Size in bytes of the HMAC sent in an AUTHENTICATE
+	MACSize = sha256.Size
+)
+
+// NewNonce Returns a random nonce to be sent in a CHALLENGE
+func NewNonce() ([]byte, error) {
+	nonce := make([]byte, NonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, errors.Wrap(err, "could not generate a nonce")
+	}
+	return nonce, nil
+}
+
+// SignChallenge Returns the HMAC-SHA256 of the nonce followed by the
+// agency ID, keyed with the secret of the agency. Binding the ID keeps
+// the answer of an agency from being replayed under another ID
+func SignChallenge(secret []byte, agencyID uint32, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(nonce)
+	var id [4]byte
+	byteOrder.PutUint32(id[:], agencyID)
+	mac.Write(id[:])
+	return mac.Sum(nil)
+}
+
+// VerifyChallenge Checks in constant time that the MAC is the one
+// SignChallenge returns for the secret, agency and nonce
+func VerifyChallenge(secret []byte, agencyID uint32, nonce []byte, mac []byte) bool {
+	return hmac.Equal(mac, SignChallenge(secret, agencyID, nonce))
+}
+
+// Hello Request that starts the authentication of a connection. The
+// agency being authenticated is the one of the frame header
+type Hello struct{}
+
+// Kind Returns KindHello
+func (m *Hello) Kind() RequestKind { return KindHello }
+
+// MarshalBinary Returns an empty payload
+func (m *Hello) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// UnmarshalBinary Checks that the payload is empty
+func (m *Hello) UnmarshalBinary(data []byte) error { return expectEmpty(data) }
+
+// Authenticate Request with the HMAC of the nonce of the CHALLENGE
+type Authenticate struct {
+	MAC []byte
+}
+
+// Kind Returns KindAuthenticate
+func (m *Authenticate) Kind() RequestKind { return KindAuthenticate }
+
+// MarshalBinary Encodes the MAC as the whole payload
+func (m *Authenticate) MarshalBinary() ([]byte, error) {
+	if len(m.MAC) != MACSize {
+		return nil, errors.Wrapf(ErrMalformedPayload, "MAC has %d bytes, expected %d", len(m.MAC), MACSize)
+	}
+	return m.MAC, nil
+}
+
+// UnmarshalBinary Decodes the payload of an AUTHENTICATE
+func (m *Authenticate) UnmarshalBinary(data []byte) error {
+	if len(data) != MACSize {
+		return errors.Wrapf(ErrMalformedPayload, "MAC has %d bytes, expected %d", len(data), MACSize)
+	}
+	m.MAC = append([]byte(nil), data...)
+	return nil
+}
+
+// Challenge Response to a HELLO with the nonce the agency must sign
+type Challenge struct {
+	Nonce []byte
+}
+
+// Kind Returns KindChallenge
+func (m *Challenge) Kind() ResponseKind { return KindChallenge }
+
+// MarshalBinary Encodes the nonce as the whole payload
+func (m *Challenge) MarshalBinary() ([]byte, error) {
+	if len(m.Nonce) != NonceSize {
+		return nil, errors.Wrapf(ErrMalformedPayload, "nonce has %d bytes, expected %d", len(m.Nonce), NonceSize)
+	}
+	return m.Nonce, nil
+}
+
+// UnmarshalBinary Decodes the payload of a CHALLENGE
+func (m *Challenge) UnmarshalBinary(data []byte) error {
+	if len(data) != NonceSize {
+		return errors.Wrapf(ErrMalformedPayload, "nonce has %d bytes, expected %d", len(data), NonceSize)
+	}
+	m.Nonce = append([]byte(nil), data...)
+	return nil
+}
+
+// ErrorCode Reason why the server refused a request
+type ErrorCode uint8
+
+const (
+	// CodeNotAuthenticated A request other than HELLO was sent before
+	// authenticating
+	CodeNotAuthenticated ErrorCode = iota + 1
+	// CodeAuthenticationFailed The agency is unknown or its MAC is wrong
+	CodeAuthenticationFailed
+	// CodeAgencyMismatch The AGENCYID of the request is not the one the
+	// connection was authenticated for
+	CodeAgencyMismatch
+	// CodeInvalidBet A bet of the request can not be stored. Sending the
+	// request again fails the same way
+	CodeInvalidBet
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case CodeNotAuthenticated:
+		return "NOT_AUTHENTICATED"
+	case CodeAuthenticationFailed:
+		return "AUTHENTICATION_FAILED"
+	case CodeAgencyMismatch:
+		return "AGENCY_MISMATCH"
+	case CodeInvalidBet:
+		return "INVALID_BET"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Error Response sent when a request is refused, right before the
+// server closes the connection. The payload is | CODE (1) | MESSAGE |.
+// It implements error so the client can return it as is
+type Error struct {
+	Code    ErrorCode
+	Message string
+}
+
+// Kind Returns KindError
+func (m *Error) Kind() ResponseKind { return KindError }
+
+// MarshalBinary Encodes the code followed by the message
+func (m *Error) MarshalBinary() ([]byte, error) {
+	return append([]byte{byte(m.Code)}, m.Message...), nil
+}
+
+// UnmarshalBinary Decodes the payload of an ERROR
+func (m *Error) UnmarshalBinary(data []byte) error {
+	if len(data) == 0 {
+		return errors.Wrap(ErrMalformedPayload, "error without code")
+	}
+	m.Code = ErrorCode(data[0])
+	m.Message = string(data[1:])
+	return nil
+}
+
+func (m *Error) Error() string {
+	return fmt.Sprintf("server refused the request: %v: %s", m.Code, m.Message)
+}
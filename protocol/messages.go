@@ -0,0 +1,313 @@
+package protocol
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	betFieldsAmount        = 5
+	betFieldSizeLength     = 2
+	maxBetFieldSize        = 1<<16 - 1
+	documentsSeparator     = ","
+	betSizePrefixLength    = 4
+	acknowledgePayloadSize = 4
+)
+
+const (
+	// BetBatchUploadSize Size in bytes of the upload ID that starts the
+	// payload of a BET_BATCH
+	BetBatchUploadSize = 8
+	// BetBatchSequenceSize Size in bytes of the sequence number that
+	// follows the upload ID
+	BetBatchSequenceSize = 8
+	// BetBatchHeaderSize Size in bytes of the payload of a BET_BATCH
+	// before its bets
+	BetBatchHeaderSize = BetBatchUploadSize + BetBatchSequenceSize
+)
+
+// Bet A lottery bet as it travels through the wire
+type Bet struct {
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate string
+	Number    string
+}
+
+func (b *Bet) fields() []*string {
+	return []*string{&b.FirstName, &b.LastName, &b.Document, &b.Birthdate, &b.Number}
+}
+
+// MarshalBinary Encodes the bet as its NOMBRE, APELLIDO, DOCUMENTO,
+// NACIMIENTO and NUMERO, each one as | SIZE (2) | UTF-8 BYTES (SIZE) |.
+// Sizes count bytes rather than characters, so fields may hold commas and
+// any text, as long as it is valid UTF-8
+func (b Bet) MarshalBinary() ([]byte, error) {
+	fields := b.fields()
+	size := 0
+	for _, field := range fields {
+		if !utf8.ValidString(*field) {
+			return nil, errors.Wrapf(ErrMalformedPayload, "bet field %q is not valid UTF-8", *field)
+		}
+		if len(*field) > maxBetFieldSize {
+			return nil, errors.Wrapf(ErrPayloadTooLarge, "bet field of %d bytes, the limit is %d", len(*field), maxBetFieldSize)
+		}
+		size += betFieldSizeLength + len(*field)
+	}
+
+	encoded := make([]byte, 0, size)
+	for _, field := range fields {
+		var fieldSize [betFieldSizeLength]byte
+		byteOrder.PutUint16(fieldSize[:], uint16(len(*field)))
+		encoded = append(encoded, fieldSize[:]...)
+		encoded = append(encoded, *field...)
+	}
+	return encoded, nil
+}
+
+// UnmarshalBinary Decodes a bet encoded by MarshalBinary
+func (b *Bet) UnmarshalBinary(data []byte) error {
+	var decoded Bet
+	for i, field := range decoded.fields() {
+		if len(data) < betFieldSizeLength {
+			return errors.Wrapf(ErrMalformedPayload, "bet has %d fields, expected %d", i, betFieldsAmount)
+		}
+		size := int(byteOrder.Uint16(data))
+		data = data[betFieldSizeLength:]
+		if size > len(data) {
+			return errors.Wrapf(ErrMalformedPayload, "bet field %d says %d bytes but only %d are left", i, size, len(data))
+		}
+		if !utf8.Valid(data[:size]) {
+			return errors.Wrapf(ErrMalformedPayload, "bet field %d is not valid UTF-8", i)
+		}
+		*field = string(data[:size])
+		data = data[size:]
+	}
+	if len(data) > 0 {
+		return errors.Wrapf(ErrMalformedPayload, "%d bytes left after the bet", len(data))
+	}
+	*b = decoded
+	return nil
+}
+
+// PostBet Request used to publish a single bet
+type PostBet struct {
+	Bet Bet
+}
+
+// Kind Returns KindPostBet
+func (m *PostBet) Kind() RequestKind { return KindPostBet }
+
+// MarshalBinary Encodes the bet as the whole payload
+func (m *PostBet) MarshalBinary() ([]byte, error) { return m.Bet.MarshalBinary() }
+
+// UnmarshalBinary Decodes the payload of a POST_BET
+func (m *PostBet) UnmarshalBinary(data []byte) error { return m.Bet.UnmarshalBinary(data) }
+
+// BetBatch Request used to publish many bets at once. Each bet is
+// prefixed with its size so the boundaries between bets are known.
+// Upload identifies each upload of the bets of an agency, and Sequence
+// numbers its batches from 1 onwards, so the server can recognize a
+// retransmitted batch and acknowledge it without storing its bets again.
+// An agency that uploads its bets from scratch picks a new Upload, so
+// its batches are not mistaken for those of the previous upload. A zero
+// Sequence disables that check
+type BetBatch struct {
+	Upload   uint64
+	Sequence uint64
+	Bets     []Bet
+}
+
+// Kind Returns KindBetBatch
+func (m *BetBatch) Kind() RequestKind { return KindBetBatch }
+
+// MarshalBinary Encodes the batch as
+// | UPLOAD (8) | SEQUENCE (8) | SIZE | BET | SIZE | BET | ...
+func (m *BetBatch) MarshalBinary() ([]byte, error) {
+	payload := make([]byte, BetBatchHeaderSize)
+	byteOrder.PutUint64(payload, m.Upload)
+	byteOrder.PutUint64(payload[BetBatchUploadSize:], m.Sequence)
+	for i, bet := range m.Bets {
+		encoded, err := bet.MarshalBinary()
+		if err != nil {
+			return nil, errors.Wrapf(err, "bet %d", i)
+		}
+		payload = appendSizePrefixed(payload, encoded)
+	}
+	return payload, nil
+}
+
+// UnmarshalBinary Decodes the payload of a BET_BATCH
+func (m *BetBatch) UnmarshalBinary(data []byte) error {
+	if len(data) < BetBatchHeaderSize {
+		return errors.Wrapf(ErrMalformedPayload, "truncated header, %d bytes", len(data))
+	}
+	m.Upload = byteOrder.Uint64(data)
+	m.Sequence = byteOrder.Uint64(data[BetBatchUploadSize:])
+	data = data[BetBatchHeaderSize:]
+
+	m.Bets = nil
+	for len(data) > 0 {
+		encoded, rest, err := splitSizePrefixed(data)
+		if err != nil {
+			return errors.Wrapf(err, "bet %d", len(m.Bets))
+		}
+		var bet Bet
+		if err := bet.UnmarshalBinary(encoded); err != nil {
+			return errors.Wrapf(err, "bet %d", len(m.Bets))
+		}
+		m.Bets = append(m.Bets, bet)
+		data = rest
+	}
+	return nil
+}
+
+// BetBatchSize Returns the size in bytes that a BET_BATCH with the
+// given bets takes once encoded, header included
+func BetBatchSize(bets []Bet) (int, error) {
+	size := RequestHeaderSize + BetBatchHeaderSize
+	for _, bet := range bets {
+		entrySize, err := BetBatchEntrySize(bet)
+		if err != nil {
+			return 0, err
+		}
+		size += entrySize
+	}
+	return size, nil
+}
+
+// BetBatchEntrySize Returns the size in bytes that a single bet takes
+// inside the payload of a BET_BATCH
+func BetBatchEntrySize(bet Bet) (int, error) {
+	encoded, err := bet.MarshalBinary()
+	if err != nil {
+		return 0, err
+	}
+	return betSizePrefixLength + len(encoded), nil
+}
+
+// BetBatchEnd Request used by an agency to signal that all of its
+// bets were sent
+type BetBatchEnd struct{}
+
+// Kind Returns KindBetBatchEnd
+func (m *BetBatchEnd) Kind() RequestKind { return KindBetBatchEnd }
+
+// MarshalBinary Returns an empty payload
+func (m *BetBatchEnd) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// UnmarshalBinary Checks that the payload is empty
+func (m *BetBatchEnd) UnmarshalBinary(data []byte) error { return expectEmpty(data) }
+
+// GetWinners Request used by an agency to ask for its winners
+type GetWinners struct{}
+
+// Kind Returns KindGetWinners
+func (m *GetWinners) Kind() RequestKind { return KindGetWinners }
+
+// MarshalBinary Returns an empty payload
+func (m *GetWinners) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// UnmarshalBinary Checks that the payload is empty
+func (m *GetWinners) UnmarshalBinary(data []byte) error { return expectEmpty(data) }
+
+// Acknowledge Response sent once a request was processed. Count
+// holds the amount of bets that were stored by the request
+type Acknowledge struct {
+	Count uint32
+}
+
+// Kind Returns KindAcknowledge
+func (m *Acknowledge) Kind() ResponseKind { return KindAcknowledge }
+
+// MarshalBinary Encodes the count as an uint32
+func (m *Acknowledge) MarshalBinary() ([]byte, error) {
+	payload := make([]byte, acknowledgePayloadSize)
+	byteOrder.PutUint32(payload, m.Count)
+	return payload, nil
+}
+
+// UnmarshalBinary Decodes the payload of an ACKNOWLEDGE
+func (m *Acknowledge) UnmarshalBinary(data []byte) error {
+	if len(data) != acknowledgePayloadSize {
+		return errors.Wrapf(ErrMalformedPayload, "acknowledge has %d bytes, expected %d", len(data), acknowledgePayloadSize)
+	}
+	m.Count = byteOrder.Uint32(data)
+	return nil
+}
+
+// WinnersReady Response sent when the draw was already made and the
+// winners can be queried
+type WinnersReady struct{}
+
+// Kind Returns KindWinnersReady
+func (m *WinnersReady) Kind() ResponseKind { return KindWinnersReady }
+
+// MarshalBinary Returns an empty payload
+func (m *WinnersReady) MarshalBinary() ([]byte, error) { return nil, nil }
+
+// UnmarshalBinary Checks that the payload is empty
+func (m *WinnersReady) UnmarshalBinary(data []byte) error { return expectEmpty(data) }
+
+// BettingResults Response with the documents of the winners of an
+// agency, encoded as DNI_1,DNI_2,...,DNI_N
+type BettingResults struct {
+	Documents []string
+}
+
+// Kind Returns KindBettingResults
+func (m *BettingResults) Kind() ResponseKind { return KindBettingResults }
+
+// MarshalBinary Encodes the documents separated by commas
+func (m *BettingResults) MarshalBinary() ([]byte, error) {
+	for _, document := range m.Documents {
+		if document == "" || strings.Contains(document, documentsSeparator) {
+			return nil, errors.Wrapf(ErrMalformedPayload, "invalid document %q", document)
+		}
+	}
+	return []byte(strings.Join(m.Documents, documentsSeparator)), nil
+}
+
+// UnmarshalBinary Decodes the payload of a BETTING_RESULTS
+func (m *BettingResults) UnmarshalBinary(data []byte) error {
+	m.Documents = nil
+	if len(data) == 0 {
+		return nil
+	}
+	for _, document := range strings.Split(string(data), documentsSeparator) {
+		if document == "" {
+			return errors.Wrap(ErrMalformedPayload, "empty document in betting results")
+		}
+		m.Documents = append(m.Documents, document)
+	}
+	return nil
+}
+
+func expectEmpty(data []byte) error {
+	if len(data) != 0 {
+		return errors.Wrapf(ErrMalformedPayload, "expected an empty payload, got %d bytes", len(data))
+	}
+	return nil
+}
+
+func appendSizePrefixed(dst []byte, data []byte) []byte {
+	var size [betSizePrefixLength]byte
+	byteOrder.PutUint32(size[:], uint32(len(data)))
+	dst = append(dst, size[:]...)
+	return append(dst, data...)
+}
+
+func splitSizePrefixed(data []byte) ([]byte, []byte, error) {
+	if len(data) < betSizePrefixLength {
+		return nil, nil, errors.Wrapf(ErrMalformedPayload, "truncated size prefix, %d bytes left", len(data))
+	}
+	size := byteOrder.Uint32(data)
+	data = data[betSizePrefixLength:]
+	if uint64(size) > uint64(len(data)) {
+		return nil, nil, errors.Wrapf(ErrMalformedPayload, "size prefix says %d bytes but only %d are left", size, len(data))
+	}
+	return data[:size], data[size:], nil
+}
@@ -0,0 +1,303 @@
+// Package protocol implements the binary protocol spoken between the
+// lottery agencies and the central server.
+//
+// Every request sent by an agency has the following layout
+//
+//	| KIND (1) | AGENCYID (4) | PAYLOAD_SIZE (4) | PAYLOAD (PAYLOAD_SIZE) |
+//
+// and every response sent by the server has the following one
+//
+//	| KIND (1) | PAYLOAD_SIZE (4) | PAYLOAD (PAYLOAD_SIZE) |
+//
+// All the integers are encoded in little endian.
+//
+// A GET_WINNERS is answered with an ACKNOWLEDGE while the draw is
+// pending, and with a WINNERS_READY followed by a BETTING_RESULTS once
+// it was made.
+//
+// When the server requires authentication every connection starts with
+// a HELLO, answered with a CHALLENGE holding a random nonce. The agency
+// proves it knows its shared secret by sending an AUTHENTICATE with the
+// HMAC of the nonce, answered with an ACKNOWLEDGE. From then on the
+// AGENCYID of every request must be the authenticated one. Requests the
+// server refuses are answered with an ERROR before closing the connection.
+package protocol
+
+import (
+	"encoding/binary"
+	"io"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxMessageSize Maximum size in bytes of a whole message, header included
+	MaxMessageSize = 8 * 1024
+	// RequestHeaderSize Size in bytes of the fixed part of a request
+	RequestHeaderSize = 1 + 4 + 4
+	// ResponseHeaderSize Size in bytes of the fixed part of a response
+	ResponseHeaderSize = 1 + 4
+	// MaxRequestPayloadSize Maximum size in bytes of a request payload
+	MaxRequestPayloadSize = MaxMessageSize - RequestHeaderSize
+	// MaxResponsePayloadSize Maximum size in bytes of a response payload
+	MaxResponsePayloadSize = MaxMessageSize - ResponseHeaderSize
+)
+
+var (
+	// ErrPayloadTooLarge The payload of a message does not fit in MaxMessageSize
+	ErrPayloadTooLarge = errors.New("payload too large")
+	// ErrUnknownKind The KIND of a message is not part of the protocol
+	ErrUnknownKind = errors.New("unknown message kind")
+	// ErrMalformedPayload The payload of a message could not be decoded
+	ErrMalformedPayload = errors.New("malformed payload")
+	// ErrUnexpectedMessage The message received is valid but is not the one expected
+	ErrUnexpectedMessage = errors.New("unexpected message")
+)
+
+var byteOrder = binary.LittleEndian
+
+// RequestKind Kind of the messages sent by the agencies
+type RequestKind uint8
+
+const (
+	// KindPostBet A single bet
+	KindPostBet RequestKind = iota
+	// KindBetBatch A batch of bets
+	KindBetBatch
+	// KindBetBatchEnd The agency finished sending its bets
+	KindBetBatchEnd
+	// KindGetWinners The agency asks for its winners
+	KindGetWinners
+	// KindHello The agency starts the authentication of the connection
+	KindHello
+	// KindAuthenticate The agency answers the challenge of the server
+	KindAuthenticate
+)
+
+func (k RequestKind) String() string {
+	switch k {
+	case KindPostBet:
+		return "POST_BET"
+	case KindBetBatch:
+		return "BET_BATCH"
+	case KindBetBatchEnd:
+		return "BET_BATCH_END"
+	case KindGetWinners:
+		return "GET_WINNERS"
+	case KindHello:
+		return "HELLO"
+	case KindAuthenticate:
+		return "AUTHENTICATE"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// ResponseKind Kind of the messages sent by the server
+type ResponseKind uint8
+
+const (
+	// KindAcknowledge The request was processed
+	KindAcknowledge ResponseKind = iota
+	// KindWinnersReady The draw was made and the winners can be queried
+	KindWinnersReady
+	// KindBettingResults The winners of the agency
+	KindBettingResults
+	// KindChallenge The nonce the agency must sign to authenticate
+	KindChallenge
+	// KindError The request was refused
+	KindError
+)
+
+func (k ResponseKind) String() string {
+	switch k {
+	case KindAcknowledge:
+		return "ACKNOWLEDGE"
+	case KindWinnersReady:
+		return "WINNERS_READY"
+	case KindBettingResults:
+		return "BETTING_RESULTS"
+	case KindChallenge:
+		return "CHALLENGE"
+	case KindError:
+		return "ERROR"
+	default:
+		return "UNKNOWN"
+	}
+}
+
+// Request Message sent by an agency to the server
+type Request interface {
+	Kind() RequestKind
+	MarshalBinary() ([]byte, error)
+}
+
+// Response Message sent by the server to an agency
+type Response interface {
+	Kind() ResponseKind
+	MarshalBinary() ([]byte, error)
+}
+
+// WriteRequest Encodes the request and writes it to w as a single
+// frame. The whole frame is written, even if the writer accepts
+// fewer bytes than requested on each call
+func WriteRequest(w io.Writer, agencyID uint32, req Request) error {
+	payload, err := req.MarshalBinary()
+	if err != nil {
+		return errors.Wrapf(err, "could not encode %v", req.Kind())
+	}
+	if len(payload) > MaxRequestPayloadSize {
+		return errors.Wrapf(ErrPayloadTooLarge, "%v payload has %d bytes, max is %d", req.Kind(), len(payload), MaxRequestPayloadSize)
+	}
+
+	frame := make([]byte, RequestHeaderSize+len(payload))
+	frame[0] = byte(req.Kind())
+	byteOrder.PutUint32(frame[1:5], agencyID)
+	byteOrder.PutUint32(frame[5:9], uint32(len(payload)))
+	copy(frame[RequestHeaderSize:], payload)
+	return writeFull(w, frame)
+}
+
+// ReadRequest Reads a whole request frame from r and decodes it. The
+// concrete type of the returned request depends on its kind
+func ReadRequest(r io.Reader) (uint32, Request, error) {
+	var header [RequestHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+	kind := RequestKind(header[0])
+	agencyID := byteOrder.Uint32(header[1:5])
+	size := byteOrder.Uint32(header[5:9])
+
+	req, err := newRequest(kind)
+	if err != nil {
+		return agencyID, nil, err
+	}
+	if size > MaxRequestPayloadSize {
+		return agencyID, nil, errors.Wrapf(ErrPayloadTooLarge, "%v payload has %d bytes, max is %d", kind, size, MaxRequestPayloadSize)
+	}
+
+	payload, err := readPayload(r, size)
+	if err != nil {
+		return agencyID, nil, errors.Wrapf(err, "could not read %v payload", kind)
+	}
+	if err := req.(unmarshaler).UnmarshalBinary(payload); err != nil {
+		return agencyID, nil, errors.Wrapf(err, "could not decode %v payload", kind)
+	}
+	return agencyID, req, nil
+}
+
+// WriteResponse Encodes the response and writes it to w as a single
+// frame. The whole frame is written, even if the writer accepts
+// fewer bytes than requested on each call
+func WriteResponse(w io.Writer, res Response) error {
+	payload, err := res.MarshalBinary()
+	if err != nil {
+		return errors.Wrapf(err, "could not encode %v", res.Kind())
+	}
+	if len(payload) > MaxResponsePayloadSize {
+		return errors.Wrapf(ErrPayloadTooLarge, "%v payload has %d bytes, max is %d", res.Kind(), len(payload), MaxResponsePayloadSize)
+	}
+
+	frame := make([]byte, ResponseHeaderSize+len(payload))
+	frame[0] = byte(res.Kind())
+	byteOrder.PutUint32(frame[1:5], uint32(len(payload)))
+	copy(frame[ResponseHeaderSize:], payload)
+	return writeFull(w, frame)
+}
+
+// ReadResponse Reads a whole response frame from r and decodes it. The
+// concrete type of the returned response depends on its kind
+func ReadResponse(r io.Reader) (Response, error) {
+	var header [ResponseHeaderSize]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	kind := ResponseKind(header[0])
+	size := byteOrder.Uint32(header[1:5])
+
+	res, err := newResponse(kind)
+	if err != nil {
+		return nil, err
+	}
+	if size > MaxResponsePayloadSize {
+		return nil, errors.Wrapf(ErrPayloadTooLarge, "%v payload has %d bytes, max is %d", kind, size, MaxResponsePayloadSize)
+	}
+
+	payload, err := readPayload(r, size)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not read %v payload", kind)
+	}
+	if err := res.(unmarshaler).UnmarshalBinary(payload); err != nil {
+		return nil, errors.Wrapf(err, "could not decode %v payload", kind)
+	}
+	return res, nil
+}
+
+type unmarshaler interface {
+	UnmarshalBinary([]byte) error
+}
+
+func newRequest(kind RequestKind) (Request, error) {
+	switch kind {
+	case KindPostBet:
+		return &PostBet{}, nil
+	case KindBetBatch:
+		return &BetBatch{}, nil
+	case KindBetBatchEnd:
+		return &BetBatchEnd{}, nil
+	case KindGetWinners:
+		return &GetWinners{}, nil
+	case KindHello:
+		return &Hello{}, nil
+	case KindAuthenticate:
+		return &Authenticate{}, nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownKind, "request kind %d", uint8(kind))
+	}
+}
+
+func newResponse(kind ResponseKind) (Response, error) {
+	switch kind {
+	case KindAcknowledge:
+		return &Acknowledge{}, nil
+	case KindWinnersReady:
+		return &WinnersReady{}, nil
+	case KindBettingResults:
+		return &BettingResults{}, nil
+	case KindChallenge:
+		return &Challenge{}, nil
+	case KindError:
+		return &Error{}, nil
+	default:
+		return nil, errors.Wrapf(ErrUnknownKind, "response kind %d", uint8(kind))
+	}
+}
+
+// readPayload Reads exactly size bytes from r. A stream that ends
+// before the payload is complete is reported as io.ErrUnexpectedEOF
+func readPayload(r io.Reader, size uint32) ([]byte, error) {
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return payload, nil
+}
+
+// writeFull Writes the whole buffer to w, retrying on short writes
+func writeFull(w io.Writer, buf []byte) error {
+	for len(buf) > 0 {
+		n, err := w.Write(buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return io.ErrShortWrite
+		}
+		buf = buf[n:]
+	}
+	return nil
+}
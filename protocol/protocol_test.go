@@ -0,0 +1,262 @@
+package protocol
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"testing/quick"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// oneByteWriter Accepts a single byte per call to exercise short writes
+type oneByteWriter struct {
+	buf bytes.Buffer
+}
+
+func (w *oneByteWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.buf.Write(p[:1])
+}
+
+var testBet = Bet{
+	FirstName: "Santiago Lionel",
+	LastName:  "Lorca",
+	Document:  "30904465",
+	Birthdate: "1999-03-17",
+	Number:    "7574",
+}
+
+func TestRequestsRoundTrip(t *testing.T) {
+	requests := []Request{
+		&PostBet{Bet: testBet},
+		&BetBatch{Upload: 3, Sequence: 7, Bets: []Bet{testBet, testBet}},
+		&BetBatchEnd{},
+		&GetWinners{},
+		&Hello{},
+		&Authenticate{MAC: bytes.Repeat([]byte{7}, MACSize)},
+	}
+	for _, req := range requests {
+		w := &oneByteWriter{}
+		if err := WriteRequest(w, 3, req); err != nil {
+			t.Fatalf("%v: write failed: %v", req.Kind(), err)
+		}
+		agencyID, decoded, err := ReadRequest(iotest.OneByteReader(&w.buf))
+		if err != nil {
+			t.Fatalf("%v: read failed: %v", req.Kind(), err)
+		}
+		if agencyID != 3 {
+			t.Errorf("%v: expected agency 3, got %d", req.Kind(), agencyID)
+		}
+		if !reflect.DeepEqual(req, decoded) {
+			t.Errorf("%v: expected %+v, got %+v", req.Kind(), req, decoded)
+		}
+	}
+}
+
+func TestResponsesRoundTrip(t *testing.T) {
+	responses := []Response{
+		&Acknowledge{Count: 42},
+		&WinnersReady{},
+		&BettingResults{Documents: []string{"30904465", "21689196"}},
+		&BettingResults{},
+		&Challenge{Nonce: bytes.Repeat([]byte{9}, NonceSize)},
+		&Error{Code: CodeAgencyMismatch, Message: "agency 2 authenticated as 1"},
+	}
+	for _, res := range responses {
+		w := &oneByteWriter{}
+		if err := WriteResponse(w, res); err != nil {
+			t.Fatalf("%v: write failed: %v", res.Kind(), err)
+		}
+		decoded, err := ReadResponse(iotest.OneByteReader(&w.buf))
+		if err != nil {
+			t.Fatalf("%v: read failed: %v", res.Kind(), err)
+		}
+		if !reflect.DeepEqual(res, decoded) {
+			t.Errorf("%v: expected %+v, got %+v", res.Kind(), res, decoded)
+		}
+	}
+}
+
+func TestWriteRequestRejectsPayloadsTooLarge(t *testing.T) {
+	bets := make([]Bet, MaxMessageSize/10)
+	for i := range bets {
+		bets[i] = testBet
+	}
+	err := WriteRequest(io.Discard, 1, &BetBatch{Bets: bets})
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestReadRequestRejectsPayloadsTooLarge(t *testing.T) {
+	frame := []byte{byte(KindBetBatch), 1, 0, 0, 0, 0xff, 0xff, 0, 0}
+	_, _, err := ReadRequest(bytes.NewReader(frame))
+	if !errors.Is(err, ErrPayloadTooLarge) {
+		t.Fatalf("expected ErrPayloadTooLarge, got %v", err)
+	}
+}
+
+func TestReadRequestRejectsUnknownKinds(t *testing.T) {
+	frame := []byte{0x7f, 1, 0, 0, 0, 0, 0, 0, 0}
+	_, _, err := ReadRequest(bytes.NewReader(frame))
+	if !errors.Is(err, ErrUnknownKind) {
+		t.Fatalf("expected ErrUnknownKind, got %v", err)
+	}
+}
+
+func TestReadResponseReportsTruncatedPayloads(t *testing.T) {
+	frame := []byte{byte(KindAcknowledge), 4, 0, 0, 0, 1, 0}
+	_, err := ReadResponse(bytes.NewReader(frame))
+	if !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+	}
+}
+
+func TestBetBatchRejectsMalformedPayloads(t *testing.T) {
+	var batch BetBatch
+	for _, payload := range [][]byte{
+		{1, 0, 0, 0},
+		{1, 0, 0, 0, 0, 0, 0, 0, 10, 0, 0, 0, 'a', 'b'},
+	} {
+		if err := batch.UnmarshalBinary(payload); !errors.Is(err, ErrMalformedPayload) {
+			t.Fatalf("expected ErrMalformedPayload, got %v", err)
+		}
+	}
+}
+
+func TestBetBatchSizeMatchesEncoding(t *testing.T) {
+	batch := &BetBatch{Sequence: 1, Bets: []Bet{testBet, testBet, testBet}}
+	var buf bytes.Buffer
+	if err := WriteRequest(&buf, 1, batch); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	size, err := BetBatchSize(batch.Bets)
+	if err != nil {
+		t.Fatalf("size failed: %v", err)
+	}
+	if size != buf.Len() {
+		t.Fatalf("expected %d bytes, got %d", buf.Len(), size)
+	}
+}
+
+func TestBetsRoundTripArbitraryText(t *testing.T) {
+	roundTrip := func(firstName, lastName, document, birthdate, number string) bool {
+		bet := Bet{FirstName: firstName, LastName: lastName, Document: document, Birthdate: birthdate, Number: number}
+		encoded, err := bet.MarshalBinary()
+		if err != nil {
+			return false
+		}
+		var decoded Bet
+		return decoded.UnmarshalBinary(encoded) == nil && decoded == bet
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBetBatchesRoundTripArbitraryText(t *testing.T) {
+	roundTrip := func(upload uint64, sequence uint64, names []string) bool {
+		batch := &BetBatch{Upload: upload, Sequence: sequence}
+		for _, name := range names {
+			batch.Bets = append(batch.Bets, Bet{FirstName: name, LastName: name + ", hijo", Document: "30904465", Birthdate: "1999-03-17", Number: "7574"})
+		}
+		encoded, err := batch.MarshalBinary()
+		if err != nil {
+			return false
+		}
+		size, err := BetBatchSize(batch.Bets)
+		if err != nil || size != RequestHeaderSize+len(encoded) {
+			return false
+		}
+		var decoded BetBatch
+		return decoded.UnmarshalBinary(encoded) == nil && reflect.DeepEqual(decoded.Bets, batch.Bets) && decoded.Upload == upload && decoded.Sequence == sequence
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestBetFieldSizesCountUTF8Bytes(t *testing.T) {
+	bet := testBet
+	bet.LastName = "Álvarez, de la Peña"
+	encoded, err := bet.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	fieldsSize := 0
+	for _, field := range []string{bet.FirstName, bet.LastName, bet.Document, bet.Birthdate, bet.Number} {
+		fieldsSize += len(field)
+	}
+	if len(encoded) != betFieldsAmount*betFieldSizeLength+fieldsSize {
+		t.Fatalf("expected %d bytes, got %d", betFieldsAmount*betFieldSizeLength+fieldsSize, len(encoded))
+	}
+	lastNameSize := int(byteOrder.Uint16(encoded[betFieldSizeLength+len(bet.FirstName):]))
+	if lastNameSize != len(bet.LastName) || lastNameSize == utf8.RuneCountInString(bet.LastName) {
+		t.Fatalf("expected the size of the last name in bytes, %d, got %d", len(bet.LastName), lastNameSize)
+	}
+}
+
+func TestBetsRejectInvalidFields(t *testing.T) {
+	bet := testBet
+	bet.FirstName = "Santiago\xff"
+	if _, err := bet.MarshalBinary(); !errors.Is(err, ErrMalformedPayload) {
+		t.Errorf("expected invalid UTF-8 to be rejected, got %v", err)
+	}
+	bet.FirstName = strings.Repeat("x", maxBetFieldSize+1)
+	if _, err := bet.MarshalBinary(); !errors.Is(err, ErrPayloadTooLarge) {
+		t.Errorf("expected a field too large to be rejected, got %v", err)
+	}
+
+	encoded, _ := testBet.MarshalBinary()
+	var decoded Bet
+	for _, payload := range [][]byte{
+		encoded[:len(encoded)-1],
+		append(append([]byte{}, encoded...), 0),
+		{2, 0, 0xc3, 0x28, 0, 0, 0, 0, 0, 0, 0, 0},
+	} {
+		if err := decoded.UnmarshalBinary(payload); !errors.Is(err, ErrMalformedPayload) {
+			t.Errorf("expected ErrMalformedPayload for %v, got %v", payload, err)
+		}
+	}
+}
+
+func TestSignedChallengesAreBoundToTheSecretAgencyAndNonce(t *testing.T) {
+	secret := []byte("secret of agency 1")
+	nonce, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	mac := SignChallenge(secret, 1, nonce)
+	if !VerifyChallenge(secret, 1, nonce, mac) {
+		t.Fatal("expected the MAC to be valid")
+	}
+
+	other, err := NewNonce()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if VerifyChallenge([]byte("another secret"), 1, nonce, mac) {
+		t.Error("expected the MAC to be invalid with another secret")
+	}
+	if VerifyChallenge(secret, 2, nonce, mac) {
+		t.Error("expected the MAC to be invalid for another agency")
+	}
+	if VerifyChallenge(secret, 1, other, mac) {
+		t.Error("expected the MAC to be invalid for another nonce")
+	}
+}
+
+func TestErrorResponsesAreErrors(t *testing.T) {
+	var err error = &Error{Code: CodeAuthenticationFailed, Message: "unknown agency 9"}
+	var refused *Error
+	if !errors.As(errors.Wrap(err, "authenticate"), &refused) || refused.Code != CodeAuthenticationFailed {
+		t.Fatalf("expected the error response to be found, got %v", err)
+	}
+}
@@ -0,0 +1,199 @@
+// Package faults implements a TCP proxy that forwards the traffic between
+// a client and a server while injecting the faults described by a plan:
+// latency, bandwidth caps, writes split in small chunks, connections
+// dropped after some bytes and corrupted bytes.
+//
+// A plan is usually read from a YAML file such as
+//
+//	listen: 0.0.0.0:12346
+//	upstream: server:12345
+//	faults:
+//	  - direction: upstream
+//	    chunk_size: 1
+//	  - direction: downstream
+//	    connections: [2]
+//	    drop_after: 10
+//	    drop_mode: reset
+package faults
+
+import (
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// Direction Way of the traffic a fault applies to
+type Direction string
+
+const (
+	// Upstream Traffic sent by the client to the server
+	Upstream Direction = "upstream"
+	// Downstream Traffic sent by the server to the client
+	Downstream Direction = "downstream"
+	// Both Traffic sent in any direction
+	Both Direction = "both"
+)
+
+// DropMode How a connection is dropped once DropAfter bytes were forwarded
+type DropMode string
+
+const (
+	// DropClose Both sides of the connection are closed gracefully
+	DropClose DropMode = "close"
+	// DropReset Both sides of the connection are reset
+	DropReset DropMode = "reset"
+	// DropStall The traffic stops being forwarded but the connection is
+	// kept open, like a half-open connection whose peer vanished
+	DropStall DropMode = "stall"
+)
+
+// Fault Faults injected in the traffic that goes in the given direction.
+// Every field left empty disables the corresponding fault
+type Fault struct {
+	// Direction Traffic affected by the fault, Both if empty
+	Direction Direction `yaml:"direction"`
+	// Connections Numbers of the connections affected, starting at 1,
+	// or every connection if empty
+	Connections []int `yaml:"connections"`
+
+	// Latency Time every chunk of data is held before being forwarded
+	Latency time.Duration `yaml:"latency"`
+	// Bandwidth Maximum amount of bytes forwarded per second
+	Bandwidth int `yaml:"bandwidth"`
+	// ChunkSize Maximum amount of bytes forwarded on each write
+	ChunkSize int `yaml:"chunk_size"`
+	// DropAfter Amount of bytes forwarded before the connection is
+	// dropped, nil to never drop it. Zero drops it before forwarding
+	// anything
+	DropAfter *int64 `yaml:"drop_after"`
+	// DropMode How the connection is dropped, DropClose if empty
+	DropMode DropMode `yaml:"drop_mode"`
+	// Corrupt Offsets, starting at 0, of the bytes that are inverted
+	Corrupt []int64 `yaml:"corrupt"`
+}
+
+// Bytes Returns a pointer to n, to set the DropAfter of a Fault
+func Bytes(n int64) *int64 {
+	return &n
+}
+
+// Plan Addresses of the proxy and faults it injects
+type Plan struct {
+	// Listen Address the proxy accepts clients on
+	Listen string `yaml:"listen"`
+	// Upstream Address of the server the traffic is forwarded to
+	Upstream string  `yaml:"upstream"`
+	Faults   []Fault `yaml:"faults"`
+}
+
+// LoadPlan Reads and validates the plan stored in the YAML file
+func LoadPlan(path string) (Plan, error) {
+	var plan Plan
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+	if err := yaml.UnmarshalStrict(data, &plan); err != nil {
+		return plan, errors.Wrapf(err, "could not parse plan %s", path)
+	}
+	return plan, plan.Validate()
+}
+
+// Validate Checks that every fault of the plan is well formed
+func (p Plan) Validate() error {
+	if p.Upstream == "" {
+		return errors.New("the upstream address is missing")
+	}
+	for i, fault := range p.Faults {
+		if err := fault.validate(); err != nil {
+			return errors.Wrapf(err, "fault %d", i+1)
+		}
+	}
+	return nil
+}
+
+func (f Fault) validate() error {
+	switch f.Direction {
+	case "", Upstream, Downstream, Both:
+	default:
+		return errors.Errorf("unknown direction %q", f.Direction)
+	}
+	switch f.DropMode {
+	case "", DropClose, DropReset, DropStall:
+	default:
+		return errors.Errorf("unknown drop mode %q", f.DropMode)
+	}
+	for _, connection := range f.Connections {
+		if connection < 1 {
+			return errors.Errorf("invalid connection number %d", connection)
+		}
+	}
+	if f.Latency < 0 || f.Bandwidth < 0 || f.ChunkSize < 0 || (f.DropAfter != nil && *f.DropAfter < 0) {
+		return errors.New("latency, bandwidth, chunk_size and drop_after can not be negative")
+	}
+	for _, offset := range f.Corrupt {
+		if offset < 0 {
+			return errors.Errorf("invalid corrupt offset %d", offset)
+		}
+	}
+	return nil
+}
+
+// appliesTo Returns true if the fault affects the traffic of the
+// connection in the given direction
+func (f Fault) appliesTo(connection int, direction Direction) bool {
+	if f.Direction != "" && f.Direction != Both && f.Direction != direction {
+		return false
+	}
+	if len(f.Connections) == 0 {
+		return true
+	}
+	for _, number := range f.Connections {
+		if number == connection {
+			return true
+		}
+	}
+	return false
+}
+
+// pipeFaults Faults of a single direction of a connection, the result of
+// merging every fault of the plan that applies to it
+type pipeFaults struct {
+	latency   time.Duration
+	bandwidth int
+	chunkSize int
+	dropAfter int64
+	dropMode  DropMode
+	corrupt   map[int64]bool
+}
+
+// faultsFor Merges the faults that apply to the traffic of the
+// connection in the given direction. Latencies add up, while the
+// strictest bandwidth, chunk size and drop are kept
+func (p Plan) faultsFor(connection int, direction Direction) pipeFaults {
+	merged := pipeFaults{dropAfter: -1, dropMode: DropClose, corrupt: make(map[int64]bool)}
+	for _, fault := range p.Faults {
+		if !fault.appliesTo(connection, direction) {
+			continue
+		}
+		merged.latency += fault.Latency
+		if fault.Bandwidth > 0 && (merged.bandwidth == 0 || fault.Bandwidth < merged.bandwidth) {
+			merged.bandwidth = fault.Bandwidth
+		}
+		if fault.ChunkSize > 0 && (merged.chunkSize == 0 || fault.ChunkSize < merged.chunkSize) {
+			merged.chunkSize = fault.ChunkSize
+		}
+		if fault.DropAfter != nil && (merged.dropAfter < 0 || *fault.DropAfter < merged.dropAfter) {
+			merged.dropAfter = *fault.DropAfter
+			if fault.DropMode != "" {
+				merged.dropMode = fault.DropMode
+			}
+		}
+		for _, offset := range fault.Corrupt {
+			merged.corrupt[offset] = true
+		}
+	}
+	return merged
+}
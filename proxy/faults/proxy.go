@@ -0,0 +1,283 @@
+package faults
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+)
+
+var log = logging.MustGetLogger("log")
+
+// dialTimeout Maximum time spent connecting to the upstream server
+const dialTimeout = 5 * time.Second
+
+// Proxy Accepts clients and forwards their traffic to the upstream
+// server, injecting the faults of the plan. Connections are numbered
+// in the order they are accepted, starting at 1
+type Proxy struct {
+	plan     Plan
+	listener net.Listener
+
+	mu          sync.Mutex
+	accepted    int
+	connections map[net.Conn]struct{}
+	closed      bool
+	handlers    sync.WaitGroup
+}
+
+// NewProxy Validates the plan and starts listening on its address
+func NewProxy(plan Plan) (*Proxy, error) {
+	if err := plan.Validate(); err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", plan.Listen)
+	if err != nil {
+		return nil, err
+	}
+	return &Proxy{
+		plan:        plan,
+		listener:    listener,
+		connections: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Addr Returns the address the proxy is listening on
+func (p *Proxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Run Accepts new clients until Shutdown is called. Each client is
+// handled in its own goroutine
+func (p *Proxy) Run() error {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			if p.isClosed() {
+				p.handlers.Wait()
+				return nil
+			}
+			return err
+		}
+
+		number, ok := p.track(conn)
+		if !ok {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer p.handlers.Done()
+			defer p.untrack(conn)
+			p.handleConnection(number, conn)
+		}()
+	}
+}
+
+// Shutdown Stops accepting clients and closes the connections in
+// progress. Run returns once every connection handler finished
+func (p *Proxy) Shutdown() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return
+	}
+	p.closed = true
+	p.listener.Close()
+	for conn := range p.connections {
+		conn.Close()
+	}
+}
+
+func (p *Proxy) isClosed() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.closed
+}
+
+// track Registers a client connection and returns its number. Returns
+// false if the proxy is shutting down
+func (p *Proxy) track(conn net.Conn) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return 0, false
+	}
+	p.accepted++
+	p.connections[conn] = struct{}{}
+	p.handlers.Add(1)
+	return p.accepted, true
+}
+
+// trackUpstream Registers the connection to the server so Shutdown
+// closes it. Returns false if the proxy is shutting down
+func (p *Proxy) trackUpstream(conn net.Conn) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		return false
+	}
+	p.connections[conn] = struct{}{}
+	return true
+}
+
+func (p *Proxy) untrack(conn net.Conn) {
+	p.mu.Lock()
+	delete(p.connections, conn)
+	p.mu.Unlock()
+	conn.Close()
+}
+
+// handleConnection Connects to the server and forwards the traffic of
+// both directions until both of them finished
+func (p *Proxy) handleConnection(number int, client net.Conn) {
+	server, err := net.DialTimeout("tcp", p.plan.Upstream, dialTimeout)
+	if err != nil {
+		log.Errorf("action: proxy_connection | result: fail | connection: %v | error: %v", number, err)
+		return
+	}
+	if !p.trackUpstream(server) {
+		server.Close()
+		return
+	}
+	defer p.untrack(server)
+	log.Infof("action: proxy_connection | result: success | connection: %v | client: %v", number, client.RemoteAddr())
+
+	link := &link{number: number, client: client, server: server}
+	var pipes sync.WaitGroup
+	pipes.Add(2)
+	go func() {
+		defer pipes.Done()
+		link.forward(client, server, Upstream, p.plan.faultsFor(number, Upstream))
+	}()
+	go func() {
+		defer pipes.Done()
+		link.forward(server, client, Downstream, p.plan.faultsFor(number, Downstream))
+	}()
+	pipes.Wait()
+	log.Infof("action: proxy_connection_closed | result: success | connection: %v", number)
+}
+
+// link Both ends of a proxied connection
+type link struct {
+	number int
+	client net.Conn
+	server net.Conn
+}
+
+// forward Copies the traffic from src to dst applying the faults. Once
+// src is exhausted the write side of dst is closed, so the peer sees the
+// same half close the proxy saw
+func (l *link) forward(src net.Conn, dst net.Conn, direction Direction, faults pipeFaults) {
+	if faults.dropAfter == 0 {
+		l.logDrop(direction, 0, faults.dropMode)
+		l.drop(src, faults.dropMode)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	var offset int64
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			data := buf[:n]
+			drop := false
+			if faults.dropAfter >= 0 && offset+int64(n) >= faults.dropAfter {
+				data = data[:faults.dropAfter-offset]
+				drop = true
+			}
+			faults.corruptBytes(data, offset)
+
+			if faults.latency > 0 {
+				time.Sleep(faults.latency)
+			}
+			if err := faults.write(dst, data); err != nil {
+				return
+			}
+			offset += int64(len(data))
+
+			if drop {
+				l.logDrop(direction, offset, faults.dropMode)
+				l.drop(src, faults.dropMode)
+				return
+			}
+		}
+		if err != nil {
+			if err == io.EOF {
+				if tcp, ok := dst.(*net.TCPConn); ok {
+					tcp.CloseWrite()
+				}
+			}
+			return
+		}
+	}
+}
+
+// logDrop Logs that the connection is dropped after forwarding the given
+// amount of bytes
+func (l *link) logDrop(direction Direction, bytes int64, mode DropMode) {
+	log.Infof("action: inject_drop | result: success | connection: %v | direction: %v | bytes: %v | mode: %v",
+		l.number,
+		direction,
+		bytes,
+		mode,
+	)
+}
+
+// drop Drops the connection following the mode. A stalled direction
+// keeps consuming the traffic of src without forwarding it
+func (l *link) drop(src net.Conn, mode DropMode) {
+	switch mode {
+	case DropStall:
+		io.Copy(io.Discard, src)
+	case DropReset:
+		for _, conn := range []net.Conn{l.client, l.server} {
+			if tcp, ok := conn.(*net.TCPConn); ok {
+				tcp.SetLinger(0)
+			}
+			conn.Close()
+		}
+	default:
+		l.client.Close()
+		l.server.Close()
+	}
+}
+
+// corruptBytes Inverts the bytes of data whose offset in the stream was
+// selected. offset is the position of the first byte of data
+func (f pipeFaults) corruptBytes(data []byte, offset int64) {
+	for i := range data {
+		if f.corrupt[offset+int64(i)] {
+			data[i] = ^data[i]
+		}
+	}
+}
+
+// write Writes data to dst in chunks of at most chunkSize bytes. Each
+// chunk is held as long as it would take to transfer it at the bandwidth
+func (f pipeFaults) write(dst net.Conn, data []byte) error {
+	chunkSize := f.chunkSize
+	if chunkSize == 0 && f.bandwidth > 0 {
+		// Smooth the transfer instead of sending a burst and waiting
+		chunkSize = f.bandwidth/10 + 1
+	}
+	if chunkSize == 0 {
+		chunkSize = len(data)
+	}
+
+	for len(data) > 0 {
+		size := chunkSize
+		if size > len(data) {
+			size = len(data)
+		}
+		if f.bandwidth > 0 {
+			time.Sleep(time.Duration(size) * time.Second / time.Duration(f.bandwidth))
+		}
+		if _, err := dst.Write(data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	return nil
+}
@@ -0,0 +1,309 @@
+package faults
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// upstream Server that echoes everything it receives and records it
+type upstream struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	received bytes.Buffer
+}
+
+func startUpstream(t *testing.T) *upstream {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	u := &upstream{listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				buf := make([]byte, 1024)
+				for {
+					n, err := conn.Read(buf)
+					if n > 0 {
+						u.mu.Lock()
+						u.received.Write(buf[:n])
+						u.mu.Unlock()
+						conn.Write(buf[:n])
+					}
+					if err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return u
+}
+
+func (u *upstream) Received() []byte {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]byte(nil), u.received.Bytes()...)
+}
+
+// waitReceived Waits a while for the server to receive size bytes and
+// returns what it received
+func (u *upstream) waitReceived(size int) []byte {
+	deadline := time.Now().Add(time.Second)
+	for {
+		received := u.Received()
+		if len(received) >= size || time.Now().After(deadline) {
+			return received
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func startProxy(t *testing.T, upstream string, faults ...Fault) string {
+	t.Helper()
+	proxy, err := NewProxy(Plan{Listen: "127.0.0.1:0", Upstream: upstream, Faults: faults})
+	if err != nil {
+		t.Fatalf("could not start proxy: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- proxy.Run() }()
+	t.Cleanup(func() {
+		proxy.Shutdown()
+		if err := <-done; err != nil {
+			t.Errorf("proxy failed: %v", err)
+		}
+	})
+	return proxy.Addr().String()
+}
+
+func dial(t *testing.T, address string) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	return conn
+}
+
+func echo(t *testing.T, conn net.Conn, msg []byte) []byte {
+	t.Helper()
+	if _, err := conn.Write(msg); err != nil {
+		t.Fatalf("could not send: %v", err)
+	}
+	answer := make([]byte, len(msg))
+	if _, err := io.ReadFull(conn, answer); err != nil {
+		t.Fatalf("could not receive: %v", err)
+	}
+	return answer
+}
+
+func TestLoadPlan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	content := `
+listen: 127.0.0.1:0
+upstream: server:12345
+faults:
+  - direction: downstream
+    connections: [2, 3]
+    latency: 150ms
+    chunk_size: 1
+    drop_after: 10
+    drop_mode: stall
+    corrupt: [4]
+`
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := LoadPlan(path)
+	if err != nil {
+		t.Fatalf("could not load plan: %v", err)
+	}
+	fault := plan.Faults[0]
+	if fault.Latency != 150*time.Millisecond || fault.DropMode != DropStall || len(fault.Connections) != 2 || fault.Corrupt[0] != 4 {
+		t.Errorf("unexpected fault %+v", fault)
+	}
+	if !fault.appliesTo(2, Downstream) || fault.appliesTo(1, Downstream) || fault.appliesTo(2, Upstream) {
+		t.Error("the fault applies to the wrong traffic")
+	}
+}
+
+func TestPlanHonoursDroppingBeforeTheFirstByte(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "plan.yaml")
+	content := "upstream: server:12345\nfaults:\n  - direction: upstream\n    drop_after: 0\n  - direction: downstream\n"
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	plan, err := LoadPlan(path)
+	if err != nil {
+		t.Fatalf("could not load plan: %v", err)
+	}
+	if drop := plan.Faults[0].DropAfter; drop == nil || *drop != 0 {
+		t.Fatalf("expected drop_after 0 to be kept, got %v", drop)
+	}
+	if plan.Faults[1].DropAfter != nil {
+		t.Errorf("expected no drop when drop_after is missing, got %v", *plan.Faults[1].DropAfter)
+	}
+	if got := plan.faultsFor(1, Upstream).dropAfter; got != 0 {
+		t.Errorf("expected the upstream to be dropped at once, got %d", got)
+	}
+	if got := plan.faultsFor(1, Downstream).dropAfter; got != -1 {
+		t.Errorf("expected the downstream not to be dropped, got %d", got)
+	}
+}
+
+func TestLoadPlanRejectsInvalidFaults(t *testing.T) {
+	for name, content := range map[string]string{
+		"unknown field":     "upstream: a:1\nfaults:\n  - delay: 1s\n",
+		"unknown direction": "upstream: a:1\nfaults:\n  - direction: sideways\n",
+		"unknown drop mode": "upstream: a:1\nfaults:\n  - drop_after: 1\n    drop_mode: explode\n",
+		"negative drop":     "upstream: a:1\nfaults:\n  - drop_after: -1\n",
+		"missing upstream":  "listen: :0\n",
+	} {
+		path := filepath.Join(t.TempDir(), "plan.yaml")
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadPlan(path); err == nil {
+			t.Errorf("%s: expected the plan to be rejected", name)
+		}
+	}
+}
+
+func TestProxyForwardsWithoutFaults(t *testing.T) {
+	server := startUpstream(t)
+	conn := dial(t, startProxy(t, server.listener.Addr().String()))
+
+	msg := bytes.Repeat([]byte("0123456789"), 10000)
+	if answer := echo(t, conn, msg); !bytes.Equal(answer, msg) {
+		t.Error("the answer differs from the message")
+	}
+}
+
+func TestProxySplitsWritesKeepingTheContent(t *testing.T) {
+	server := startUpstream(t)
+	conn := dial(t, startProxy(t, server.listener.Addr().String(), Fault{ChunkSize: 1}))
+
+	msg := []byte("split in one byte chunks")
+	if answer := echo(t, conn, msg); !bytes.Equal(answer, msg) {
+		t.Errorf("expected %q, got %q", msg, answer)
+	}
+}
+
+func TestProxyAddsLatencyAndCapsBandwidth(t *testing.T) {
+	server := startUpstream(t)
+	address := startProxy(t, server.listener.Addr().String(),
+		Fault{Direction: Upstream, Latency: 100 * time.Millisecond},
+		Fault{Direction: Downstream, Bandwidth: 1000},
+	)
+	conn := dial(t, address)
+
+	start := time.Now()
+	echo(t, conn, make([]byte, 200))
+	// 100ms of latency plus 200 bytes at 1000 bytes per second
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("expected the echo to take at least 300ms, took %v", elapsed)
+	}
+}
+
+func TestProxyCorruptsBytes(t *testing.T) {
+	server := startUpstream(t)
+	conn := dial(t, startProxy(t, server.listener.Addr().String(), Fault{Direction: Downstream, Corrupt: []int64{1, 3}}))
+
+	answer := echo(t, conn, []byte{0, 0, 0, 0})
+	if want := []byte{0, 0xff, 0, 0xff}; !bytes.Equal(answer, want) {
+		t.Errorf("expected %v, got %v", want, answer)
+	}
+	if received := server.Received(); !bytes.Equal(received, []byte{0, 0, 0, 0}) {
+		t.Errorf("expected the request to arrive intact, got %v", received)
+	}
+}
+
+func TestProxyDropsConnections(t *testing.T) {
+	server := startUpstream(t)
+	address := startProxy(t, server.listener.Addr().String(), Fault{Direction: Upstream, DropAfter: Bytes(3)})
+	conn := dial(t, address)
+
+	conn.Write([]byte("hello"))
+	received, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("expected the connection to be closed gracefully, got %v", err)
+	}
+	if len(received) > 3 {
+		t.Errorf("expected at most 3 bytes to be echoed, got %q", received)
+	}
+	if got := server.waitReceived(3); string(got) != "hel" {
+		t.Errorf("expected the server to receive %q, got %q", "hel", got)
+	}
+}
+
+func TestProxyDropsConnectionsImmediately(t *testing.T) {
+	server := startUpstream(t)
+	address := startProxy(t, server.listener.Addr().String(), Fault{Direction: Downstream, DropAfter: Bytes(0)})
+	conn := dial(t, address)
+
+	// Nothing is sent, the proxy closes the connection on its own
+	received, err := io.ReadAll(conn)
+	if err != nil || len(received) != 0 {
+		t.Fatalf("expected the connection to be closed at once, got %q and %v", received, err)
+	}
+}
+
+func TestProxyResetsConnections(t *testing.T) {
+	server := startUpstream(t)
+	address := startProxy(t, server.listener.Addr().String(), Fault{Direction: Upstream, DropAfter: Bytes(1), DropMode: DropReset})
+	conn := dial(t, address)
+
+	conn.Write([]byte("hello"))
+	if _, err := io.ReadAll(conn); err == nil {
+		t.Error("expected the connection to be reset")
+	}
+}
+
+func TestProxyStallsConnections(t *testing.T) {
+	server := startUpstream(t)
+	address := startProxy(t, server.listener.Addr().String(), Fault{Direction: Downstream, DropAfter: Bytes(2), DropMode: DropStall})
+	conn := dial(t, address)
+	conn.SetDeadline(time.Now().Add(200 * time.Millisecond))
+
+	conn.Write([]byte("hello"))
+	received, err := io.ReadAll(conn)
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("expected the read to time out, got %v", err)
+	}
+	if string(received) != "he" {
+		t.Errorf("expected %q before the stall, got %q", "he", received)
+	}
+}
+
+func TestProxyAppliesFaultsToTheSelectedConnections(t *testing.T) {
+	server := startUpstream(t)
+	address := startProxy(t, server.listener.Addr().String(), Fault{Direction: Downstream, Connections: []int{2}, Corrupt: []int64{0}})
+
+	for number, want := range []byte{'a', ^byte('a'), 'a'} {
+		conn := dial(t, address)
+		answer := echo(t, conn, []byte("a"))
+		conn.Close()
+		if answer[0] != want {
+			t.Errorf("connection %d: expected %q, got %q", number+1, want, answer[0])
+		}
+	}
+}
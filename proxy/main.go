@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/op/go-logging"
+	"github.com/spf13/pflag"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/proxy/faults"
+)
+
+var log = logging.MustGetLogger("log")
+
+const usage = `Usage: proxy [flags]
+
+Forwards the traffic between the clients and the server, injecting the
+faults described by the plan file.
+
+Flags:
+`
+
+// InitLogger Receives the log level to be set in go-logging as a string. This method
+// parses the string and set the level to the logger. If the level string is not
+// valid an error is returned
+func InitLogger(logLevel string) error {
+	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:-8s} %{message}`,
+	)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backendLeveled.SetLevel(logLevelCode, "")
+
+	// Set the backends to be used.
+	logging.SetBackend(backendLeveled)
+	return nil
+}
+
+func main() {
+	flags := pflag.NewFlagSet("proxy", pflag.ContinueOnError)
+	flags.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flags.PrintDefaults()
+	}
+	planPath := flags.String("plan", "./plan.yaml", "YAML file with the addresses and the faults to inject")
+	listen := flags.String("listen", "", "address to accept clients on, overrides the one of the plan")
+	upstream := flags.String("upstream", "", "address of the server, overrides the one of the plan")
+	logLevel := flags.String("log-level", "INFO", "log level")
+	if err := flags.Parse(os.Args[1:]); err != nil {
+		if err == pflag.ErrHelp {
+			return
+		}
+		os.Exit(1)
+	}
+
+	if err := InitLogger(*logLevel); err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+
+	plan, err := faults.LoadPlan(*planPath)
+	if *listen != "" {
+		plan.Listen = *listen
+	}
+	if *upstream != "" {
+		plan.Upstream = *upstream
+		err = plan.Validate()
+	}
+	if err != nil {
+		log.Criticalf("action: load_plan | result: fail | file: %s | error: %v", *planPath, err)
+		os.Exit(1)
+	}
+
+	proxy, err := faults.NewProxy(plan)
+	if err != nil {
+		log.Criticalf("action: create_proxy | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("action: create_proxy | result: success | listen: %v | upstream: %v | faults: %v",
+		proxy.Addr(),
+		plan.Upstream,
+		len(plan.Faults),
+	)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infof("action: shutdown | result: in_progress | signal: %v", sig)
+		proxy.Shutdown()
+	}()
+
+	if err := proxy.Run(); err != nil {
+		log.Criticalf("action: run_proxy | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("action: shutdown | result: success")
+}
@@ -1,5 +1,6 @@
 import socket
 import logging
+import threading
 
 
 class Server:
@@ -14,32 +15,45 @@ class Server:
         Dummy Server loop
 
         Server that accept a new connections and establishes a
-        communication with a client. After client with communucation
-        finishes, servers starts to accept new connections again
+        communication with a client. Each client is served in its own
+        thread, so clients that keep their connection open do not block
+        the rest
         """
 
         # TODO: Modify this program to handle signal to graceful shutdown
         # the server
         while True:
             client_sock = self.__accept_new_connection()
-            self.__handle_client_connection(client_sock)
+            threading.Thread(
+                target=self.__handle_client_connection,
+                args=(client_sock,),
+                daemon=True,
+            ).start()
 
     def __handle_client_connection(self, client_sock):
         """
-        Read message from a specific client socket and closes the socket
+        Read newline terminated messages from a specific client socket
+        and echo each one of them until the client closes the socket
 
         If a problem arises in the communication with the client, the
         client socket will also be closed
         """
         try:
-            # TODO: Modify the receive to avoid short-reads
-            msg = client_sock.recv(1024).rstrip().decode('utf-8')
             addr = client_sock.getpeername()
-            logging.info(f'action: receive_message | result: success | ip: {addr[0]} | msg: {msg}')
-            # TODO: Modify the send to avoid short-writes
-            client_sock.send("{}\n".format(msg).encode('utf-8'))
+            # The buffered reader keeps reading until a whole line is
+            # received, so messages split in many segments are not cut
+            with client_sock.makefile('rb') as reader:
+                for line in reader:
+                    # Only the newline that frames the message is removed,
+                    # so the echo is the same message byte by byte
+                    msg = line.rstrip(b'\n').decode('utf-8')
+                    logging.info(f'action: receive_message | result: success | ip: {addr[0]} | msg: {msg}')
+                    # sendall keeps sending until the whole message is written
+                    client_sock.sendall("{}\n".format(msg).encode('utf-8'))
+        except UnicodeDecodeError as e:
+            logging.error(f"action: receive_message | result: fail | error: message is not valid UTF-8: {e}")
         except OSError as e:
-            logging.error("action: receive_message | result: fail | error: {e}")
+            logging.error(f"action: receive_message | result: fail | error: {e}")
         finally:
             client_sock.close()
 
@@ -0,0 +1,105 @@
+package lottery
+
+import (
+	"bufio"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// LoadSecrets Reads the shared secrets of the agencies from a file with
+// one ID=SECRET line per agency. Blank lines and lines starting with #
+// are ignored. Whitespace around the ID and the secret is not part of
+// them, as the agencies trim both ends of their secret too
+func LoadSecrets(path string) (map[int][]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not open the secrets file")
+	}
+	defer file.Close()
+
+	secrets := make(map[int][]byte)
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) == 2 {
+			parts[1] = strings.TrimSpace(parts[1])
+		}
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, errors.Errorf("line %d of %s: expected ID=SECRET", number, path)
+		}
+		id, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+		if err != nil || id < 0 {
+			return nil, errors.Errorf("line %d of %s: invalid agency ID %q", number, path, parts[0])
+		}
+		secrets[id] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, errors.Wrap(err, "could not read the secrets file")
+	}
+	return secrets, nil
+}
+
+// authenticate Runs the HELLO/CHALLENGE/AUTHENTICATE handshake and
+// returns the agency the connection was authenticated for. Agencies
+// restricted by their certificate, allowed >= 0, can only authenticate
+// as themselves
+func (s *Server) authenticate(conn net.Conn, allowed int) (int, error) {
+	agencyID, req, err := protocol.ReadRequest(conn)
+	if err != nil {
+		return 0, err
+	}
+	if _, ok := req.(*protocol.Hello); !ok {
+		return 0, refuse(conn, protocol.CodeNotAuthenticated, "expected %v, got %v", protocol.KindHello, req.Kind())
+	}
+	agency := int(agencyID)
+	secret, ok := s.config.Secrets[agency]
+	if !ok {
+		return 0, refuse(conn, protocol.CodeAuthenticationFailed, "unknown agency %v", agency)
+	}
+	if allowed >= 0 && agency != allowed {
+		return 0, refuse(conn, protocol.CodeAgencyMismatch, "certificate of agency %v", allowed)
+	}
+
+	nonce, err := protocol.NewNonce()
+	if err != nil {
+		return 0, err
+	}
+	if err := protocol.WriteResponse(conn, &protocol.Challenge{Nonce: nonce}); err != nil {
+		return 0, err
+	}
+
+	answerID, req, err := protocol.ReadRequest(conn)
+	if err != nil {
+		return 0, err
+	}
+	answer, ok := req.(*protocol.Authenticate)
+	if !ok {
+		return 0, refuse(conn, protocol.CodeNotAuthenticated, "expected %v, got %v", protocol.KindAuthenticate, req.Kind())
+	}
+	if answerID != agencyID {
+		return 0, refuse(conn, protocol.CodeAgencyMismatch, "agency %v answered the challenge of agency %v", answerID, agency)
+	}
+	if !protocol.VerifyChallenge(secret, agencyID, nonce, answer.MAC) {
+		return 0, refuse(conn, protocol.CodeAuthenticationFailed, "invalid MAC for agency %v", agency)
+	}
+	return agency, protocol.WriteResponse(conn, &protocol.Acknowledge{})
+}
+
+// refuse Answers an ERROR with the code and message, and returns the
+// message as an ErrUnauthorizedAgency. The connection is expected to be
+// closed afterwards, so a failure to write the answer is ignored
+func refuse(conn net.Conn, code protocol.ErrorCode, format string, args ...interface{}) error {
+	err := errors.Wrapf(ErrUnauthorizedAgency, format, args...)
+	protocol.WriteResponse(conn, &protocol.Error{Code: code, Message: err.Error()})
+	return errors.Wrapf(err, "%v", code)
+}
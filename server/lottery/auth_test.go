@@ -0,0 +1,119 @@
+package lottery
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+var testSecrets = map[int][]byte{1: []byte("secret-1"), 2: []byte("secret-2")}
+
+// authenticateTestConn Runs the handshake as the agency with the given
+// secret and returns the answer to the AUTHENTICATE
+func authenticateTestConn(t *testing.T, conn net.Conn, agency uint32, secret []byte) protocol.Response {
+	t.Helper()
+	challenge, ok := exchange(t, conn, agency, &protocol.Hello{}).(*protocol.Challenge)
+	if !ok {
+		t.Fatal("expected a challenge")
+	}
+	mac := protocol.SignChallenge(secret, agency, challenge.Nonce)
+	return exchange(t, conn, agency, &protocol.Authenticate{MAC: mac})
+}
+
+func expectRefused(t *testing.T, res protocol.Response, code protocol.ErrorCode) {
+	t.Helper()
+	if refused, ok := res.(*protocol.Error); !ok || refused.Code != code {
+		t.Fatalf("expected an error %v, got %+v", code, res)
+	}
+}
+
+func TestServerAcceptsBetsOfAuthenticatedAgencies(t *testing.T) {
+	server := startConfiguredTestServer(t, ServerConfig{Agencies: 2, Secrets: testSecrets})
+	conn := dialTestServer(t, server)
+
+	if _, ok := authenticateTestConn(t, conn, 1, testSecrets[1]).(*protocol.Acknowledge); !ok {
+		t.Fatal("expected the agency to be authenticated")
+	}
+	res := exchange(t, conn, 1, &protocol.BetBatch{Bets: []protocol.Bet{testBet("1", "7574")}})
+	if ack, ok := res.(*protocol.Acknowledge); !ok || ack.Count != 1 {
+		t.Fatalf("expected an acknowledge of 1 bet, got %+v", res)
+	}
+}
+
+func TestServerRefusesRequestsBeforeAuthenticating(t *testing.T) {
+	server := startConfiguredTestServer(t, ServerConfig{Agencies: 2, Secrets: testSecrets})
+	conn := dialTestServer(t, server)
+	res := exchange(t, conn, 1, &protocol.BetBatch{Bets: []protocol.Bet{testBet("1", "7574")}})
+	expectRefused(t, res, protocol.CodeNotAuthenticated)
+}
+
+func TestServerRefusesInvalidMACs(t *testing.T) {
+	server := startConfiguredTestServer(t, ServerConfig{Agencies: 2, Secrets: testSecrets})
+
+	expectRefused(t, authenticateTestConn(t, dialTestServer(t, server), 1, testSecrets[2]), protocol.CodeAuthenticationFailed)
+	expectRefused(t, exchange(t, dialTestServer(t, server), 9, &protocol.Hello{}), protocol.CodeAuthenticationFailed)
+}
+
+func TestServerRefusesRequestsOfOtherAgencies(t *testing.T) {
+	server := startConfiguredTestServer(t, ServerConfig{Agencies: 2, Secrets: testSecrets})
+	conn := dialTestServer(t, server)
+
+	if _, ok := authenticateTestConn(t, conn, 1, testSecrets[1]).(*protocol.Acknowledge); !ok {
+		t.Fatal("expected the agency to be authenticated")
+	}
+	expectRefused(t, exchange(t, conn, 2, &protocol.BetBatchEnd{}), protocol.CodeAgencyMismatch)
+	if _, err := protocol.ReadResponse(conn); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+func TestServerClosesConnectionsThatDoNotAuthenticateInTime(t *testing.T) {
+	server := startConfiguredTestServer(t, ServerConfig{Agencies: 2, Secrets: testSecrets, HandshakeTimeout: 50 * time.Millisecond})
+
+	silent := dialTestServer(t, server)
+	silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(silent); err != nil {
+		t.Fatalf("expected the silent connection to be closed, got %v", err)
+	}
+
+	// Once authenticated the connection may stay idle
+	conn := dialTestServer(t, server)
+	if _, ok := authenticateTestConn(t, conn, 1, testSecrets[1]).(*protocol.Acknowledge); !ok {
+		t.Fatal("expected the agency to be authenticated")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := exchange(t, conn, 1, &protocol.BetBatch{Bets: []protocol.Bet{testBet("1", "7574")}}).(*protocol.Acknowledge); !ok {
+		t.Fatal("expected the bets of the idle agency to be acknowledged")
+	}
+}
+
+func TestLoadSecrets(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secrets")
+	content := "# agencies\n1=secret-1\n\n2=secret=2\n3 = secret 3 \n"
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	secrets, err := LoadSecrets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := map[int][]byte{1: []byte("secret-1"), 2: []byte("secret=2"), 3: []byte("secret 3")}
+	if !reflect.DeepEqual(secrets, expected) {
+		t.Fatalf("expected %q, got %q", expected, secrets)
+	}
+
+	for _, content := range []string{"1\n", "one=secret\n", "1=\n", "1 =  \n"} {
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadSecrets(path); err == nil {
+			t.Errorf("expected %q to be rejected", content)
+		}
+	}
+}
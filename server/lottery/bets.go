@@ -0,0 +1,129 @@
+package lottery
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+const (
+	// DefaultStorageFilepath Bets storage location
+	DefaultStorageFilepath = "./bets.csv"
+	// LotteryWinnerNumber Simulated winner number in the lottery contest
+	LotteryWinnerNumber = 7574
+
+	birthdateLayout = "2006-01-02"
+)
+
+// Bet A lottery bet registry
+type Bet struct {
+	Agency    int
+	FirstName string
+	LastName  string
+	Document  string
+	Birthdate time.Time
+	Number    int
+}
+
+// NewBet Builds a bet of the given agency from the fields received
+// through the wire. The birthdate must have the format YYYY-MM-DD and
+// the number must be an integer
+func NewBet(agency int, bet protocol.Bet) (Bet, error) {
+	birthdate, err := time.Parse(birthdateLayout, bet.Birthdate)
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid birthdate %q", bet.Birthdate)
+	}
+	number, err := strconv.Atoi(bet.Number)
+	if err != nil {
+		return Bet{}, errors.Wrapf(err, "invalid number %q", bet.Number)
+	}
+	return Bet{
+		Agency:    agency,
+		FirstName: bet.FirstName,
+		LastName:  bet.LastName,
+		Document:  bet.Document,
+		Birthdate: birthdate,
+		Number:    number,
+	}, nil
+}
+
+// HasWon Checks whether a bet won the prize or not
+func HasWon(bet Bet) bool {
+	return bet.Number == LotteryWinnerNumber
+}
+
+// StoreBets Persists the information of each bet in the given file,
+// synced to disk before returning. Not thread-safe
+func StoreBets(path string, bets []Bet) error {
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := csv.NewWriter(file)
+	for _, bet := range bets {
+		record := []string{
+			strconv.Itoa(bet.Agency),
+			bet.FirstName,
+			bet.LastName,
+			bet.Document,
+			bet.Birthdate.Format(birthdateLayout),
+			strconv.Itoa(bet.Number),
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		return err
+	}
+	return file.Sync()
+}
+
+// LoadBets Loads the information of all the bets in the given file and
+// calls fn with each one of them. Not thread-safe
+func LoadBets(path string, fn func(Bet)) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = 6
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		agency, err := strconv.Atoi(record[0])
+		if err != nil {
+			return errors.Wrapf(err, "invalid agency %q", record[0])
+		}
+		bet, err := NewBet(agency, protocol.Bet{
+			FirstName: record[1],
+			LastName:  record[2],
+			Document:  record[3],
+			Birthdate: record[4],
+			Number:    record[5],
+		})
+		if err != nil {
+			return err
+		}
+		fn(bet)
+	}
+}
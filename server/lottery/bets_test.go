@@ -0,0 +1,74 @@
+package lottery
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+func TestNewBetMustKeepFields(t *testing.T) {
+	bet, err := NewBet(1, protocol.Bet{
+		FirstName: "first",
+		LastName:  "last",
+		Document:  "10000000",
+		Birthdate: "2000-12-20",
+		Number:    "7500",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	expected := Bet{
+		Agency:    1,
+		FirstName: "first",
+		LastName:  "last",
+		Document:  "10000000",
+		Birthdate: time.Date(2000, 12, 20, 0, 0, 0, 0, time.UTC),
+		Number:    7500,
+	}
+	if !reflect.DeepEqual(expected, bet) {
+		t.Fatalf("expected %+v, got %+v", expected, bet)
+	}
+}
+
+func TestNewBetRejectsInvalidFields(t *testing.T) {
+	invalid := []protocol.Bet{
+		{Birthdate: "20-12-2000", Number: "7500"},
+		{Birthdate: "2000-12-20", Number: "seven"},
+	}
+	for _, bet := range invalid {
+		if _, err := NewBet(1, bet); err == nil {
+			t.Errorf("expected an error for %+v", bet)
+		}
+	}
+}
+
+func TestHasWon(t *testing.T) {
+	if !HasWon(Bet{Number: LotteryWinnerNumber}) {
+		t.Error("bet with the winner number must win")
+	}
+	if HasWon(Bet{Number: LotteryWinnerNumber + 1}) {
+		t.Error("bet without the winner number must not win")
+	}
+}
+
+func TestStoreBetsAndLoadBetsKeepsFieldsData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	stored := []Bet{
+		{Agency: 1, FirstName: "first", LastName: "last, jr", Document: "10000000", Birthdate: time.Date(2000, 12, 20, 0, 0, 0, 0, time.UTC), Number: 7500},
+		{Agency: 2, FirstName: "Álvaro", LastName: "Núñez", Document: "20000000", Birthdate: time.Date(1990, 1, 2, 0, 0, 0, 0, time.UTC), Number: 7574},
+	}
+	if err := StoreBets(path, stored); err != nil {
+		t.Fatalf("could not store bets: %v", err)
+	}
+
+	var loaded []Bet
+	if err := LoadBets(path, func(bet Bet) { loaded = append(loaded, bet) }); err != nil {
+		t.Fatalf("could not load bets: %v", err)
+	}
+	if !reflect.DeepEqual(stored, loaded) {
+		t.Fatalf("expected %+v, got %+v", stored, loaded)
+	}
+}
@@ -0,0 +1,46 @@
+//go:build linux
+// +build linux
+
+package lottery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+)
+
+// listen Creates the server socket on the given IPv4 address, or on all
+// the interfaces if it is empty. The socket is created by hand since the
+// net package does not allow choosing the listen backlog
+func listen(host string, port int, backlog int) (net.Listener, error) {
+	addr := &syscall.SockaddrInet4{Port: port}
+	if host != "" {
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IPv4 address %q", host)
+		}
+		copy(addr.Addr[:], ip)
+	}
+
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setsockopt", err)
+	}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("listen", err)
+	}
+
+	file := os.NewFile(uintptr(fd), "server")
+	defer file.Close()
+	return net.FileListener(file)
+}
@@ -0,0 +1,16 @@
+//go:build !linux
+// +build !linux
+
+package lottery
+
+import (
+	"net"
+	"strconv"
+)
+
+// listen Creates the server socket on the given IPv4 address, or on all
+// the interfaces if it is empty. The listen backlog is chosen by the
+// runtime on this platform
+func listen(host string, port int, backlog int) (net.Listener, error) {
+	return net.Listen("tcp4", net.JoinHostPort(host, strconv.Itoa(port)))
+}
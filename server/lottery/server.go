@@ -0,0 +1,316 @@
+package lottery
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+var log = logging.MustGetLogger("log")
+
+// ServerConfig Configuration used by the server
+type ServerConfig struct {
+	// Host IPv4 address the server listens on, empty for all interfaces
+	Host          string
+	Port          int
+	ListenBacklog int
+	Agencies      int
+	StoragePath   string
+
+	// TLS Secures the connections of the agencies, plain TCP is used if nil
+	TLS *tls.Config
+	// CertificateAgencies Maps the common name of the agency certificates
+	// to the only agency ID they may send requests under. When set, every
+	// agency must present a known certificate
+	CertificateAgencies map[string]int
+	// Secrets Shared secret of each agency. When set, every connection
+	// must authenticate with a HELLO before sending other requests
+	Secrets map[int][]byte
+	// HandshakeTimeout Time a connection has to complete the TLS handshake
+	// and the authentication, DefaultHandshakeTimeout if zero
+	HandshakeTimeout time.Duration
+}
+
+// DefaultHandshakeTimeout Time a connection has to complete the TLS
+// handshake and the authentication when none is configured
+const DefaultHandshakeTimeout = 10 * time.Second
+
+// Server Accepts the connections of the agencies and runs the protocol
+// with each one of them in its own goroutine
+type Server struct {
+	config   ServerConfig
+	listener net.Listener
+	storage  *Storage
+
+	mu          sync.Mutex
+	connections map[net.Conn]struct{}
+	closed      bool
+	handlers    sync.WaitGroup
+}
+
+// NewServer Initializes the server socket and the bets storage
+func NewServer(config ServerConfig) (*Server, error) {
+	listener, err := listen(config.Host, config.Port, config.ListenBacklog)
+	if err != nil {
+		return nil, err
+	}
+	storage, err := NewStorage(config.StoragePath, config.Agencies)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	if config.TLS != nil {
+		listener = tls.NewListener(listener, config.TLS)
+	}
+	return &Server{
+		config:      config,
+		listener:    listener,
+		storage:     storage,
+		connections: make(map[net.Conn]struct{}),
+	}, nil
+}
+
+// Storage Returns the storage holding the state shared by the connections
+func (s *Server) Storage() *Storage {
+	return s.storage
+}
+
+// Addr Returns the address the server is listening on
+func (s *Server) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+// Run Accepts new connections until Shutdown is called. Each connection
+// is handled in its own goroutine
+func (s *Server) Run() error {
+	for {
+		log.Infof("action: accept_connections | result: in_progress")
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if s.isClosed() {
+				s.handlers.Wait()
+				s.storage.Close()
+				return nil
+			}
+			return err
+		}
+		log.Infof("action: accept_connections | result: success | ip: %v", remoteIP(conn))
+
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
+		go func() {
+			defer s.untrack(conn)
+			s.handleConnection(conn)
+		}()
+	}
+}
+
+// Shutdown Stops accepting connections and closes the ones in progress.
+// Run returns once every connection handler finished
+func (s *Server) Shutdown() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.connections {
+		conn.Close()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) track(conn net.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.connections[conn] = struct{}{}
+	s.handlers.Add(1)
+	return true
+}
+
+func (s *Server) untrack(conn net.Conn) {
+	s.mu.Lock()
+	delete(s.connections, conn)
+	s.mu.Unlock()
+	conn.Close()
+	s.handlers.Done()
+}
+
+// handleConnection Reads requests from the connection and answers them
+// until the agency closes it, sends a BET_BATCH_END or a problem arises.
+// Requests sent under an ID other than the one the connection was
+// authenticated for, by certificate or by HELLO, are answered with an
+// ERROR and close the connection
+func (s *Server) handleConnection(conn net.Conn) {
+	ip := remoteIP(conn)
+	allowed, err := s.handshake(conn, ip)
+	if err != nil {
+		return
+	}
+
+	for {
+		agencyID, req, err := protocol.ReadRequest(conn)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			if !s.isClosed() {
+				log.Errorf("action: receive_message | result: fail | ip: %v | error: %v", ip, err)
+			}
+			return
+		}
+		if allowed >= 0 && int(agencyID) != allowed {
+			err := refuse(conn, protocol.CodeAgencyMismatch, "connection of agency %v", allowed)
+			log.Errorf("action: authorize | result: fail | ip: %v | agency: %v | error: %v", ip, agencyID, err)
+			return
+		}
+
+		keepOpen, err := s.handleRequest(conn, int(agencyID), req)
+		if err != nil {
+			log.Errorf("action: handle_message | result: fail | ip: %v | agency: %v | kind: %v | error: %v",
+				ip,
+				agencyID,
+				req.Kind(),
+				err,
+			)
+			return
+		}
+		if !keepOpen {
+			return
+		}
+	}
+}
+
+// handshake Completes the TLS handshake and authenticates the agency, if
+// the server requires them, within the handshake timeout so a peer that
+// stays silent does not hold the connection. Returns the agency the
+// connection is restricted to, or -1 if any agency may use it
+func (s *Server) handshake(conn net.Conn, ip string) (int, error) {
+	_, secured := conn.(*tls.Conn)
+	if !secured && len(s.config.Secrets) == 0 {
+		return -1, nil
+	}
+	timeout := s.config.HandshakeTimeout
+	if timeout <= 0 {
+		timeout = DefaultHandshakeTimeout
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return 0, err
+	}
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		if err := tlsConn.Handshake(); err != nil {
+			log.Errorf("action: authorize | result: fail | ip: %v | error: %v", ip, errors.Wrap(err, "TLS handshake failed"))
+			return 0, err
+		}
+	}
+	allowed, err := s.certificateAgency(conn)
+	if err != nil {
+		log.Errorf("action: authorize | result: fail | ip: %v | error: %v", ip, err)
+		return 0, err
+	}
+	if len(s.config.Secrets) > 0 {
+		if allowed, err = s.authenticate(conn, allowed); err != nil {
+			if !s.isClosed() {
+				log.Errorf("action: authenticate | result: fail | ip: %v | error: %v", ip, err)
+			}
+			return 0, err
+		}
+		log.Infof("action: authenticate | result: success | ip: %v | agency: %v", ip, allowed)
+	}
+	return allowed, conn.SetDeadline(time.Time{})
+}
+
+// rejectBet Answers a request that holds an invalid bet with an ERROR, so
+// the agency does not send it again
+func rejectBet(conn net.Conn, err error) error {
+	protocol.WriteResponse(conn, &protocol.Error{Code: protocol.CodeInvalidBet, Message: err.Error()})
+	return errors.Wrapf(err, "%v", protocol.CodeInvalidBet)
+}
+
+// handleRequest Answers a single request. Returns false when the
+// connection must be closed after the request
+func (s *Server) handleRequest(conn net.Conn, agency int, req protocol.Request) (bool, error) {
+	switch req := req.(type) {
+	case *protocol.PostBet:
+		bet, err := NewBet(agency, req.Bet)
+		if err != nil {
+			log.Errorf("action: apuesta_almacenada | result: fail | error: %v", err)
+			return false, rejectBet(conn, err)
+		}
+		if err := s.storage.StoreBets([]Bet{bet}); err != nil {
+			return false, err
+		}
+		log.Infof("action: apuesta_almacenada | result: success | dni: %v | numero: %v", bet.Document, bet.Number)
+		return true, protocol.WriteResponse(conn, &protocol.Acknowledge{Count: 1})
+
+	case *protocol.BetBatch:
+		bets := make([]Bet, 0, len(req.Bets))
+		for _, received := range req.Bets {
+			bet, err := NewBet(agency, received)
+			if err != nil {
+				log.Errorf("action: apuesta_recibida | result: fail | cantidad: %v", len(req.Bets))
+				return false, rejectBet(conn, errors.Wrapf(err, "bet %d", len(bets)))
+			}
+			bets = append(bets, bet)
+		}
+		stored, err := s.storage.StoreBatch(agency, req.Upload, req.Sequence, bets)
+		if err != nil {
+			return false, err
+		}
+		if stored {
+			log.Infof("action: apuesta_recibida | result: success | cantidad: %v", len(bets))
+		} else {
+			log.Infof("action: apuesta_recibida | result: duplicate | agency: %v | upload: %v | sequence: %v | cantidad: %v", agency, req.Upload, req.Sequence, len(bets))
+		}
+		return true, protocol.WriteResponse(conn, &protocol.Acknowledge{Count: uint32(len(bets))})
+
+	case *protocol.BetBatchEnd:
+		if err := s.storage.FinishAgency(agency); err != nil {
+			return false, err
+		}
+		log.Infof("action: batch_end | result: success | agency: %v", agency)
+		return false, protocol.WriteResponse(conn, &protocol.Acknowledge{})
+
+	case *protocol.GetWinners:
+		documents, ready, err := s.storage.Winners(agency)
+		if err != nil {
+			return false, err
+		}
+		if !ready {
+			return true, protocol.WriteResponse(conn, &protocol.Acknowledge{})
+		}
+		if err := protocol.WriteResponse(conn, &protocol.WinnersReady{}); err != nil {
+			return false, err
+		}
+		return true, protocol.WriteResponse(conn, &protocol.BettingResults{Documents: documents})
+
+	default:
+		return false, errors.Wrapf(protocol.ErrUnexpectedMessage, "kind %v", req.Kind())
+	}
+}
+
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return conn.RemoteAddr().String()
+}
@@ -0,0 +1,147 @@
+package lottery
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+func startTestServer(t *testing.T, agencies int) *Server {
+	t.Helper()
+	return startConfiguredTestServer(t, ServerConfig{Agencies: agencies})
+}
+
+// startConfiguredTestServer Starts a server with the given configuration,
+// storing its bets in a temporary file
+func startConfiguredTestServer(t *testing.T, config ServerConfig) *Server {
+	t.Helper()
+	config.ListenBacklog = 5
+	config.StoragePath = filepath.Join(t.TempDir(), "bets.csv")
+	server, err := NewServer(config)
+	if err != nil {
+		t.Fatalf("could not start server: %v", err)
+	}
+	go server.Run()
+	t.Cleanup(server.Shutdown)
+	return server
+}
+
+func dialTestServer(t *testing.T, server *Server) net.Conn {
+	t.Helper()
+	port := server.Addr().(*net.TCPAddr).Port
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func exchange(t *testing.T, conn net.Conn, agency uint32, req protocol.Request) protocol.Response {
+	t.Helper()
+	if err := protocol.WriteRequest(conn, agency, req); err != nil {
+		t.Fatalf("could not send %v: %v", req.Kind(), err)
+	}
+	res, err := protocol.ReadResponse(conn)
+	if err != nil {
+		t.Fatalf("could not receive the answer to %v: %v", req.Kind(), err)
+	}
+	return res
+}
+
+func testBet(document string, number string) protocol.Bet {
+	return protocol.Bet{
+		FirstName: "first",
+		LastName:  "last",
+		Document:  document,
+		Birthdate: "2000-12-20",
+		Number:    number,
+	}
+}
+
+func TestServerAnswersWinnersAfterAllAgenciesFinish(t *testing.T) {
+	server := startTestServer(t, 2)
+
+	agencies := map[uint32][]protocol.Bet{
+		1: {testBet("1", "7574"), testBet("2", "1")},
+		2: {testBet("3", "2"), testBet("4", "7574"), testBet("5", "7574")},
+	}
+	for agency, bets := range agencies {
+		conn := dialTestServer(t, server)
+		res := exchange(t, conn, agency, &protocol.BetBatch{Bets: bets})
+		if ack, ok := res.(*protocol.Acknowledge); !ok || ack.Count != uint32(len(bets)) {
+			t.Fatalf("expected an acknowledge of %d bets, got %+v", len(bets), res)
+		}
+
+		query := dialTestServer(t, server)
+		if _, ok := exchange(t, query, agency, &protocol.GetWinners{}).(*protocol.Acknowledge); !ok {
+			t.Fatal("expected winners to be pending before the draw")
+		}
+
+		if _, ok := exchange(t, conn, agency, &protocol.BetBatchEnd{}).(*protocol.Acknowledge); !ok {
+			t.Fatal("expected an acknowledge of the batch end")
+		}
+	}
+
+	expected := map[uint32][]string{1: {"1"}, 2: {"4", "5"}}
+	for agency, documents := range expected {
+		conn := dialTestServer(t, server)
+		if _, ok := exchange(t, conn, agency, &protocol.GetWinners{}).(*protocol.WinnersReady); !ok {
+			t.Fatal("expected winners to be ready after the draw")
+		}
+		res, err := protocol.ReadResponse(conn)
+		if err != nil {
+			t.Fatalf("could not receive the betting results: %v", err)
+		}
+		results, ok := res.(*protocol.BettingResults)
+		if !ok || !reflect.DeepEqual(results.Documents, documents) {
+			t.Fatalf("agency %d: expected winners %v, got %+v", agency, documents, res)
+		}
+	}
+}
+
+func TestServerAcknowledgesDuplicateBatchesWithoutStoringThem(t *testing.T) {
+	server := startTestServer(t, 2)
+	conn := dialTestServer(t, server)
+
+	batches := []*protocol.BetBatch{
+		{Upload: 1, Sequence: 1, Bets: []protocol.Bet{testBet("1", "1"), testBet("2", "2")}},
+		{Upload: 1, Sequence: 1, Bets: []protocol.Bet{testBet("1", "1"), testBet("2", "2")}},
+		{Upload: 1, Sequence: 2, Bets: []protocol.Bet{testBet("3", "3")}},
+		{Upload: 1, Sequence: 1, Bets: []protocol.Bet{testBet("1", "1"), testBet("2", "2")}},
+		// A new upload numbers its batches from 1 again
+		{Upload: 2, Sequence: 1, Bets: []protocol.Bet{testBet("5", "5")}},
+	}
+	for _, batch := range batches {
+		res := exchange(t, conn, 1, batch)
+		if ack, ok := res.(*protocol.Acknowledge); !ok || ack.Count != uint32(len(batch.Bets)) {
+			t.Fatalf("expected an acknowledge of %d bets, got %+v", len(batch.Bets), res)
+		}
+	}
+	// Sequences are scoped to the agency
+	exchange(t, dialTestServer(t, server), 2, &protocol.BetBatch{Upload: 1, Sequence: 1, Bets: []protocol.Bet{testBet("4", "4")}})
+
+	var documents []string
+	if err := LoadBets(server.config.StoragePath, func(bet Bet) { documents = append(documents, bet.Document) }); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"1", "2", "3", "5", "4"}; !reflect.DeepEqual(documents, expected) {
+		t.Fatalf("expected the bets %v to be stored once, got %v", expected, documents)
+	}
+}
+
+func TestServerRefusesBatchesWithInvalidBets(t *testing.T) {
+	server := startTestServer(t, 1)
+	conn := dialTestServer(t, server)
+
+	batch := &protocol.BetBatch{Upload: 1, Sequence: 1, Bets: []protocol.Bet{testBet("1", "1"), testBet("2", "seven")}}
+	expectRefused(t, exchange(t, conn, 1, batch), protocol.CodeInvalidBet)
+	if _, err := os.Stat(server.config.StoragePath); !os.IsNotExist(err) {
+		t.Fatalf("expected no bet to be stored, got %v", err)
+	}
+}
@@ -0,0 +1,317 @@
+package lottery
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// ErrStorageClosed The storage was closed and no longer accepts operations
+var ErrStorageClosed = errors.New("storage closed")
+
+// Storage Owns all the state shared between the connections: the bets
+// file, the last batch applied of each upload, the agencies that
+// finished sending their bets and the winners of the draw. Every
+// operation is executed by a single goroutine, so the accesses to the
+// state are serialized without locks
+type Storage struct {
+	path     string
+	agencies int
+
+	// applied Highest sequence number stored of each upload
+	applied map[uploadKey]uint64
+	// size Size of the bets file once the last write was committed
+	size     int64
+	finished map[int]bool
+	winners  map[int][]string
+	drawn    bool
+
+	operations chan func()
+	done       chan struct{}
+}
+
+// uploadKey Identifies an upload of the bets of an agency
+type uploadKey struct {
+	agency int
+	upload uint64
+}
+
+// appliedBatch Highest sequence number stored of an upload, as saved in
+// the state file
+type appliedBatch struct {
+	Agency   int    `json:"agency"`
+	Upload   uint64 `json:"upload"`
+	Sequence uint64 `json:"sequence"`
+}
+
+// storageState Part of the state of the storage that must survive a
+// restart, committed to the state file after every write to the bets file
+type storageState struct {
+	// Size Size of the bets file once the last write was committed
+	Size int64 `json:"size"`
+	// Applied Highest sequence number stored of each upload
+	Applied []appliedBatch `json:"applied"`
+}
+
+// stateFilePath Returns the path of the file that holds the state
+// committed along with the bets file at path
+func stateFilePath(path string) string {
+	return path + ".state.json"
+}
+
+// NewStorage Initializes the storage of the bets in the given file. The
+// draw is made once the given amount of agencies finished sending bets.
+// The sequences applied before a restart are loaded from the state file,
+// and bets written after its last commit are discarded, since the agency
+// never got their ACKNOWLEDGE and sends them again
+func NewStorage(path string, agencies int) (*Storage, error) {
+	s := &Storage{
+		path:       path,
+		agencies:   agencies,
+		applied:    make(map[uploadKey]uint64),
+		finished:   make(map[int]bool),
+		winners:    make(map[int][]string),
+		operations: make(chan func()),
+		done:       make(chan struct{}),
+	}
+	if err := s.recover(); err != nil {
+		return nil, err
+	}
+	go s.run()
+	return s, nil
+}
+
+// recover Loads the state committed by a previous run and truncates the
+// bets file to the size it had then
+func (s *Storage) recover() error {
+	info, err := os.Stat(s.path)
+	if os.IsNotExist(err) {
+		info, err = nil, nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not inspect the bets file")
+	}
+
+	content, err := os.ReadFile(stateFilePath(s.path))
+	if os.IsNotExist(err) {
+		// Bets stored before the state file existed are kept as they are
+		if info != nil {
+			s.size = info.Size()
+		}
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read the storage state")
+	}
+	var state storageState
+	if err := json.Unmarshal(content, &state); err != nil {
+		return errors.Wrapf(err, "could not decode the storage state %s", stateFilePath(s.path))
+	}
+	for _, batch := range state.Applied {
+		s.applied[uploadKey{agency: batch.Agency, upload: batch.Upload}] = batch.Sequence
+	}
+	s.size = state.Size
+
+	var size int64
+	if info != nil {
+		size = info.Size()
+	}
+	if size < s.size {
+		return errors.Errorf("bets file %s has %d bytes but %d were committed", s.path, size, s.size)
+	}
+	if size > s.size {
+		log.Warningf("action: recover_storage | result: in_progress | discarded_bytes: %v", size-s.size)
+		if err := os.Truncate(s.path, s.size); err != nil {
+			return errors.Wrap(err, "could not discard the uncommitted bets")
+		}
+	}
+	return nil
+}
+
+// commit Saves the state after a write to the bets file. Bets written
+// but not committed are discarded by the next NewStorage. Must be called
+// from the storage goroutine
+func (s *Storage) commit() error {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return errors.Wrap(err, "could not inspect the bets file")
+	}
+	state := storageState{Size: info.Size(), Applied: make([]appliedBatch, 0, len(s.applied))}
+	for key, sequence := range s.applied {
+		state.Applied = append(state.Applied, appliedBatch{Agency: key.agency, Upload: key.upload, Sequence: sequence})
+	}
+	content, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(stateFilePath(s.path), content); err != nil {
+		return errors.Wrap(err, "could not save the storage state")
+	}
+	s.size = info.Size()
+	return nil
+}
+
+// write Appends the bets to the bets file and commits them. On failure
+// the bets file is truncated to the size of the last commit, so the bets
+// are not committed by a later write. Must be called from the storage
+// goroutine
+func (s *Storage) write(bets []Bet) error {
+	err := StoreBets(s.path, bets)
+	if err == nil {
+		err = s.commit()
+	}
+	if err != nil {
+		if truncateErr := os.Truncate(s.path, s.size); truncateErr != nil && !os.IsNotExist(truncateErr) {
+			log.Errorf("action: discard_bets | result: fail | error: %v", truncateErr)
+		}
+	}
+	return err
+}
+
+// writeFileAtomic Writes the content to a temporary file that replaces
+// the one at path once it is synced
+func writeFileAtomic(path string, content []byte) error {
+	file, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	if _, err := file.Write(content); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file.Name(), path)
+}
+
+func (s *Storage) run() {
+	for {
+		select {
+		case operation := <-s.operations:
+			operation()
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// execute Runs the operation in the storage goroutine and waits for it
+// to finish
+func (s *Storage) execute(operation func()) error {
+	finished := make(chan struct{})
+	select {
+	case s.operations <- func() {
+		operation()
+		close(finished)
+	}:
+	case <-s.done:
+		return ErrStorageClosed
+	}
+	<-finished
+	return nil
+}
+
+// Close Stops the storage goroutine. Operations issued afterwards fail
+// with ErrStorageClosed
+func (s *Storage) Close() {
+	close(s.done)
+}
+
+// StoreBets Persists the bets
+func (s *Storage) StoreBets(bets []Bet) error {
+	var err error
+	if closedErr := s.execute(func() {
+		err = s.write(bets)
+	}); closedErr != nil {
+		return closedErr
+	}
+	return err
+}
+
+// StoreBatch Persists the bets of a batch of an upload of the agency,
+// unless a batch of the same upload with the same or a higher sequence
+// number was already stored. Returns false for those duplicates. A zero
+// sequence is always stored. The bets and the sequence are committed
+// together, so a batch stored right before a crash is not stored again
+// when it is retransmitted
+func (s *Storage) StoreBatch(agency int, upload uint64, sequence uint64, bets []Bet) (bool, error) {
+	key := uploadKey{agency: agency, upload: upload}
+	var stored bool
+	var err error
+	if closedErr := s.execute(func() {
+		if sequence != 0 && sequence <= s.applied[key] {
+			return
+		}
+		previous, applied := s.applied[key]
+		if sequence != 0 {
+			s.applied[key] = sequence
+		}
+		if err = s.write(bets); err != nil {
+			// The bets were discarded, so the batch is not applied
+			if sequence != 0 {
+				s.applied[key] = previous
+				if !applied {
+					delete(s.applied, key)
+				}
+			}
+			return
+		}
+		stored = true
+	}); closedErr != nil {
+		return false, closedErr
+	}
+	return stored, err
+}
+
+// FinishAgency Registers that the agency sent all of its bets. Once all
+// the agencies did so the draw is made
+func (s *Storage) FinishAgency(agency int) error {
+	var err error
+	if closedErr := s.execute(func() {
+		s.finished[agency] = true
+		if !s.drawn && len(s.finished) >= s.agencies {
+			err = s.draw()
+		}
+	}); closedErr != nil {
+		return closedErr
+	}
+	return err
+}
+
+// Winners Returns the documents of the winners of the agency. The second
+// value is false while the draw was not made yet
+func (s *Storage) Winners(agency int) ([]string, bool, error) {
+	var documents []string
+	var drawn bool
+	err := s.execute(func() {
+		drawn = s.drawn
+		documents = append(documents, s.winners[agency]...)
+	})
+	return documents, drawn, err
+}
+
+// draw Loads all the stored bets and keeps the winners of each agency.
+// Must be called from the storage goroutine
+func (s *Storage) draw() error {
+	winners := make(map[int][]string)
+	err := LoadBets(s.path, func(bet Bet) {
+		if HasWon(bet) {
+			winners[bet.Agency] = append(winners[bet.Agency], bet.Document)
+		}
+	})
+	if err != nil {
+		return errors.Wrap(err, "could not load bets")
+	}
+	s.winners = winners
+	s.drawn = true
+	log.Infof("action: sorteo | result: success")
+	return nil
+}
@@ -0,0 +1,162 @@
+package lottery
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func testStoredBet(agency int, document string) Bet {
+	return Bet{
+		Agency:    agency,
+		FirstName: "first",
+		LastName:  "last",
+		Document:  document,
+		Birthdate: time.Date(2000, 12, 20, 0, 0, 0, 0, time.UTC),
+		Number:    7500,
+	}
+}
+
+func storedDocuments(t *testing.T, path string) []string {
+	t.Helper()
+	var documents []string
+	if err := LoadBets(path, func(bet Bet) { documents = append(documents, bet.Document) }); err != nil {
+		t.Fatal(err)
+	}
+	return documents
+}
+
+func TestStorageRemembersAppliedBatchesAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	storage, err := NewStorage(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := storage.StoreBatch(1, 7, 1, []Bet{testStoredBet(1, "1")}); err != nil || !stored {
+		t.Fatalf("expected the batch to be stored, got %v and %v", stored, err)
+	}
+	storage.Close()
+
+	// The ACKNOWLEDGE was lost in the restart, so the batch is sent again
+	storage, err = NewStorage(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if stored, err := storage.StoreBatch(1, 7, 1, []Bet{testStoredBet(1, "1")}); err != nil || stored {
+		t.Fatalf("expected the retransmission to be recognized, got %v and %v", stored, err)
+	}
+	if stored, err := storage.StoreBatch(1, 7, 2, []Bet{testStoredBet(1, "2")}); err != nil || !stored {
+		t.Fatalf("expected the next batch to be stored, got %v and %v", stored, err)
+	}
+	// The agency uploads its bets again from scratch
+	if stored, err := storage.StoreBatch(1, 8, 1, []Bet{testStoredBet(1, "3")}); err != nil || !stored {
+		t.Fatalf("expected the batch of a new upload to be stored, got %v and %v", stored, err)
+	}
+	if documents := storedDocuments(t, path); !reflect.DeepEqual(documents, []string{"1", "2", "3"}) {
+		t.Fatalf("expected the bets to be stored once, got %v", documents)
+	}
+}
+
+func TestStorageDiscardsBetsThatWereNotCommitted(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	storage, err := NewStorage(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.StoreBatch(1, 7, 1, []Bet{testStoredBet(1, "1")}); err != nil {
+		t.Fatal(err)
+	}
+	storage.Close()
+
+	// A crash after writing the bets of the second batch but before
+	// committing its sequence
+	if err := StoreBets(path, []Bet{testStoredBet(1, "2")}); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = NewStorage(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if documents := storedDocuments(t, path); !reflect.DeepEqual(documents, []string{"1"}) {
+		t.Fatalf("expected the uncommitted bets to be discarded, got %v", documents)
+	}
+	if stored, err := storage.StoreBatch(1, 7, 2, []Bet{testStoredBet(1, "2")}); err != nil || !stored {
+		t.Fatalf("expected the retransmitted batch to be stored, got %v and %v", stored, err)
+	}
+	if documents := storedDocuments(t, path); !reflect.DeepEqual(documents, []string{"1", "2"}) {
+		t.Fatalf("expected the bets to be stored once, got %v", documents)
+	}
+}
+
+func TestStorageKeepsBetsWrittenBeforeTheStateFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	if err := StoreBets(path, []Bet{testStoredBet(1, "1")}); err != nil {
+		t.Fatal(err)
+	}
+	storage, err := NewStorage(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err := storage.StoreBatch(1, 7, 1, []Bet{testStoredBet(1, "2")}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(stateFilePath(path)); err != nil {
+		t.Fatalf("expected the state to be saved, got %v", err)
+	}
+	if documents := storedDocuments(t, path); !reflect.DeepEqual(documents, []string{"1", "2"}) {
+		t.Fatalf("expected the previous bets to be kept, got %v", documents)
+	}
+}
+
+func TestStorageDiscardsTheBetsOfAFailedCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bets.csv")
+	storage, err := NewStorage(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	if _, err := storage.StoreBatch(1, 7, 1, []Bet{testStoredBet(1, "1")}); err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory in place of the state file makes the commit fail
+	state := stateFilePath(path)
+	if err := os.Remove(state); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(state, "blocked"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := storage.StoreBatch(1, 7, 2, []Bet{testStoredBet(1, "2")}); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	if err := storage.StoreBets([]Bet{testStoredBet(1, "3")}); err == nil {
+		t.Fatal("expected the commit to fail")
+	}
+	if after, err := os.Stat(path); err != nil || after.Size() != info.Size() {
+		t.Fatalf("expected the bets file to keep %d bytes, got %v and %v", info.Size(), after, err)
+	}
+
+	if err := os.RemoveAll(state); err != nil {
+		t.Fatal(err)
+	}
+	if stored, err := storage.StoreBatch(1, 7, 2, []Bet{testStoredBet(1, "2")}); err != nil || !stored {
+		t.Fatalf("expected the retransmitted batch to be stored, got %v and %v", stored, err)
+	}
+	if stored, err := storage.StoreBatch(1, 7, 2, []Bet{testStoredBet(1, "2")}); err != nil || stored {
+		t.Fatalf("expected the batch to be applied once, got %v and %v", stored, err)
+	}
+	if documents := storedDocuments(t, path); !reflect.DeepEqual(documents, []string{"1", "2"}) {
+		t.Fatalf("expected the bets to be stored once, got %v", documents)
+	}
+}
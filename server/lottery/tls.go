@@ -0,0 +1,92 @@
+package lottery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrUnauthorizedAgency The agency is not allowed to use the connection,
+// either because its certificate is unknown or because it sent requests
+// under the ID of another agency
+var ErrUnauthorizedAgency = errors.New("agency not authorized")
+
+// NewTLSConfig Loads the certificate served to the agencies. If a client
+// CA bundle is given the agencies must present a certificate signed by it
+func NewTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load the TLS certificate")
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read the client CA bundle")
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.Errorf("no certificates found in %s", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ParseCertificateAgencies Parses a comma separated list of CN=ID pairs,
+// e.g. "agencia-1=1,agencia-2=2", mapping the common name of the agency
+// certificates to the ID they may submit bets under
+func ParseCertificateAgencies(raw string) (map[string]int, error) {
+	agencies := make(map[string]int)
+	for _, pair := range strings.Split(raw, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, errors.Errorf("invalid certificate mapping %q, expected CN=ID", pair)
+		}
+		id, err := strconv.Atoi(parts[1])
+		if err != nil || id < 0 {
+			return nil, errors.Errorf("invalid agency ID in certificate mapping %q", pair)
+		}
+		agencies[parts[0]] = id
+	}
+	return agencies, nil
+}
+
+// certificateAgency Returns the agency the peer certificate of the
+// connection belongs to, or -1 if no mapping is configured and so any
+// agency may use the connection
+func (s *Server) certificateAgency(conn net.Conn) (int, error) {
+	if len(s.config.CertificateAgencies) == 0 {
+		return -1, nil
+	}
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return 0, errors.Wrap(ErrUnauthorizedAgency, "connection without TLS")
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return 0, errors.Wrap(err, "TLS handshake failed")
+	}
+	certificates := tlsConn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return 0, errors.Wrap(ErrUnauthorizedAgency, "no client certificate")
+	}
+	name := certificates[0].Subject.CommonName
+	agency, ok := s.config.CertificateAgencies[name]
+	if !ok {
+		return 0, errors.Wrapf(ErrUnauthorizedAgency, "unknown certificate %q", name)
+	}
+	return agency, nil
+}
@@ -0,0 +1,116 @@
+package lottery
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/pkg/errors"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/internal/testcerts"
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/protocol"
+)
+
+// startTLSTestServer Starts a server that requires agency certificates
+// issued by the authority, mapping agencia-N to agency N
+func startTLSTestServer(t *testing.T, authority *testcerts.Authority) *Server {
+	t.Helper()
+	pair := authority.Issue(t, "server", "127.0.0.1")
+	config, err := NewTLSConfig(pair.CertFile, pair.KeyFile, authority.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return startConfiguredTestServer(t, ServerConfig{
+		Agencies:            2,
+		TLS:                 config,
+		CertificateAgencies: map[string]int{"agencia-1": 1, "agencia-2": 2},
+	})
+}
+
+// dialTLSTestServer Connects presenting a certificate with the given
+// common name, or none if it is empty
+func dialTLSTestServer(t *testing.T, server *Server, authority *testcerts.Authority, commonName string) net.Conn {
+	t.Helper()
+	pem, err := os.ReadFile(authority.CertFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &tls.Config{RootCAs: x509.NewCertPool()}
+	config.RootCAs.AppendCertsFromPEM(pem)
+	if commonName != "" {
+		pair := authority.Issue(t, commonName)
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	port := server.Addr().(*net.TCPAddr).Port
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), config)
+	if err != nil {
+		t.Fatalf("could not connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestServerAcceptsBetsOfTheCertificateAgency(t *testing.T) {
+	authority := testcerts.NewAuthority(t)
+	server := startTLSTestServer(t, authority)
+
+	conn := dialTLSTestServer(t, server, authority, "agencia-1")
+	res := exchange(t, conn, 1, &protocol.BetBatch{Bets: []protocol.Bet{testBet("1", "7574")}})
+	if ack, ok := res.(*protocol.Acknowledge); !ok || ack.Count != 1 {
+		t.Fatalf("expected an acknowledge of 1 bet, got %+v", res)
+	}
+}
+
+func TestServerRejectsUnauthorizedAgencies(t *testing.T) {
+	authority := testcerts.NewAuthority(t)
+	server := startTLSTestServer(t, authority)
+
+	for name, commonName := range map[string]string{
+		"other agency":        "agencia-2",
+		"unknown certificate": "agencia-9",
+		"no certificate":      "",
+	} {
+		conn := dialTLSTestServer(t, server, authority, commonName)
+		if err := protocol.WriteRequest(conn, 1, &protocol.BetBatch{Bets: []protocol.Bet{testBet("1", "7574")}}); err != nil {
+			continue
+		}
+		res, err := protocol.ReadResponse(conn)
+		if err != nil {
+			continue
+		}
+		if refused, ok := res.(*protocol.Error); !ok || refused.Code != protocol.CodeAgencyMismatch {
+			t.Errorf("%s: expected the request to be refused, got %+v", name, res)
+		}
+	}
+	stored := 0
+	if err := LoadBets(server.config.StoragePath, func(Bet) { stored++ }); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		t.Fatal(err)
+	}
+	if stored != 0 {
+		t.Fatalf("expected no bets to be stored, got %d", stored)
+	}
+}
+
+func TestParseCertificateAgencies(t *testing.T) {
+	agencies, err := ParseCertificateAgencies(" agencia-1=1, agencia-2=2,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := map[string]int{"agencia-1": 1, "agencia-2": 2}; !reflect.DeepEqual(agencies, expected) {
+		t.Fatalf("expected %v, got %v", expected, agencies)
+	}
+	for _, raw := range []string{"agencia-1", "=1", "agencia-1=one", "agencia-1=-1"} {
+		if _, err := ParseCertificateAgencies(raw); err == nil {
+			t.Errorf("expected %q to be rejected", raw)
+		}
+	}
+}
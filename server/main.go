@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/op/go-logging"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+
+	"github.com/7574-sistemas-distribuidos/docker-compose-init/server/lottery"
+)
+
+var log = logging.MustGetLogger("log")
+
+// InitConfig Function that uses viper library to parse configuration parameters.
+// Viper is configured to read variables from both environment variables and the
+// config file ./config.ini, the same one used by the python server. Environment
+// variables takes precedence over parameters defined in the configuration file.
+// If some of the variables cannot be found or parsed, an error is returned
+func InitConfig() (*viper.Viper, error) {
+	v := viper.New()
+
+	// Every parameter lives in the DEFAULT section of the ini file and
+	// is overridden by the env variable with the same name
+	v.BindEnv("default.server_port", "SERVER_PORT")
+	v.BindEnv("default.server_listen_backlog", "SERVER_LISTEN_BACKLOG")
+	v.BindEnv("default.logging_level", "LOGGING_LEVEL")
+	v.BindEnv("default.server_agencies", "SERVER_AGENCIES")
+	v.BindEnv("default.server_storage_path", "SERVER_STORAGE_PATH")
+	v.BindEnv("default.server_tls_cert", "SERVER_TLS_CERT")
+	v.BindEnv("default.server_tls_key", "SERVER_TLS_KEY")
+	v.BindEnv("default.server_tls_client_ca", "SERVER_TLS_CLIENT_CA")
+	v.BindEnv("default.server_tls_agencies", "SERVER_TLS_AGENCIES")
+	v.BindEnv("default.server_auth_secrets", "SERVER_AUTH_SECRETS")
+	v.BindEnv("default.server_handshake_timeout", "SERVER_HANDSHAKE_TIMEOUT")
+
+	v.SetDefault("default.server_storage_path", lottery.DefaultStorageFilepath)
+	v.SetDefault("default.server_handshake_timeout", lottery.DefaultHandshakeTimeout.String())
+
+	// Try to read configuration from config file. If config file
+	// does not exists then ReadInConfig will fail but configuration
+	// can be loaded from the environment variables so we shouldn't
+	// return an error in that case
+	v.SetConfigFile("./config.ini")
+	if err := v.ReadInConfig(); err != nil {
+		fmt.Printf("Configuration could not be read from config file. Using env variables instead")
+	}
+
+	for _, key := range []string{"server_port", "server_listen_backlog", "logging_level", "server_agencies"} {
+		if !v.IsSet("default." + key) {
+			return nil, errors.Errorf("Key %s was not found. Aborting server", key)
+		}
+	}
+	for _, key := range []string{"server_port", "server_listen_backlog", "server_agencies"} {
+		if _, err := strconv.Atoi(v.GetString("default." + key)); err != nil {
+			return nil, errors.Wrapf(err, "Key %s could not be parsed. Aborting server", key)
+		}
+	}
+
+	if _, err := time.ParseDuration(v.GetString("default.server_handshake_timeout")); err != nil {
+		return nil, errors.Wrapf(err, "Key server_handshake_timeout could not be parsed. Aborting server")
+	}
+
+	if v.GetString("default.server_tls_cert") == "" && v.GetString("default.server_tls_client_ca") != "" {
+		return nil, errors.Errorf("Key server_tls_client_ca requires server_tls_cert. Aborting server")
+	}
+	if v.GetString("default.server_tls_client_ca") == "" && v.GetString("default.server_tls_agencies") != "" {
+		return nil, errors.Errorf("Key server_tls_agencies requires server_tls_client_ca. Aborting server")
+	}
+
+	return v, nil
+}
+
+// InitTLS Loads the TLS configuration and the certificate to agency
+// mapping of the server. Returns a nil configuration if TLS is disabled
+func InitTLS(v *viper.Viper) (*tls.Config, map[string]int, error) {
+	if v.GetString("default.server_tls_cert") == "" {
+		return nil, nil, nil
+	}
+	config, err := lottery.NewTLSConfig(
+		v.GetString("default.server_tls_cert"),
+		v.GetString("default.server_tls_key"),
+		v.GetString("default.server_tls_client_ca"),
+	)
+	if err != nil {
+		return nil, nil, err
+	}
+	agencies, err := lottery.ParseCertificateAgencies(v.GetString("default.server_tls_agencies"))
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, agencies, nil
+}
+
+// InitLogger Receives the log level to be set in go-logging as a string. This method
+// parses the string and set the level to the logger. If the level string is not
+// valid an error is returned
+func InitLogger(logLevel string) error {
+	baseBackend := logging.NewLogBackend(os.Stdout, "", 0)
+	format := logging.MustStringFormatter(
+		`%{time:2006-01-02 15:04:05} %{level:-8s} %{message}`,
+	)
+	backendFormatter := logging.NewBackendFormatter(baseBackend, format)
+
+	backendLeveled := logging.AddModuleLevel(backendFormatter)
+	logLevelCode, err := logging.LogLevel(logLevel)
+	if err != nil {
+		return err
+	}
+	backendLeveled.SetLevel(logLevelCode, "")
+
+	// Set the backends to be used.
+	logging.SetBackend(backendLeveled)
+	return nil
+}
+
+// PrintConfig Print all the configuration parameters of the program.
+// For debugging purposes only
+func PrintConfig(v *viper.Viper) {
+	log.Debugf("action: config | result: success | port: %v | listen_backlog: %v | logging_level: %s | agencies: %v | storage_path: %s | tls: %v | auth: %v",
+		v.GetInt("default.server_port"),
+		v.GetInt("default.server_listen_backlog"),
+		v.GetString("default.logging_level"),
+		v.GetInt("default.server_agencies"),
+		v.GetString("default.server_storage_path"),
+		v.GetString("default.server_tls_cert") != "",
+		v.GetString("default.server_auth_secrets") != "",
+	)
+}
+
+func main() {
+	v, err := InitConfig()
+	if err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+
+	if err := InitLogger(v.GetString("default.logging_level")); err != nil {
+		log.Criticalf("%s", err)
+		os.Exit(1)
+	}
+
+	// Log config parameters at the beginning of the program to verify the configuration
+	// of the component
+	PrintConfig(v)
+
+	tlsConfig, certificateAgencies, err := InitTLS(v)
+	if err != nil {
+		log.Criticalf("action: init_tls | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+
+	// Agencies must authenticate with their shared secret when a secrets
+	// file is configured
+	var secrets map[int][]byte
+	if path := v.GetString("default.server_auth_secrets"); path != "" {
+		if secrets, err = lottery.LoadSecrets(path); err != nil {
+			log.Criticalf("action: init_auth | result: fail | error: %v", err)
+			os.Exit(1)
+		}
+	}
+
+	server, err := lottery.NewServer(lottery.ServerConfig{
+		Port:          v.GetInt("default.server_port"),
+		ListenBacklog: v.GetInt("default.server_listen_backlog"),
+		Agencies:      v.GetInt("default.server_agencies"),
+		StoragePath:   v.GetString("default.server_storage_path"),
+
+		TLS:                 tlsConfig,
+		CertificateAgencies: certificateAgencies,
+		Secrets:             secrets,
+		HandshakeTimeout:    v.GetDuration("default.server_handshake_timeout"),
+	})
+	if err != nil {
+		log.Criticalf("action: create_server | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+
+	// Stop accepting connections once SIGTERM is received
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		log.Infof("action: shutdown | result: in_progress | signal: %v", sig)
+		server.Shutdown()
+	}()
+
+	if err := server.Run(); err != nil {
+		log.Criticalf("action: run_server | result: fail | error: %v", err)
+		os.Exit(1)
+	}
+	log.Infof("action: shutdown | result: success")
+}